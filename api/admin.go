@@ -0,0 +1,172 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	signing "rocket-service/rockets-signing"
+
+	"github.com/gorilla/mux"
+)
+
+// Headers carrying the signature of a message.
+const (
+	signatureKeyHeader       = "X-Signature-Key"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureHeader          = "X-Signature"
+)
+
+// SetSigning makes POST /messages check signatures with keys. Unsigned
+// messages are refused for channels with a key, or for every channel when
+// required. Without keys, signatures are not checked.
+func (a *API) SetSigning(keys *signing.Keys, required bool) {
+	a.keys = keys
+	a.signaturesRequired = required
+}
+
+// SetAdminToken sets the bearer token of the /admin endpoints, which also
+// works as an admin API key. They are not found while the token is empty and
+// API keys are off.
+func (a *API) SetAdminToken(token string) {
+	a.adminToken = token
+}
+
+// verifySignature checks the signature headers of a message of channel
+// against its raw body.
+func (a *API) verifySignature(r *http.Request, channel string, body []byte) error {
+	if a.keys == nil {
+		return nil
+	}
+
+	keyID := r.Header.Get(signatureKeyHeader)
+	timestamp := r.Header.Get(signatureTimestampHeader)
+	mac := r.Header.Get(signatureHeader)
+	if keyID == "" && timestamp == "" && mac == "" {
+		required := a.signaturesRequired
+		if !required {
+			covered, err := a.keys.Covered(channel)
+			if err != nil {
+				return err
+			}
+			required = covered
+		}
+		if required {
+			return signing.ErrSignatureRequired
+		}
+		return nil
+	}
+
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || keyID == "" || mac == "" {
+		return signing.ErrInvalidSignature
+	}
+	return a.keys.Verify(signing.Signature{KeyID: keyID, Timestamp: signedAt, MAC: mac}, channel, body)
+}
+
+// admin only serves handler to requests with the admin token or, when API
+// keys are on, to those authorize let through with an admin key.
+func (a *API) admin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.adminToken == "" && a.apiKeys == nil || a.keys == nil {
+			writeProblem(w, r, http.StatusNotFound, "admin endpoints are disabled")
+			return
+		}
+		if a.apiKeys != nil {
+			handler(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeProblem(w, r, http.StatusUnauthorized, "a valid admin token is required")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (a *API) handleListKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := a.keys.List()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]signing.Key{"keys": keys})
+}
+
+type createKeyRequest struct {
+	Channel   string     `json:"channel"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+func (a *API) handleCreateKey(w http.ResponseWriter, r *http.Request) {
+	var req createKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Channel == "" {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("channel is required, %q for every channel", signing.AnyChannel))
+		return
+	}
+
+	key, err := a.keys.Create(req.Channel, req.ExpiresAt)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeKey(w, key)
+}
+
+type rotateKeyRequest struct {
+	// Overlap is how long the old key stays valid, such as "1h"
+	Overlap string `json:"overlap"`
+}
+
+func (a *API) handleRotateKey(w http.ResponseWriter, r *http.Request) {
+	var req rotateKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	var overlap time.Duration
+	if req.Overlap != "" {
+		var err error
+		overlap, err = time.ParseDuration(req.Overlap)
+		if err != nil || overlap < 0 {
+			writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("invalid overlap: %s", req.Overlap))
+			return
+		}
+	}
+
+	key, err := a.keys.Rotate(mux.Vars(r)["id"], overlap)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeKey(w, key)
+}
+
+func (a *API) handleRevokeKey(w http.ResponseWriter, r *http.Request) {
+	if err := a.keys.Revoke(mux.Vars(r)["id"]); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeKey replies with a new key, the only response holding its secret.
+func writeKey(w http.ResponseWriter, key *signing.Key) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	signing "rocket-service/rockets-signing"
+)
+
+const testAdminToken = "admin-secret"
+
+func adminRequest(t *testing.T, server *httptest.Server, method, path, token, body string) *http.Response {
+	req, _ := http.NewRequest(method, server.URL+path, bytes.NewBufferString(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	return resp
+}
+
+func createKey(t *testing.T, server *httptest.Server, path, body string) signing.Key {
+	resp := adminRequest(t, server, "POST", path, testAdminToken, body)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+	}
+	var key signing.Key
+	json.NewDecoder(resp.Body).Decode(&key)
+	if key.Secret == "" {
+		t.Fatalf("Expected the secret of the new key, got %+v", key)
+	}
+	return key
+}
+
+// signature returns the headers signing body with key at signedAt.
+func signature(key *signing.Key, signedAt time.Time, body []byte) []string {
+	return []string{
+		"X-Signature-Key", key.ID,
+		"X-Signature-Timestamp", strconv.FormatInt(signedAt.Unix(), 10),
+		"X-Signature", signing.Sign(key.Secret, signedAt.Unix(), body),
+	}
+}
+
+func TestSigning_Messages(t *testing.T) {
+	server, cleanup := setupTestServer(t, withSigning())
+	defer cleanup()
+	launched := loadTestMessage(t, "testdata/rocket_launched.json")
+
+	// Channels without a key still take unsigned messages
+	if status := postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched_chan1.json")).StatusCode; status != http.StatusOK {
+		t.Errorf("Expected unsigned message to be accepted, got %d", status)
+	}
+
+	key := createKey(t, server, "/admin/keys", `{"channel":"test-channel"}`)
+	if status := postMessage(t, server, launched).StatusCode; status != http.StatusUnauthorized {
+		t.Errorf("Expected unsigned message to be refused, got %d", status)
+	}
+	if status := postMessage(t, server, launched, signature(&key, time.Now().Add(-time.Hour), launched)...).StatusCode; status != http.StatusUnauthorized {
+		t.Errorf("Expected an old signature to be refused, got %d", status)
+	}
+	// The signature of another body does not match
+	if status := postMessage(t, server, launched, signature(&key, time.Now(), []byte("{}"))...).StatusCode; status != http.StatusUnauthorized {
+		t.Errorf("Expected a tampered message to be refused, got %d", status)
+	}
+	if status := postMessage(t, server, launched, signature(&key, time.Now(), launched)...).StatusCode; status != http.StatusOK {
+		t.Errorf("Expected signed message to be accepted, got %d", status)
+	}
+
+	// Rotating keeps the old key valid during the overlap
+	rotated := createKey(t, server, "/admin/keys/"+key.ID+"/rotate", `{"overlap":"1h"}`)
+	speedIncreased := loadTestMessage(t, "testdata/speed_increased.json")
+	for _, k := range []*signing.Key{&key, &rotated} {
+		if status := postMessage(t, server, speedIncreased, signature(k, time.Now(), speedIncreased)...).StatusCode; status != http.StatusOK {
+			t.Errorf("Expected key %s to be accepted, got %d", k.ID, status)
+		}
+	}
+
+	resp := adminRequest(t, server, "DELETE", "/admin/keys/"+key.ID, testAdminToken, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", resp.StatusCode)
+	}
+	if status := postMessage(t, server, speedIncreased, signature(&key, time.Now(), speedIncreased)...).StatusCode; status != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked key to be refused, got %d", status)
+	}
+	resp = adminRequest(t, server, "POST", "/admin/keys/"+key.ID+"/rotate", testAdminToken, `{"overlap":"1h"}`)
+	readProblem(t, resp)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected rotating the revoked key to be refused with 409, got %d", resp.StatusCode)
+	}
+}
+
+func TestSigning_Admin(t *testing.T) {
+	server, cleanup := setupTestServer(t, withSigning())
+	defer cleanup()
+	createKey(t, server, "/admin/keys", `{"channel":"*"}`)
+
+	for _, token := range []string{"", "wrong"} {
+		resp := adminRequest(t, server, "GET", "/admin/keys", token, "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 with token %q, got %d", token, resp.StatusCode)
+		}
+	}
+
+	resp := adminRequest(t, server, "GET", "/admin/keys", testAdminToken, "")
+	var list struct {
+		Keys []signing.Key `json:"keys"`
+	}
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Keys) != 1 || list.Keys[0].Channel != "*" || list.Keys[0].Secret != "" || !list.Keys[0].Active {
+		t.Errorf("Unexpected keys: %+v", list.Keys)
+	}
+
+	for _, tt := range []struct {
+		method, path, body string
+		expected           int
+	}{
+		{"POST", "/admin/keys", `{}`, http.StatusBadRequest},
+		{"POST", "/admin/keys/key_unknown/rotate", `{"overlap":"1h"}`, http.StatusNotFound},
+		{"POST", "/admin/keys/key_unknown/rotate", `{"overlap":"soon"}`, http.StatusBadRequest},
+		{"DELETE", "/admin/keys/key_unknown", "", http.StatusNotFound},
+	} {
+		resp := adminRequest(t, server, tt.method, tt.path, testAdminToken, tt.body)
+		readProblem(t, resp)
+		resp.Body.Close()
+		if resp.StatusCode != tt.expected {
+			t.Errorf("Expected status %d for %s %s, got %d", tt.expected, tt.method, tt.path, resp.StatusCode)
+		}
+	}
+
+	// Without a token the admin endpoints are off
+	disabled, cleanup := setupTestServer(t)
+	defer cleanup()
+	resp = adminRequest(t, disabled, "GET", "/admin/keys", "", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", resp.StatusCode)
+	}
+}
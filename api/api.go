@@ -1,52 +1,134 @@
 package api
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	auth "rocket-service/rockets-auth"
+	config "rocket-service/rockets-config"
 	inventory "rocket-service/rockets-inventory"
+	logging "rocket-service/rockets-logging"
+	metrics "rocket-service/rockets-metrics"
 	queries "rocket-service/rockets-queries"
+	ratelimit "rocket-service/rockets-ratelimit"
+	signing "rocket-service/rockets-signing"
 
 	"github.com/gorilla/mux"
+	"github.com/graphql-go/graphql"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type API struct {
-	inventory *inventory.Inventory
-	queries   *queries.Queries
+	inventory  *inventory.Inventory
+	queries    *queries.Queries
+	heartbeat  time.Duration
+	replayPage int
+	// closing is done once Serve shuts down, which ends streams and websockets
+	closing       context.Context
+	graphqlSchema graphql.Schema
+	metrics       *prometheus.Registry
+	features      config.Features
+	readiness     config.Readiness
+	// keys checks message signatures and is managed through /admin/keys
+	keys               *signing.Keys
+	signaturesRequired bool
+	adminToken         string
+	// apiKeys authenticates requests when set
+	apiKeys *auth.Store
+	// channelLimit, clientLimit and authFailureLimit are nil without a limit
+	channelLimit     *ratelimit.Limiter
+	clientLimit      *ratelimit.Limiter
+	authFailureLimit *ratelimit.Limiter
+	maxBodyBytes     int64
+	strictJSON       bool
+	cors             config.CORS
 }
 
 func NewAPI(inventory *inventory.Inventory, queries *queries.Queries) *API {
-	return &API{inventory, queries}
+	schema, err := newGraphQLSchema(queries)
+	if err != nil {
+		// The schema is fixed, so this is a programming error
+		panic(err)
+	}
+	// Only the inventory knows about the messages waiting in its buffers
+	queries.SetPendingCounter(inventory)
+
+	return &API{
+		inventory:     inventory,
+		queries:       queries,
+		heartbeat:     defaultHeartbeat,
+		replayPage:    defaultReplayPage,
+		closing:       context.Background(),
+		graphqlSchema: schema,
+		features:      config.Default().Features,
+		readiness:     config.Default().Readiness,
+		maxBodyBytes:  config.Default().MaxBodyBytes,
+		cors:          config.Default().CORS,
+		metrics: metrics.NewRegistry(metrics.Fleet{
+			BufferDepths:    inventory.BufferDepths,
+			RocketsByStatus: queries.RocketsByStatus,
+		}),
+	}
+}
+
+// SetFeatures turns the optional endpoints on or off. Call it before InitHandlers.
+func (a *API) SetFeatures(features config.Features) {
+	a.features = features
+}
+
+// SetDecoding sets the largest request body accepted and whether messages
+// are decoded strictly. See inventory.DecodeMessage.
+func (a *API) SetDecoding(maxBodyBytes int64, strict bool) {
+	a.maxBodyBytes = maxBodyBytes
+	a.strictJSON = strict
+}
+
+// SetReadiness sets the backlog thresholds checked by GET /readyz.
+func (a *API) SetReadiness(readiness config.Readiness) {
+	a.readiness = readiness
 }
 
 // Init initializes the database, modules, and HTTP router.
 // If dbPath is empty, uses in-memory SQLite.
 func Init(dbPath string) (*sql.DB, error) {
+	return Open(dbPath, config.Default().BusyTimeout)
+}
+
+// Open opens and migrates the database at dbPath, or an in-memory database
+// when it is empty. Queries wait up to busyTimeout for a locked database.
+func Open(dbPath string, busyTimeout time.Duration) (*sql.DB, error) {
+	params := fmt.Sprintf("?_busy_timeout=%d", busyTimeout.Milliseconds())
 	if dbPath == "" {
-		dbPath = ":memory:?_busy_timeout=5000"
+		dbPath = ":memory:" + params
 	} else {
-		dbPath += "?_busy_timeout=5000"
+		// WAL lets long reads, such as exports, run without blocking writes
+		dbPath += params + "&_journal_mode=WAL"
 	}
 
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, err
 	}
+	if strings.HasPrefix(dbPath, ":memory:") {
+		// Every connection to :memory: opens a new empty database
+		db.SetMaxOpenConns(1)
+	}
 
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS rockets (
-            channel TEXT PRIMARY KEY,
-            type TEXT,
-            speed INTEGER,
-            mission TEXT,
-            status TEXT,
-            last_message_number INTEGER DEFAULT 0
-        );
-    `)
-	if err != nil {
+	if err := migrate(db); err != nil {
 		db.Close()
 		return nil, err
 	}
@@ -54,35 +136,215 @@ func Init(dbPath string) (*sql.DB, error) {
 	return db, nil
 }
 
-func (a *API) Start() error {
+// Start serves the API on addr until ctx is done, then shuts down within
+// shutdownTimeout. See Serve.
+func (a *API) Start(ctx context.Context, addr string, shutdownTimeout time.Duration) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("Server starting", "addr", listener.Addr().String())
+	return a.Serve(ctx, listener, shutdownTimeout)
+}
 
-	r := a.InitHandlers()
+// Serve serves the API on listener until ctx is done. Shutting down stops
+// listening, ends streams and websockets, lets the requests in flight finish
+// and saves the buffered messages, all within shutdownTimeout. Requests still
+// running at the deadline are cancelled.
+func (a *API) Serve(ctx context.Context, listener net.Listener, shutdownTimeout time.Duration) error {
+	base, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+	closing, closeStreams := context.WithCancel(context.Background())
+	defer closeStreams()
+	a.closing = closing
+	server := &http.Server{
+		Handler:     a.InitHandlers(),
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
 
-	log.Println("Server starting on :8088")
-	return http.ListenAndServe(":8088", r)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Server shutting down", "timeout", shutdownTimeout)
+	deadline, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// Streams and websockets never finish on their own
+	closeStreams()
+	// Messages being handled are acknowledged before the buffers are saved
+	shutdownErr := server.Shutdown(deadline)
+	cancelBase()
+	drainErr := a.inventory.Drain(deadline)
+	return errors.Join(shutdownErr, drainErr)
 }
 
 func (a *API) InitHandlers() *mux.Router {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/messages", a.handleMessage).Methods("POST")
+	// Registered before /rockets/{channel} so they are not read as channels
+	r.HandleFunc("/rockets/stream", a.feature(a.features.Streams, a.handleStream)).Methods("GET")
+	r.HandleFunc("/rockets/ws", a.feature(a.features.WebSocket, a.handleWebSocket)).Methods("GET")
 	r.HandleFunc("/rockets/{channel}", a.handleRockets).Methods("GET")
+	r.HandleFunc("/rockets/{channel}/events", a.handleRocketEvents).Methods("GET")
+	r.HandleFunc("/rockets/{channel}/stream", a.feature(a.features.Streams, a.handleStream)).Methods("GET")
 	r.HandleFunc("/rockets", a.handleListRockets).Methods("GET")
+	r.HandleFunc("/stats", a.handleStats).Methods("GET")
+	r.HandleFunc("/missions", a.handleListMissions).Methods("GET")
+	r.HandleFunc("/missions/{name}", a.handleMission).Methods("GET")
+	r.HandleFunc("/graphql", a.feature(a.features.GraphQL, a.handleGraphQL)).Methods("GET", "POST")
+	r.HandleFunc("/admin/keys", a.admin(a.handleListKeys)).Methods("GET")
+	r.HandleFunc("/admin/keys", a.admin(a.handleCreateKey)).Methods("POST")
+	r.HandleFunc("/admin/keys/{id}/rotate", a.admin(a.handleRotateKey)).Methods("POST")
+	r.HandleFunc("/admin/keys/{id}", a.admin(a.handleRevokeKey)).Methods("DELETE")
+	r.HandleFunc("/healthz", a.handleHealth).Methods("GET")
+	r.HandleFunc("/readyz", a.handleReady).Methods("GET")
+	r.HandleFunc("/metrics", a.feature(a.features.Metrics, metrics.Handler(a.metrics).ServeHTTP)).Methods("GET")
+	r.HandleFunc("/openapi.json", a.handleOpenAPI).Methods("GET")
+	r.HandleFunc("/docs", a.handleDocs).Methods("GET")
+	r.Use(requestID, a.corsRoute, traceRoute, instrumentRoute, a.authorize, a.limitClient, a.limitBody)
+	// Middlewares only run for matched routes
+	r.NotFoundHandler = requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusNotFound, "")
+	}))
+	r.MethodNotAllowedHandler = requestID(a.preflight(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	})))
 
 	return r
 }
 
+// feature returns handler when its feature is enabled. Disabled features stay
+// routed, so their paths are not taken for rocket channels, but are not found.
+func (a *API) feature(enabled bool, handler http.HandlerFunc) http.HandlerFunc {
+	if enabled {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusNotFound, "this feature is disabled")
+	}
+}
+
+// maxRequestIDLength caps the X-Request-ID accepted from clients.
+const maxRequestIDLength = 128
+
+// requestID tags the logs of a request with its X-Request-ID, kept from the
+// request when it is a reasonable one and generated otherwise. The ID is sent
+// back in the response so clients can quote it.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := logging.With(r.Context(), slog.String("requestId", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validRequestID accepts IDs of printable ASCII, so they cannot break log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// limitBody caps the request bodies at maxBodyBytes. Bodies announced as
+// larger are refused at once; others fail to read past the limit.
+func (a *API) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > a.maxBodyBytes {
+			writeProblem(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", a.maxBodyBytes))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, a.maxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// instrumentRoute records the HTTP metrics of a request under the path
+// template of its route, so every rocket shares the same series.
+func instrumentRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, err := mux.CurrentRoute(r).GetPathTemplate()
+		if err != nil {
+			route = "unknown"
+		}
+		metrics.InstrumentHandler(route, next).ServeHTTP(w, r)
+	})
+}
+
 func (a *API) handleMessage(w http.ResponseWriter, r *http.Request) {
-	var msg inventory.RocketMessage
-	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
-		log.Printf("Error processing message %s", err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// Signatures cover the body as sent
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.As(err, new(*http.MaxBytesError)) {
+			status = http.StatusRequestEntityTooLarge
+			err = fmt.Errorf("message body exceeds %d bytes", a.maxBodyBytes)
+		}
+		metrics.ObserveMessage(metrics.UnknownType, metrics.Rejected)
+		slog.WarnContext(r.Context(), "Invalid message", "error", err)
+		writeProblem(w, r, status, err.Error())
+		return
+	}
+	msg, err := inventory.DecodeMessage(body, a.strictJSON)
+	if err != nil {
+		metrics.ObserveMessage(metrics.UnknownType, metrics.Rejected)
+		slog.WarnContext(r.Context(), "Invalid message", "error", err)
+		writeError(w, r, err)
 		return
 	}
 
-	if err := a.inventory.UpdateRocketState(msg); err != nil {
-		log.Printf("Error updating rocket inventory %s", err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// Every log line about the message, here or in the inventory, names it
+	r = r.WithContext(logging.With(r.Context(),
+		slog.String("channel", msg.Metadata.Channel), slog.Int("messageNumber", msg.Metadata.MessageNumber)))
+	if key := auth.FromContext(r.Context()); key != nil && !key.Allows(msg.Metadata.Channel) {
+		metrics.ObserveMessage(metrics.UnknownType, metrics.Rejected)
+		slog.WarnContext(r.Context(), "API key not scoped to channel")
+		writeError(w, r, auth.ErrForbidden)
+		return
+	}
+	if err := a.verifySignature(r, msg.Metadata.Channel, body); err != nil {
+		// Unauthenticated messages do not get their own series
+		metrics.ObserveMessage(metrics.UnknownType, metrics.Rejected)
+		if errorStatus(err) != http.StatusInternalServerError {
+			slog.WarnContext(r.Context(), "Message signature rejected", "error", err)
+		}
+		writeError(w, r, err)
+		return
+	}
+	// Only authentic messages count, so forged ones cannot use up the limit
+	if ok, wait := a.channelLimit.Allow(msg.Metadata.Channel); !ok {
+		metrics.ObserveMessage(metrics.UnknownType, metrics.Rejected)
+		throttle(w, r, channelScope, wait)
+		return
+	}
+	if err := a.inventory.UpdateRocketStateContext(r.Context(), msg); err != nil {
+		status := errorStatus(err)
+		if status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "1")
+		}
+		if status != http.StatusInternalServerError {
+			// Server errors are logged by writeError
+			slog.WarnContext(r.Context(), "Message rejected", "error", err)
+		}
+		writeError(w, r, err)
 		return
 	}
 
@@ -95,9 +357,27 @@ func (a *API) handleRockets(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	channel := vars["channel"]
 
-	rocket, err := a.queries.GetRocket(channel)
+	at, err := parseAt(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Past states never change, so only the current state is versioned
+	if at == nil {
+		if version, err := a.queries.RocketVersion(channel); err == nil && notModified(w, r, rocketETag(version), version.Modified) {
+			return
+		}
+	}
+
+	var rocket *queries.RocketState
+	if at == nil {
+		rocket, err = a.queries.GetRocket(channel)
+	} else {
+		rocket, err = a.queries.GetRocketAt(channel, *at)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
 
@@ -105,14 +385,217 @@ func (a *API) handleRockets(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(rocket)
 }
 
+func (a *API) handleRocketEvents(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+
+	opts, err := parseEventOptions(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	format, err := negotiateFormat(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if format != formatJSON {
+		a.exportEvents(w, r, channel, opts, format)
+		return
+	}
+
+	page, err := a.queries.ListEvents(channel, opts)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
 func (a *API) handleListRockets(w http.ResponseWriter, r *http.Request) {
-	sortBy := r.URL.Query().Get("sort_by")
-	rockets, err := a.queries.ListRockets(sortBy)
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	format, err := negotiateFormat(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if format != formatJSON {
+		a.exportRockets(w, r, opts, format)
+		return
+	}
+
+	// Read the version before the rockets, so a change made in between makes
+	// the next request fetch the list again
+	version, err := a.queries.FleetVersion()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
+	}
+	if notModified(w, r, fleetETag(version), version.Modified) {
+		return
+	}
+
+	page, err := a.queries.ListRockets(opts)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(rockets)
+	json.NewEncoder(w).Encode(page)
+}
+
+func (a *API) handleStats(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseRocketFilter(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	stats, err := a.queries.Stats(filter)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (a *API) handleListMissions(w http.ResponseWriter, r *http.Request) {
+	missions, err := a.queries.ListMissions()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(missions)
+}
+
+func (a *API) handleMission(w http.ResponseWriter, r *http.Request) {
+	mission, err := a.queries.GetMission(mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mission)
+}
+
+// parseEventOptions reads messageType, limit and cursor from the query string.
+func parseEventOptions(values url.Values) (queries.EventOptions, error) {
+	opts := queries.EventOptions{
+		MessageType: values.Get("messageType"),
+		Cursor:      values.Get("cursor"),
+	}
+
+	if _, exists := inventory.MessageHandlers[opts.MessageType]; opts.MessageType != "" && !exists {
+		return opts, fmt.Errorf("invalid message type: %s", opts.MessageType)
+	}
+
+	var err error
+	if opts.Limit, err = parseLimit(values); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// parseAt reads the at_message or at_time query parameter of a rocket
+// lookup. It returns nil when the current state is requested.
+func parseAt(values url.Values) (*queries.At, error) {
+	atMessage, atTime := values.Get("at_message"), values.Get("at_time")
+	switch {
+	case atMessage != "" && atTime != "":
+		return nil, fmt.Errorf("at_message and at_time are mutually exclusive")
+	case atMessage != "":
+		number, err := strconv.Atoi(atMessage)
+		if err != nil || number < 1 {
+			return nil, fmt.Errorf("invalid at_message: %s", atMessage)
+		}
+		return &queries.At{MessageNumber: number}, nil
+	case atTime != "":
+		t, err := time.Parse(time.RFC3339Nano, atTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid at_time: %s", atTime)
+		}
+		return &queries.At{Time: &t}, nil
+	}
+	return nil, nil
+}
+
+// parseListOptions reads filters, sort_by, order, limit and cursor from the query string.
+func parseListOptions(values url.Values) (queries.ListOptions, error) {
+	var opts queries.ListOptions
+	var err error
+
+	if opts.Filter, err = parseRocketFilter(values); err != nil {
+		return opts, err
+	}
+	if opts.SortBy, err = queries.ParseSort(values.Get("sort_by"), values.Get("order")); err != nil {
+		return opts, err
+	}
+	if opts.Limit, err = parseLimit(values); err != nil {
+		return opts, err
+	}
+	opts.Cursor = values.Get("cursor")
+
+	return opts, nil
+}
+
+// parseLimit reads the page size, returning zero when no limit is set.
+func parseLimit(values url.Values) (int, error) {
+	raw := values.Get("limit")
+	if raw == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > queries.MaxPageSize {
+		return 0, fmt.Errorf("limit must be between 1 and %d", queries.MaxPageSize)
+	}
+	return limit, nil
+}
+
+// parseRocketFilter reads the list filters from the query string:
+// status, type, mission, mission_prefix, min_speed and max_speed.
+func parseRocketFilter(values url.Values) (queries.RocketFilter, error) {
+	filter := queries.RocketFilter{
+		Status:        values.Get("status"),
+		Type:          values.Get("type"),
+		Mission:       values.Get("mission"),
+		MissionPrefix: values.Get("mission_prefix"),
+	}
+
+	var err error
+	if filter.MinSpeed, err = parseSpeed(values, "min_speed"); err != nil {
+		return filter, err
+	}
+	if filter.MaxSpeed, err = parseSpeed(values, "max_speed"); err != nil {
+		return filter, err
+	}
+
+	return filter, filter.Validate()
+}
+
+func parseSpeed(values url.Values, name string) (*int, error) {
+	raw := values.Get(name)
+	if raw == "" {
+		return nil, nil
+	}
+	speed, err := strconv.Atoi(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", name, raw)
+	}
+	return &speed, nil
 }
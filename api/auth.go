@@ -0,0 +1,112 @@
+package api
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	auth "rocket-service/rockets-auth"
+	logging "rocket-service/rockets-logging"
+
+	"github.com/gorilla/mux"
+)
+
+// routeRoles is the role each route needs, by path template. Routes missing
+// here are public.
+var routeRoles = map[string]auth.Role{
+	"/messages":                 auth.RoleIngest,
+	"/rockets":                  auth.RoleRead,
+	"/rockets/stream":           auth.RoleRead,
+	"/rockets/ws":               auth.RoleRead,
+	"/rockets/{channel}":        auth.RoleRead,
+	"/rockets/{channel}/events": auth.RoleRead,
+	"/rockets/{channel}/stream": auth.RoleRead,
+	"/stats":                    auth.RoleRead,
+	"/missions":                 auth.RoleRead,
+	"/missions/{name}":          auth.RoleRead,
+	"/graphql":                  auth.RoleRead,
+	"/admin/keys":               auth.RoleAdmin,
+	"/admin/keys/{id}/rotate":   auth.RoleAdmin,
+	"/admin/keys/{id}":          auth.RoleAdmin,
+}
+
+// publicRoutes are left open for probes, scrapers and the API documentation.
+var publicRoutes = map[string]bool{
+	"/healthz":      true,
+	"/readyz":       true,
+	"/metrics":      true,
+	"/openapi.json": true,
+	"/docs":         true,
+}
+
+// adminTokenKey stands for the admin token, which works as an admin API key.
+var adminTokenKey = &auth.Key{ID: "admin-token", Name: "admin token", Roles: []auth.Role{auth.RoleAdmin}}
+
+// SetAuth makes every route but the public ones require an API key of store
+// with the role of the route. Without a store, requests are anonymous.
+func (a *API) SetAuth(store *auth.Store) {
+	a.apiKeys = store
+}
+
+// authorize checks the API key of a request against the role of its route.
+// Keys scoped to channels may only use the routes of their channels: the
+// fleet-wide routes are forbidden to them, and handleMessage checks the
+// channel of each message.
+func (a *API) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := mux.CurrentRoute(r).GetPathTemplate()
+		role, ok := routeRoles[route]
+		if a.apiKeys == nil || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Failed attempts have no key to be limited by, so they count against
+		// their address, which is refused before its next attempt is checked
+		address := clientAddress(r)
+		if wait := a.authFailureLimit.Wait(address); wait > 0 {
+			throttle(w, r, addressScope, wait)
+			return
+		}
+		key, err := a.authenticate(r)
+		if err != nil {
+			if errorStatus(err) == http.StatusUnauthorized {
+				a.authFailureLimit.Allow(address)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			writeError(w, r, err)
+			return
+		}
+		ctx := logging.With(r.Context(), slog.String("apiKey", key.ID))
+		r = r.WithContext(auth.WithKey(ctx, key))
+
+		channel, named := mux.Vars(r)["channel"]
+		switch {
+		case !key.Has(role):
+			slog.WarnContext(r.Context(), "API key lacks role", "role", role)
+			writeError(w, r, auth.ErrForbidden)
+		case key.Scoped() && route != "/messages" && (!named || !key.Allows(channel)):
+			slog.WarnContext(r.Context(), "API key not scoped to route", "route", route)
+			writeError(w, r, auth.ErrForbidden)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// authenticate returns the key of the Authorization bearer token or of the
+// X-API-Key header.
+func (a *API) authenticate(r *http.Request) (*auth.Key, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.Header.Get("X-API-Key")
+	}
+	if token == "" {
+		return nil, auth.ErrUnauthenticated
+	}
+	if a.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) == 1 {
+		return adminTokenKey, nil
+	}
+	return a.apiKeys.Authenticate(token)
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	auth "rocket-service/rockets-auth"
+	inventory "rocket-service/rockets-inventory"
+	queries "rocket-service/rockets-queries"
+
+	"github.com/gorilla/mux"
+)
+
+func issueKey(t *testing.T, store *auth.Store, roles []auth.Role, channels ...string) (string, *auth.Key) {
+	token, key, err := store.Issue("test", roles, channels)
+	if err != nil {
+		t.Fatalf("Failed to issue key: %v", err)
+	}
+	return token, key
+}
+
+func TestAuth_Roles(t *testing.T) {
+	var store *auth.Store
+	server, cleanup := setupTestServer(t, withSigning(), withAuth(&store))
+	defer cleanup()
+	reader, _ := issueKey(t, store, []auth.Role{auth.RoleRead})
+	ingester, _ := issueKey(t, store, []auth.Role{auth.RoleIngest})
+	admin, _ := issueKey(t, store, []auth.Role{auth.RoleAdmin})
+	revoked, revokedKey := issueKey(t, store, []auth.Role{auth.RoleRead})
+	if err := store.Revoke(revokedKey.ID); err != nil {
+		t.Fatalf("Failed to revoke key: %v", err)
+	}
+	launched := loadTestMessage(t, "testdata/rocket_launched.json")
+
+	for _, tt := range []struct {
+		name, method, path, token string
+		body                      []byte
+		expected                  int
+	}{
+		{"anonymous read", "GET", "/rockets", "", nil, http.StatusUnauthorized},
+		{"anonymous ingest", "POST", "/messages", "", launched, http.StatusUnauthorized},
+		{"unknown key", "GET", "/rockets", "rk_unknown", nil, http.StatusUnauthorized},
+		{"revoked key", "GET", "/rockets", revoked, nil, http.StatusUnauthorized},
+		{"health is public", "GET", "/healthz", "", nil, http.StatusOK},
+		{"metrics are public", "GET", "/metrics", "", nil, http.StatusOK},
+		{"reader ingests", "POST", "/messages", reader, launched, http.StatusForbidden},
+		{"ingester ingests", "POST", "/messages", ingester, launched, http.StatusOK},
+		{"ingester reads", "GET", "/rockets/test-channel", ingester, nil, http.StatusForbidden},
+		{"reader reads", "GET", "/rockets/test-channel", reader, nil, http.StatusOK},
+		{"reader manages keys", "GET", "/admin/keys", reader, nil, http.StatusForbidden},
+		{"admin manages keys", "GET", "/admin/keys", admin, nil, http.StatusOK},
+		{"admin reads", "GET", "/stats", admin, nil, http.StatusOK},
+		{"admin token", "GET", "/admin/keys", testAdminToken, nil, http.StatusOK},
+	} {
+		resp := adminRequest(t, server, tt.method, tt.path, tt.token, string(tt.body))
+		resp.Body.Close()
+		if resp.StatusCode != tt.expected {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.expected, resp.StatusCode)
+		}
+	}
+
+	// X-API-Key works like the bearer token
+	req, _ := http.NewRequest("GET", server.URL+"/rockets", nil)
+	req.Header.Set("X-API-Key", reader)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 with X-API-Key, got %d", resp.StatusCode)
+	}
+}
+
+func TestAuth_Channels(t *testing.T) {
+	var store *auth.Store
+	server, cleanup := setupTestServer(t, withSigning(), withAuth(&store))
+	defer cleanup()
+	scoped, _ := issueKey(t, store, []auth.Role{auth.RoleIngest, auth.RoleRead}, "test-channel")
+
+	for _, tt := range []struct {
+		name, method, path string
+		body               []byte
+		expected           int
+	}{
+		{"own channel", "POST", "/messages", loadTestMessage(t, "testdata/rocket_launched.json"), http.StatusOK},
+		{"other channel", "POST", "/messages", loadTestMessage(t, "testdata/rocket_launched_chan1.json"), http.StatusForbidden},
+		{"own rocket", "GET", "/rockets/test-channel", nil, http.StatusOK},
+		{"own events", "GET", "/rockets/test-channel/events", nil, http.StatusOK},
+		{"other rocket", "GET", "/rockets/chan1", nil, http.StatusForbidden},
+		{"fleet", "GET", "/rockets", nil, http.StatusForbidden},
+		{"stats", "GET", "/stats", nil, http.StatusForbidden},
+	} {
+		resp := adminRequest(t, server, tt.method, tt.path, scoped, string(tt.body))
+		resp.Body.Close()
+		if resp.StatusCode != tt.expected {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.expected, resp.StatusCode)
+		}
+	}
+
+	// The refused message was not applied
+	resp := adminRequest(t, server, "GET", "/rockets/chan1", testAdminToken, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected chan1 to be unknown, got %d", resp.StatusCode)
+	}
+}
+
+// TestAuth_EveryRouteHasRole keeps new routes from being left public by
+// mistake.
+func TestAuth_EveryRouteHasRole(t *testing.T) {
+	db, err := Init("")
+	if err != nil {
+		t.Fatalf("Failed to initialize server: %v", err)
+	}
+	defer db.Close()
+	router := NewAPI(inventory.NewInventory(db), queries.NewQueries(db)).InitHandlers()
+
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		if _, ok := routeRoles[template]; !ok && !publicRoutes[template] {
+			t.Errorf("Route %s has no role and is not public", template)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	queries "rocket-service/rockets-queries"
+)
+
+func rocketETag(v *queries.Version) string {
+	return fmt.Sprintf(`"%d-%d"`, v.Number, v.Pending)
+}
+
+func fleetETag(v *queries.Version) string {
+	return fmt.Sprintf(`"fleet-%d-%x"`, v.Number, v.Pending)
+}
+
+// notModified sets the ETag and Last-Modified headers of a response and
+// checks the If-None-Match and If-Modified-Since preconditions. It returns
+// true after writing a 304 response when the client copy is still current.
+// As in RFC 9110, If-Modified-Since is ignored when If-None-Match is present.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatches(inm, etag) {
+			return false
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		since, err := http.ParseTime(ims)
+		if err != nil || modified.Truncate(time.Second).After(since) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches compares an If-None-Match header with an ETag using the weak
+// comparison required for GET requests.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	config "rocket-service/rockets-config"
+)
+
+// exposedHeaders are the response headers scripts of other origins may read.
+const exposedHeaders = "ETag, Last-Modified, Retry-After, X-Request-ID"
+
+// SetCORS lets browser pages of other origins call the API. Call it before
+// InitHandlers.
+func (a *API) SetCORS(cors config.CORS) {
+	a.cors = cors
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin of origin, or "" when
+// the origin is not allowed.
+func (a *API) allowedOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range a.cors.AllowedOrigins {
+		switch {
+		// Echoing any origin with credentials would let every site read
+		// responses as the user, so * only matches without them
+		case allowed == "*" && !a.cors.AllowCredentials:
+			return "*"
+		case strings.EqualFold(allowed, origin):
+			return origin
+		}
+	}
+	return ""
+}
+
+// corsHeaders adds the headers letting origin read the response.
+func (a *API) corsHeaders(w http.ResponseWriter, origin string) {
+	w.Header().Add("Vary", "Origin")
+	allowed := a.allowedOrigin(origin)
+	if allowed == "" {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	w.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+	if a.cors.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// corsRoute lets the allowed origins read the responses of the routes. It runs
+// before authorize, so that errors can be read too.
+func (a *API) corsRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(a.cors.AllowedOrigins) > 0 {
+			a.corsHeaders(w, r.Header.Get("Origin"))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// preflight answers the OPTIONS requests browsers send before a cross-origin
+// request. No route serves OPTIONS, so the router hands them to its method
+// not allowed handler, which preflight wraps; paths without a route stay not
+// found.
+func (a *API) preflight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		method := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || origin == "" || method == "" || len(a.cors.AllowedOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		allowed := a.allowedOrigin(origin)
+		if allowed == "" {
+			writeProblem(w, r, http.StatusForbidden, "origin not allowed")
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(a.cors.AllowedMethods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(a.cors.AllowedHeaders, ", "))
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(a.cors.MaxAge.Seconds())))
+		if a.cors.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// checkOrigin accepts websockets opened from the host of the API, or from
+// the origins allowed by CORS.
+func (a *API) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || a.allowedOrigin(origin) != "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
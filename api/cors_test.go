@@ -0,0 +1,148 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+const dashboardOrigin = "https://dashboard.example.com"
+
+func corsRequest(t *testing.T, server *httptest.Server, method, path, origin string, headers map[string]string) *http.Response {
+	req, _ := http.NewRequest(method, server.URL+path, nil)
+	req.Header.Set("Origin", origin)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCORS_Preflight(t *testing.T) {
+	server, cleanup := setupTestServer(t, withCORS(false, dashboardOrigin))
+	defer cleanup()
+	preflight := map[string]string{
+		"Access-Control-Request-Method":  "GET",
+		"Access-Control-Request-Headers": "authorization",
+	}
+
+	resp := corsRequest(t, server, "OPTIONS", "/rockets", dashboardOrigin, preflight)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+	}
+	for name, expected := range map[string]string{
+		"Access-Control-Allow-Origin":  dashboardOrigin,
+		"Access-Control-Allow-Methods": "GET, POST, DELETE",
+		"Access-Control-Allow-Headers": "Authorization, Content-Type, X-API-Key, X-Request-ID",
+		"Access-Control-Max-Age":       "300",
+	} {
+		if value := resp.Header.Get(name); value != expected {
+			t.Errorf("Expected %s %q, got %q", name, expected, value)
+		}
+	}
+	if resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Error("Expected no credentials to be allowed")
+	}
+
+	for _, tt := range []struct {
+		name, path, origin string
+		expected           int
+	}{
+		{"other origin", "/rockets", "https://evil.example.com", http.StatusForbidden},
+		{"unknown route", "/satellites", dashboardOrigin, http.StatusNotFound},
+		{"route with a channel", "/rockets/test-channel/events", dashboardOrigin, http.StatusNoContent},
+	} {
+		if resp := corsRequest(t, server, "OPTIONS", tt.path, tt.origin, preflight); resp.StatusCode != tt.expected {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.expected, resp.StatusCode)
+		}
+	}
+
+	// Without allowed origins OPTIONS is not allowed, as before
+	disabled, cleanupDisabled := setupTestServer(t)
+	defer cleanupDisabled()
+	if resp := corsRequest(t, disabled, "OPTIONS", "/rockets", dashboardOrigin, preflight); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 without CORS, got %d", resp.StatusCode)
+	}
+}
+
+func TestCORS_SimpleRequests(t *testing.T) {
+	server, cleanup := setupTestServer(t, withCORS(true, dashboardOrigin, "http://localhost:3000"))
+	defer cleanup()
+
+	resp := corsRequest(t, server, "GET", "/rockets", dashboardOrigin, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != dashboardOrigin {
+		t.Errorf("Expected the origin to be allowed, got %q", origin)
+	}
+	if resp.Header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("Expected credentials to be allowed")
+	}
+	if !strings.Contains(resp.Header.Get("Access-Control-Expose-Headers"), "X-Request-ID") {
+		t.Errorf("Expected X-Request-ID to be exposed, got %q", resp.Header.Get("Access-Control-Expose-Headers"))
+	}
+	// Caches must keep the response of each origin apart
+	if vary := resp.Header.Values("Vary"); !strings.Contains(strings.Join(vary, ","), "Origin") {
+		t.Errorf("Expected Vary to include Origin, got %v", vary)
+	}
+
+	// Errors can be read too
+	resp = corsRequest(t, server, "GET", "/rockets/unknown", dashboardOrigin, nil)
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Access-Control-Allow-Origin") != dashboardOrigin {
+		t.Errorf("Expected a readable 404, got %d with origin %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+
+	resp = corsRequest(t, server, "GET", "/rockets", "https://evil.example.com", nil)
+	if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("Expected another origin not to be allowed, got %q", origin)
+	}
+}
+
+func TestCORS_AnyOrigin(t *testing.T) {
+	server, cleanup := setupTestServer(t, withCORS(false, "*"))
+	defer cleanup()
+	resp := corsRequest(t, server, "GET", "/stats", "https://anywhere.example.com", nil)
+	if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("Expected any origin to be allowed, got %q", origin)
+	}
+}
+
+func TestCORS_AnyOriginWithCredentials(t *testing.T) {
+	// Configuration refuses this, but the API must not rely on it
+	server, cleanup := setupTestServer(t, withCORS(true, "*"))
+	defer cleanup()
+
+	resp := corsRequest(t, server, "GET", "/stats", "https://anywhere.example.com", nil)
+	if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("Expected no origin to be allowed with credentials, got %q", origin)
+	}
+	preflight := map[string]string{"Access-Control-Request-Method": "GET"}
+	if resp := corsRequest(t, server, "OPTIONS", "/stats", "https://anywhere.example.com", preflight); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the preflight to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestCORS_WebSocketOrigins(t *testing.T) {
+	server, cleanup := setupTestServer(t, withCORS(false, dashboardOrigin))
+	defer cleanup()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/rockets/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {dashboardOrigin}})
+	if err != nil {
+		t.Fatalf("Expected the allowed origin to connect: %v", err)
+	}
+	conn.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example.com"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected another origin to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	auth "rocket-service/rockets-auth"
+	inventory "rocket-service/rockets-inventory"
+	queries "rocket-service/rockets-queries"
+	signing "rocket-service/rockets-signing"
+)
+
+// problem is the body of every error response, following RFC 9457 problem
+// details. Errors have no type of their own, so Title is the status text.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Field is the offending field of an invalid message, such as
+	// message.launchSpeed
+	Field string `json:"field,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	sendProblem(w, r, problem{Status: status, Detail: detail})
+}
+
+func sendProblem(w http.ResponseWriter, r *http.Request, p problem) {
+	p.Type = "about:blank"
+	p.Title = http.StatusText(p.Status)
+	p.Instance = r.URL.Path
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// errorStatus maps the errors of the inventory, the queries, the signing keys
+// and the API keys to a status code. Any other error is a failure of the database or the server.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, queries.ErrRocketNotFound), errors.Is(err, queries.ErrMissionNotFound),
+		errors.Is(err, signing.ErrKeyNotFound), errors.Is(err, auth.ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, auth.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, signing.ErrKeyInactive):
+		return http.StatusConflict
+	case errors.Is(err, auth.ErrUnauthenticated),
+		errors.Is(err, signing.ErrSignatureRequired),
+		errors.Is(err, signing.ErrInvalidSignature),
+		errors.Is(err, signing.ErrSignatureExpired):
+		return http.StatusUnauthorized
+	case errors.Is(err, queries.ErrInvalidCursor),
+		errors.Is(err, inventory.ErrInvalidMessageType),
+		errors.Is(err, inventory.ErrInvalidMessage),
+		errors.Is(err, auth.ErrInvalidRole):
+		return http.StatusBadRequest
+	case errors.Is(err, inventory.ErrBufferFull), errors.Is(err, inventory.ErrShuttingDown):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError replies with the problem matching err. Server errors are logged
+// and their details kept from the client.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		slog.ErrorContext(r.Context(), "Error serving request", "method", r.Method, "path", r.URL.Path, "error", err)
+		writeProblem(w, r, status, "")
+		return
+	}
+	p := problem{Status: status, Detail: err.Error()}
+	var fieldErr *inventory.FieldError
+	if errors.As(err, &fieldErr) {
+		p.Field = fieldErr.Field
+	}
+	sendProblem(w, r, p)
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	inventory "rocket-service/rockets-inventory"
+	queries "rocket-service/rockets-queries"
+	"strings"
+	"testing"
+)
+
+func readProblem(t *testing.T, resp *http.Response) problem {
+	t.Helper()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "application/problem+json" {
+		t.Errorf("Expected application/problem+json, got %s", contentType)
+	}
+	var p problem
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		t.Fatalf("Invalid problem body: %v", err)
+	}
+	if p.Status != resp.StatusCode || p.Title != http.StatusText(resp.StatusCode) {
+		t.Errorf("Problem %+v does not match status %d", p, resp.StatusCode)
+	}
+	return p
+}
+
+func TestErrors_Problems(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for _, tt := range []struct {
+		name           string
+		method, path   string
+		body           string
+		expectedStatus int
+		expectedDetail string
+	}{
+		{"unknown rocket", "GET", "/rockets/non-existent", "", http.StatusNotFound, "rocket not found"},
+		{"unknown rocket events", "GET", "/rockets/non-existent/events", "", http.StatusNotFound, "rocket not found"},
+		{"invalid filter", "GET", "/rockets?status=orbiting", "", http.StatusBadRequest, "invalid status: orbiting"},
+		{"invalid cursor", "GET", "/rockets?cursor=nope", "", http.StatusBadRequest, "invalid cursor"},
+		{"unknown route", "GET", "/satellites", "", http.StatusNotFound, ""},
+		{"method not allowed", "DELETE", "/rockets", "", http.StatusMethodNotAllowed, ""},
+		{"invalid message type", "POST", "/messages",
+			`{"metadata":{"channel":"c","messageNumber":1,"messageType":"RocketLanded"},"message":{}}`,
+			http.StatusBadRequest, "invalid message type: RocketLanded"},
+		{"invalid message", "POST", "/messages",
+			`{"metadata":{"channel":"c","messageNumber":1,"messageType":"RocketLaunched"},"message":{"launchSpeed":"fast"}}`,
+			http.StatusBadRequest, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, server.URL+tt.path, bytes.NewBufferString(tt.body))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			p := readProblem(t, resp)
+			if tt.expectedDetail != "" && p.Detail != tt.expectedDetail {
+				t.Errorf("Expected detail %q, got %q", tt.expectedDetail, p.Detail)
+			}
+		})
+	}
+}
+
+func TestErrors_StorageFailure(t *testing.T) {
+	db, err := Init("")
+	if err != nil {
+		t.Fatalf("Failed to initialize server: %v", err)
+	}
+	api := NewAPI(inventory.NewInventory(db), queries.NewQueries(db))
+	server := httptest.NewServer(api.InitHandlers())
+	defer server.Close()
+
+	// A closed database fails every query, which must not look like a missing rocket
+	db.Close()
+
+	for _, path := range []string{"/rockets/test-channel", "/rockets", "/stats"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("Expected status 500 for %s, got %d", path, resp.StatusCode)
+		}
+		if p := readProblem(t, resp); p.Detail != "" {
+			t.Errorf("Expected no detail for %s, got %q", path, p.Detail)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestErrors_BufferFull(t *testing.T) {
+	db, err := Init("")
+	if err != nil {
+		t.Fatalf("Failed to initialize server: %v", err)
+	}
+	defer db.Close()
+	inv := inventory.NewInventory(db)
+	inv.SetBufferLimits(1, 0)
+	server := httptest.NewServer(NewAPI(inv, queries.NewQueries(db)).InitHandlers())
+	defer server.Close()
+
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased_3.json"))
+
+	body := loadTestMessage(t, "testdata/speed_increased.json")
+	resp, err := http.Post(server.URL+"/messages", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Failed to post message: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After, got %d", resp.StatusCode)
+	}
+	readProblem(t, resp)
+}
+
+func TestErrors_StrictMessages(t *testing.T) {
+	db, err := Init("")
+	if err != nil {
+		t.Fatalf("Failed to initialize server: %v", err)
+	}
+	defer db.Close()
+	api := NewAPI(inventory.NewInventory(db), queries.NewQueries(db))
+	api.SetDecoding(512, true)
+	server := httptest.NewServer(api.InitHandlers())
+	defer server.Close()
+
+	const metadata = `"metadata":{"channel":"c","messageNumber":1,"messageTime":"2022-02-02T19:39:05.86337+01:00","messageType":"RocketLaunched"}`
+	for _, tt := range []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedField  string
+	}{
+		{"valid", `{` + metadata + `,"message":{"type":"Falcon-9","launchSpeed":500,"mission":"ARTEMIS"}}`, http.StatusOK, ""},
+		{"unknown payload field", `{` + metadata + `,"message":{"launchSpeed":500,"color":"red"}}`, http.StatusBadRequest, "message.color"},
+		{"wrong type", `{` + metadata + `,"message":{"launchSpeed":"fast"}}`, http.StatusBadRequest, "message.launchSpeed"},
+		{"trailing data", `{` + metadata + `,"message":{}}{}`, http.StatusBadRequest, ""},
+		{"too large", `{` + metadata + `,"message":{"mission":"` + strings.Repeat("A", 512) + `"}}`, http.StatusRequestEntityTooLarge, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(server.URL+"/messages", "application/json", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("Failed to post message: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if tt.expectedStatus == http.StatusOK {
+				return
+			}
+			if p := readProblem(t, resp); p.Field != tt.expectedField {
+				t.Errorf("Expected field %q, got %q (%s)", tt.expectedField, p.Field, p.Detail)
+			}
+		})
+	}
+
+	// Without a Content-Length the body is cut while read
+	chunked := struct{ io.Reader }{strings.NewReader(strings.Repeat(" ", 1024))}
+	resp, err := http.Post(server.URL+"/messages", "application/json", chunked)
+	if err != nil {
+		t.Fatalf("Failed to post message: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413 for a chunked body, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	queries "rocket-service/rockets-queries"
+)
+
+// Formats lists can be exported in besides the default JSON document.
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+var formatTypes = map[string]string{
+	formatJSON:   "application/json",
+	formatCSV:    "text/csv",
+	formatNDJSON: "application/x-ndjson",
+}
+
+// negotiateFormat picks the response format of a list from the format query
+// parameter or, without it, the preferred supported type in Accept. JSON is
+// used when nothing else is asked for.
+func negotiateFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if _, ok := formatTypes[format]; !ok {
+			return "", fmt.Errorf("invalid format: %s", format)
+		}
+		return format, nil
+	}
+
+	best, bestQ := formatJSON, 0.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(raw, 64); err != nil {
+				continue
+			}
+		}
+		for format, contentType := range formatTypes {
+			if mediaType == contentType && q > bestQ {
+				best, bestQ = format, q
+			}
+		}
+	}
+	return best, nil
+}
+
+// rowWriter writes the rows of an export as they are read from the database.
+type rowWriter interface {
+	header(columns []string) error
+	row(values []string, object interface{}) error
+	close() error
+}
+
+func newRowWriter(w http.ResponseWriter, format string) rowWriter {
+	w.Header().Set("Content-Type", formatTypes[format])
+	if format == formatCSV {
+		return &csvWriter{csv.NewWriter(w)}
+	}
+	return &ndjsonWriter{json.NewEncoder(w)}
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) header(columns []string) error {
+	return c.w.Write(columns)
+}
+
+func (c *csvWriter) row(values []string, _ interface{}) error {
+	for i, value := range values {
+		values[i] = csvCell(value)
+	}
+	return c.w.Write(values)
+}
+
+// csvCell keeps spreadsheets from running a cell as a formula: text starting
+// with a formula character is prefixed with a quote. Numbers are left as is.
+func csvCell(value string) string {
+	if value == "" || !strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return value
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return value
+	}
+	return "'" + value
+}
+
+func (c *csvWriter) close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func (n *ndjsonWriter) header([]string) error {
+	return nil
+}
+
+func (n *ndjsonWriter) row(_ []string, object interface{}) error {
+	return n.enc.Encode(object)
+}
+
+func (n *ndjsonWriter) close() error {
+	return nil
+}
+
+var csvRocketColumns = []string{
+	"channel", "type", "speed", "mission", "status",
+	"lastMessageNumber", "lastMessageTime", "launchedAt", "updatedAt", "pendingMessages",
+}
+
+// exportRockets streams every rocket matching the filter and sort of opts.
+// Errors before the first rocket are reported with their status.
+func (a *API) exportRockets(w http.ResponseWriter, r *http.Request, opts queries.ListOptions, format string) {
+	if opts.Limit > 0 || opts.Cursor != "" {
+		writeProblem(w, r, http.StatusBadRequest, "limit and cursor are not supported when exporting")
+		return
+	}
+
+	var out rowWriter
+	err := a.queries.EachRocket(opts.Filter, opts.SortBy, func(rocket queries.RocketState) error {
+		if out == nil {
+			out = newRowWriter(w, format)
+			if err := out.header(csvRocketColumns); err != nil {
+				return err
+			}
+		}
+		return out.row([]string{
+			rocket.Channel,
+			stringCell(rocket.Type),
+			intCell(rocket.Speed),
+			stringCell(rocket.Mission),
+			stringCell(rocket.Status),
+			strconv.Itoa(rocket.LastMessageNumber),
+			stringCell(rocket.LastMessageTime),
+			stringCell(rocket.LaunchedAt),
+			stringCell(rocket.UpdatedAt),
+			intCell(rocket.PendingMessages),
+		}, rocket)
+	})
+	if out == nil {
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		// No rocket matched: still send the header
+		out = newRowWriter(w, format)
+		out.header(csvRocketColumns)
+	}
+	finishExport(r, out, err)
+}
+
+var csvEventColumns = []string{"messageNumber", "messageTime", "messageType", "message", "speed", "status"}
+
+// exportEvents streams the events of a rocket matching opts. Unknown rockets
+// are reported before anything is written.
+func (a *API) exportEvents(w http.ResponseWriter, r *http.Request, channel string, opts queries.EventOptions, format string) {
+	if opts.Limit > 0 || opts.Cursor != "" {
+		writeProblem(w, r, http.StatusBadRequest, "limit and cursor are not supported when exporting")
+		return
+	}
+
+	var out rowWriter
+	err := a.queries.EachEvent(channel, opts, func(e queries.RocketEvent) error {
+		if out == nil {
+			out = newRowWriter(w, format)
+			if err := out.header(csvEventColumns); err != nil {
+				return err
+			}
+		}
+		return out.row([]string{
+			strconv.Itoa(e.MessageNumber),
+			e.MessageTime,
+			e.MessageType,
+			string(e.Message),
+			intCell(e.Speed),
+			stringCell(e.Status),
+		}, e)
+	})
+	if out == nil {
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		// The filter matched no event: still send the header
+		out = newRowWriter(w, format)
+		out.header(csvEventColumns)
+	}
+	finishExport(r, out, err)
+}
+
+// finishExport flushes an export. Once rows have been sent the status can no
+// longer change, so a failure only cuts the response short.
+func finishExport(r *http.Request, out rowWriter, err error) {
+	if err == nil {
+		err = out.close()
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error exporting rows", "path", r.URL.Path, "error", err)
+	}
+}
+
+func stringCell(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func intCell(i *int) string {
+	if i == nil {
+		return ""
+	}
+	return strconv.Itoa(*i)
+}
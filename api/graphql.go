@@ -0,0 +1,492 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	queries "rocket-service/rockets-queries"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// Limits on GraphQL queries. Every field costs one point and the fields
+// below a list are counted once per item the list can hold.
+const (
+	maxQueryDepth      = 8
+	maxQueryComplexity = 2000
+	// defaultListSize is the page size of lists queried without a limit
+	defaultListSize = 100
+)
+
+// Fields returning a page whose size is set by their limit argument. The
+// list inside the page has the same name.
+var listFields = map[string]bool{
+	"rockets": true,
+	"events":  true,
+}
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// handleGraphQL executes queries sent as JSON in a POST body or in the
+// query, variables and operationName parameters of a GET request.
+func (a *API) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	if r.Method == http.MethodGet {
+		values := r.URL.Query()
+		req.Query = values.Get("query")
+		req.OperationName = values.Get("operationName")
+		if variables := values.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				writeGraphQLError(w, "invalid variables: "+err.Error())
+				return
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeGraphQLError(w, "invalid request: "+err.Error())
+		return
+	}
+
+	if err := checkQueryLimits(req.Query, req.Variables); err != nil {
+		writeGraphQLError(w, err.Error())
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         a.graphqlSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        r.Context(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func writeGraphQLError(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"message": message}},
+	})
+}
+
+// checkQueryLimits rejects queries nested deeper than maxQueryDepth or
+// costing more than maxQueryComplexity. Syntax errors are left to the
+// executor, which reports them with their location.
+func checkQueryLimits(query string, variables map[string]interface{}) error {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return nil
+	}
+
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, def := range doc.Definitions {
+		if fragment, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[fragment.Name.Value] = fragment
+		}
+	}
+
+	for _, def := range doc.Definitions {
+		operation, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		defaults := map[string]ast.Value{}
+		for _, v := range operation.VariableDefinitions {
+			if v.DefaultValue != nil {
+				defaults[v.Variable.Name.Value] = v.DefaultValue
+			}
+		}
+		c := &queryCost{fragments: fragments, variables: variables, defaults: defaults, visiting: map[string]bool{}}
+		cost, depth := c.selectionSet(operation.SelectionSet, "", 1)
+		if depth > maxQueryDepth {
+			return fmt.Errorf("query depth %d exceeds the maximum of %d", depth, maxQueryDepth)
+		}
+		if cost > maxQueryComplexity {
+			return fmt.Errorf("query complexity %d exceeds the maximum of %d", cost, maxQueryComplexity)
+		}
+	}
+	return nil
+}
+
+type queryCost struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+	// defaults are the default values of the variables of the operation
+	defaults map[string]ast.Value
+	visiting map[string]bool
+}
+
+// selectionSet returns the cost of the selection set of the parent field and
+// the depth of its deepest field. Introspection fields are free.
+func (c *queryCost) selectionSet(set *ast.SelectionSet, parent string, depth int) (int, int) {
+	if set == nil {
+		return 0, depth - 1
+	}
+
+	cost, maxDepth := 0, depth
+	for _, selection := range set.Selections {
+		var selectionCost, selectionDepth int
+		switch s := selection.(type) {
+		case *ast.Field:
+			if strings.HasPrefix(s.Name.Value, "__") {
+				continue
+			}
+			childCost, childDepth := c.selectionSet(s.SelectionSet, s.Name.Value, depth+1)
+			selectionCost = 1 + childCost*c.listSize(s, parent)
+			selectionDepth = childDepth
+		case *ast.InlineFragment:
+			selectionCost, selectionDepth = c.selectionSet(s.SelectionSet, parent, depth)
+		case *ast.FragmentSpread:
+			fragment, ok := c.fragments[s.Name.Value]
+			if !ok || c.visiting[s.Name.Value] {
+				continue
+			}
+			c.visiting[s.Name.Value] = true
+			selectionCost, selectionDepth = c.selectionSet(fragment.SelectionSet, parent, depth)
+			delete(c.visiting, s.Name.Value)
+		}
+		cost += selectionCost
+		if selectionDepth > maxDepth {
+			maxDepth = selectionDepth
+		}
+	}
+	return cost, maxDepth
+}
+
+// listSize is how many items a field can return: its limit for paginated
+// fields, one otherwise.
+func (c *queryCost) listSize(field *ast.Field, parent string) int {
+	if !listFields[field.Name.Value] || parent == field.Name.Value {
+		return 1
+	}
+	for _, arg := range field.Arguments {
+		if arg.Name.Value == "limit" {
+			if n, ok := c.intValue(arg.Value); ok && n > 0 {
+				return n
+			}
+		}
+	}
+	return defaultListSize
+}
+
+// intValue reads an integer argument, looking variables up in the request
+// and then in their default values.
+func (c *queryCost) intValue(value ast.Value) (int, bool) {
+	switch v := value.(type) {
+	case *ast.IntValue:
+		n, err := strconv.Atoi(v.Value)
+		return n, err == nil
+	case *ast.Variable:
+		if given, ok := c.variables[v.Name.Value]; ok {
+			// JSON numbers decode to float64
+			n, ok := given.(float64)
+			return int(n), ok
+		}
+		if value, ok := c.defaults[v.Name.Value]; ok {
+			return c.intValue(value)
+		}
+	}
+	return 0, false
+}
+
+// newGraphQLSchema builds the schema, resolving every field through q.
+func newGraphQLSchema(q *queries.Queries) (graphql.Schema, error) {
+	eventType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Event",
+		Fields: graphql.Fields{
+			"messageNumber": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"messageTime":   &graphql.Field{Type: graphql.String},
+			"messageType":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"message": &graphql.Field{
+				Type:        graphql.String,
+				Description: "The message payload as JSON",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return string(p.Source.(queries.RocketEvent).Message), nil
+				},
+			},
+			"speed":  &graphql.Field{Type: graphql.Int},
+			"status": &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	eventPageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "EventPage",
+		Fields: graphql.Fields{
+			"events": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(eventType)))},
+			"nextCursor": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return optionalString(p.Source.(*queries.EventPage).NextCursor), nil
+				},
+			},
+		},
+	})
+
+	rocketType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Rocket",
+		Fields: graphql.Fields{
+			"channel":           &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"type":              &graphql.Field{Type: graphql.String},
+			"speed":             &graphql.Field{Type: graphql.Int},
+			"mission":           &graphql.Field{Type: graphql.String},
+			"status":            &graphql.Field{Type: graphql.String},
+			"lastMessageNumber": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"lastMessageTime":   &graphql.Field{Type: graphql.String},
+			"launchedAt":        &graphql.Field{Type: graphql.String},
+			"updatedAt":         &graphql.Field{Type: graphql.String},
+			"pendingMessages": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "Messages received out of order, waiting for a gap to be filled. Null for past states.",
+			},
+			"events": &graphql.Field{
+				Type:        graphql.NewNonNull(eventPageType),
+				Description: "Messages applied to the rocket, in message number order",
+				Args: graphql.FieldConfigArgument{
+					"messageType": &graphql.ArgumentConfig{Type: graphql.String},
+					"limit":       &graphql.ArgumentConfig{Type: graphql.Int},
+					"cursor":      &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var channel string
+					switch r := p.Source.(type) {
+					case queries.RocketState:
+						channel = r.Channel
+					case *queries.RocketState:
+						channel = r.Channel
+					}
+					opts := queries.EventOptions{
+						MessageType: stringArg(p.Args, "messageType"),
+						Cursor:      stringArg(p.Args, "cursor"),
+					}
+					var err error
+					if opts.Limit, err = limitArg(p.Args); err != nil {
+						return nil, err
+					}
+					return q.ListEvents(channel, opts)
+				},
+			},
+		},
+	})
+
+	rocketPageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "RocketPage",
+		Fields: graphql.Fields{
+			"rockets": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(rocketType)))},
+			"nextCursor": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return optionalString(p.Source.(*queries.RocketPage).NextCursor), nil
+				},
+			},
+		},
+	})
+
+	countType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "GroupCount",
+		Fields: graphql.Fields{
+			"key":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"count": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	speedType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "GroupSpeed",
+		Fields: graphql.Fields{
+			"key":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"average": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"max":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"min":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	countsField := func(counts func(*queries.FleetStats) map[string]int) *graphql.Field {
+		return &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(countType))),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				var groups []map[string]interface{}
+				for key, count := range counts(p.Source.(*queries.FleetStats)) {
+					groups = append(groups, map[string]interface{}{"key": key, "count": count})
+				}
+				sort.Slice(groups, func(i, j int) bool { return groups[i]["key"].(string) < groups[j]["key"].(string) })
+				return groups, nil
+			},
+		}
+	}
+	speedsField := func(speeds func(*queries.FleetStats) map[string]queries.SpeedStats) *graphql.Field {
+		return &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(speedType))),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				var groups []map[string]interface{}
+				for key, s := range speeds(p.Source.(*queries.FleetStats)) {
+					groups = append(groups, map[string]interface{}{"key": key, "average": s.Average, "max": s.Max, "min": s.Min})
+				}
+				sort.Slice(groups, func(i, j int) bool { return groups[i]["key"].(string) < groups[j]["key"].(string) })
+				return groups, nil
+			},
+		}
+	}
+
+	statsType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Stats",
+		Fields: graphql.Fields{
+			"total":          &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"activeMissions": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"byStatus":       countsField(func(s *queries.FleetStats) map[string]int { return s.ByStatus }),
+			"byType":         countsField(func(s *queries.FleetStats) map[string]int { return s.ByType }),
+			"speedByType": speedsField(func(s *queries.FleetStats) map[string]queries.SpeedStats {
+				return s.SpeedByType
+			}),
+			"speedByMission": speedsField(func(s *queries.FleetStats) map[string]queries.SpeedStats {
+				return s.SpeedByMission
+			}),
+		},
+	})
+
+	filterType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "RocketFilter",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"status":        &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"type":          &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"mission":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"missionPrefix": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"minSpeed":      &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"maxSpeed":      &graphql.InputObjectFieldConfig{Type: graphql.Int},
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"rockets": &graphql.Field{
+				Type:        graphql.NewNonNull(rocketPageType),
+				Description: "Rockets matching the filter, with the sorting and pagination of GET /rockets",
+				Args: graphql.FieldConfigArgument{
+					"filter": &graphql.ArgumentConfig{Type: filterType},
+					"sortBy": &graphql.ArgumentConfig{Type: graphql.String},
+					"order":  &graphql.ArgumentConfig{Type: graphql.String},
+					"limit":  &graphql.ArgumentConfig{Type: graphql.Int},
+					"cursor": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var opts queries.ListOptions
+					var err error
+					if opts.Filter, err = filterArg(p.Args); err != nil {
+						return nil, err
+					}
+					if opts.SortBy, err = queries.ParseSort(stringArg(p.Args, "sortBy"), stringArg(p.Args, "order")); err != nil {
+						return nil, err
+					}
+					if opts.Limit, err = limitArg(p.Args); err != nil {
+						return nil, err
+					}
+					opts.Cursor = stringArg(p.Args, "cursor")
+					return q.ListRockets(opts)
+				},
+			},
+			"rocket": &graphql.Field{
+				Type:        rocketType,
+				Description: "A rocket by channel, optionally as it was after a message number or at a time",
+				Args: graphql.FieldConfigArgument{
+					"channel":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"atMessage": &graphql.ArgumentConfig{Type: graphql.Int},
+					"atTime":    &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					channel := stringArg(p.Args, "channel")
+					var rocket *queries.RocketState
+					var err error
+					switch {
+					case p.Args["atMessage"] != nil && p.Args["atTime"] != nil:
+						return nil, fmt.Errorf("atMessage and atTime are mutually exclusive")
+					case p.Args["atMessage"] != nil:
+						rocket, err = q.GetRocketAt(channel, queries.At{MessageNumber: p.Args["atMessage"].(int)})
+					case p.Args["atTime"] != nil:
+						t, parseErr := time.Parse(time.RFC3339Nano, p.Args["atTime"].(string))
+						if parseErr != nil {
+							return nil, fmt.Errorf("invalid atTime: %s", p.Args["atTime"])
+						}
+						rocket, err = q.GetRocketAt(channel, queries.At{Time: &t})
+					default:
+						rocket, err = q.GetRocket(channel)
+					}
+					if errors.Is(err, queries.ErrRocketNotFound) {
+						return nil, nil
+					}
+					return rocket, err
+				},
+			},
+			"stats": &graphql.Field{
+				Type:        graphql.NewNonNull(statsType),
+				Description: "Aggregates over the rockets matching the filter",
+				Args: graphql.FieldConfigArgument{
+					"filter": &graphql.ArgumentConfig{Type: filterType},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					filter, err := filterArg(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					return q.Stats(filter)
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+}
+
+func stringArg(args map[string]interface{}, name string) string {
+	s, _ := args[name].(string)
+	return s
+}
+
+// limitArg reads the page size of a list, defaultListSize when not given,
+// so that every list stays within what checkQueryLimits counted.
+func limitArg(args map[string]interface{}) (int, error) {
+	limit, ok := args["limit"].(int)
+	if !ok {
+		return defaultListSize, nil
+	}
+	if limit < 1 || limit > queries.MaxPageSize {
+		return 0, fmt.Errorf("limit must be between 1 and %d", queries.MaxPageSize)
+	}
+	return limit, nil
+}
+
+func filterArg(args map[string]interface{}) (queries.RocketFilter, error) {
+	input, _ := args["filter"].(map[string]interface{})
+	filter := queries.RocketFilter{
+		Status:        stringArg(input, "status"),
+		Type:          stringArg(input, "type"),
+		Mission:       stringArg(input, "mission"),
+		MissionPrefix: stringArg(input, "missionPrefix"),
+	}
+	if speed, ok := input["minSpeed"].(int); ok {
+		filter.MinSpeed = &speed
+	}
+	if speed, ok := input["maxSpeed"].(int); ok {
+		filter.MaxSpeed = &speed
+	}
+	return filter, filter.Validate()
+}
+
+func optionalString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type graphQLResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func postGraphQL(t *testing.T, serverURL, query string, variables map[string]interface{}) (int, graphQLResponse) {
+	body, _ := json.Marshal(graphQLRequest{Query: query, Variables: variables})
+	resp, err := http.Post(serverURL+"/graphql", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Failed to post query: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result graphQLResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return resp.StatusCode, result
+}
+
+func TestGraphQL_RocketsEventsAndStats(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for _, file := range []string{
+		"testdata/rocket_launched_chan1.json",
+		"testdata/rocket_launched_chan2.json",
+		"testdata/rocket_launched.json",
+		"testdata/speed_increased.json",
+	} {
+		postMessage(t, server, loadTestMessage(t, file))
+	}
+
+	status, result := postGraphQL(t, server.URL, `
+        query Fleet($limit: Int) {
+            rockets(filter: {type: "Falcon-9"}, sortBy: "-speed", limit: $limit) {
+                rockets {
+                    channel
+                    speed
+                    events(messageType: "RocketSpeedIncreased") {
+                        events { messageNumber message speed }
+                    }
+                }
+                nextCursor
+            }
+            stats { total activeMissions byType { key count } }
+        }`, map[string]interface{}{"limit": 1})
+	if status != http.StatusOK || len(result.Errors) > 0 {
+		t.Fatalf("Expected status 200 without errors, got %d: %+v", status, result.Errors)
+	}
+
+	var expected map[string]interface{}
+	json.Unmarshal([]byte(`{
+        "rockets": {
+            "rockets": [{
+                "channel": "test-channel",
+                "speed": 800,
+                "events": {"events": [{"messageNumber": 2, "message": "{\"by\":300}", "speed": 800}]}
+            }],
+            "nextCursor": null
+        },
+        "stats": {
+            "total": 3,
+            "activeMissions": 2,
+            "byType": [{"key": "Falcon-9", "count": 2}, {"key": "Starship", "count": 1}]
+        }
+    }`), &expected)
+	// The cursor is opaque, only check that there is one
+	page := result.Data["rockets"].(map[string]interface{})
+	if page["nextCursor"] == nil {
+		t.Errorf("Expected a next cursor, got %+v", page)
+	}
+	page["nextCursor"] = nil
+	if !reflect.DeepEqual(result.Data, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, result.Data)
+	}
+}
+
+func TestGraphQL_Rocket(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched.json"))
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased.json"))
+
+	// GET requests are accepted too
+	query := url.Values{"query": {`{
+        now: rocket(channel: "test-channel") { speed mission }
+        before: rocket(channel: "test-channel", atMessage: 1) { speed }
+        missing: rocket(channel: "non-existent") { speed }
+    }`}}
+	resp, err := http.Get(server.URL + "/graphql?" + query.Encode())
+	if err != nil {
+		t.Fatalf("Failed to get query: %v", err)
+	}
+	var result graphQLResponse
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+
+	if len(result.Errors) > 0 {
+		t.Fatalf("Expected no errors, got %+v", result.Errors)
+	}
+	var expected map[string]interface{}
+	json.Unmarshal([]byte(`{
+        "now": {"speed": 800, "mission": "ARTEMIS"},
+        "before": {"speed": 500},
+        "missing": null
+    }`), &expected)
+	if !reflect.DeepEqual(result.Data, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, result.Data)
+	}
+}
+
+func TestGraphQL_Errors(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		status    int
+		contains  string
+	}{
+		{"invalid filter", `{ rockets(filter: {status: "orbiting"}) { nextCursor } }`, nil, http.StatusOK, "invalid status"},
+		{"unknown field", `{ rockets { altitude } }`, nil, http.StatusOK, "altitude"},
+		{"too deep", `{ rockets { rockets { events { events { a { b { c { d { e } } } } } } } } }`, nil,
+			http.StatusBadRequest, "query depth 9 exceeds"},
+		{"too complex", `{ rockets(limit: 1000) { rockets { events(limit: 1000) { events { messageNumber } } } } }`, nil,
+			http.StatusBadRequest, "query complexity"},
+		{"too complex through fragments", `
+            { rockets { rockets { ...history } } }
+            fragment history on Rocket { events(limit: 500) { events { messageNumber speed status } } }`, nil,
+			http.StatusBadRequest, "query complexity"},
+		{"too complex through variables", `
+            query($n: Int) { rockets(limit: $n) { rockets { events(limit: $n) { events { messageNumber } } } } }`,
+			map[string]interface{}{"n": 1000}, http.StatusBadRequest, "query complexity"},
+		{"too complex through default values", `
+            query($n: Int = 1000) { rockets(limit: $n) { rockets { channel speed status } } }`, nil,
+			http.StatusBadRequest, "query complexity"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, result := postGraphQL(t, server.URL, tt.query, tt.variables)
+			if status != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, status)
+			}
+			if len(result.Errors) == 0 || !strings.Contains(result.Errors[0].Message, tt.contains) {
+				t.Errorf("Expected error containing %q, got %+v", tt.contains, result.Errors)
+			}
+		})
+	}
+}
+
+func TestGraphQL_ListsWithoutLimitReturnOnePage(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for i := 0; i <= defaultListSize; i++ {
+		body := strings.Replace(string(loadTestMessage(t, "testdata/rocket_launched.json")),
+			"test-channel", fmt.Sprintf("channel-%03d", i), 1)
+		resp, err := http.Post(server.URL+"/messages", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to post message: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	_, result := postGraphQL(t, server.URL, `{ rockets { rockets { channel } nextCursor } }`, nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("Unexpected errors: %+v", result.Errors)
+	}
+	page := result.Data["rockets"].(map[string]interface{})
+	if rockets := page["rockets"].([]interface{}); len(rockets) != defaultListSize {
+		t.Errorf("Expected %d rockets, got %d", defaultListSize, len(rockets))
+	}
+	if page["nextCursor"] == nil {
+		t.Error("Expected a cursor to the last rocket")
+	}
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// readyTimeout bounds the database checks of GET /readyz, so a locked or
+// stalled database fails the probe instead of hanging it.
+const readyTimeout = 2 * time.Second
+
+type check struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type readiness struct {
+	Status string           `json:"status"`
+	Checks map[string]check `json:"checks"`
+}
+
+func passed(detail string) check { return check{Status: "ok", Detail: detail} }
+
+func failed(detail string) check { return check{Status: "failed", Detail: detail} }
+
+// handleHealth reports that the process is up and serving requests.
+func (a *API) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handleReady reports whether the service should receive traffic: the
+// database answers, its schema is the one this service migrates to, messages
+// are accepted and the out of order backlog is under the thresholds. Each
+// check is listed, and any failure makes the response a 503.
+func (a *API) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	checks := map[string]check{}
+	version, err := a.queries.SchemaVersion(ctx)
+	if err != nil {
+		// The probe is public, so the error is only logged
+		slog.ErrorContext(r.Context(), "Readiness database check failed", "error", err)
+		checks["database"] = failed("unavailable")
+		checks["schema"] = failed("database unavailable")
+	} else {
+		checks["database"] = passed("")
+		if version == len(migrations) {
+			checks["schema"] = passed(fmt.Sprintf("version %d", version))
+		} else {
+			checks["schema"] = failed(fmt.Sprintf("version %d, expected %d", version, len(migrations)))
+		}
+	}
+
+	if a.inventory.Draining() {
+		checks["ingestion"] = failed("shutting down")
+	} else {
+		checks["ingestion"] = passed("")
+	}
+
+	checks["backlog"] = a.checkBacklog()
+
+	result := readiness{Status: "ready", Checks: checks}
+	status := http.StatusOK
+	for _, c := range checks {
+		if c.Status != "ok" {
+			result.Status = "not ready"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// checkBacklog compares the buffered messages with the readiness thresholds.
+func (a *API) checkBacklog() check {
+	total, largest, largestChannel := 0, 0, ""
+	for channel, depth := range a.inventory.BufferDepths() {
+		total += depth
+		if depth > largest || depth == largest && channel < largestChannel {
+			largest, largestChannel = depth, channel
+		}
+	}
+	detail := fmt.Sprintf("%d pending messages", total)
+	if largest > 0 {
+		detail += fmt.Sprintf(", %d for %s", largest, largestChannel)
+	}
+
+	limits := a.readiness
+	if limits.MaxPending > 0 && total > limits.MaxPending {
+		return failed(fmt.Sprintf("%s, over %d in total", detail, limits.MaxPending))
+	}
+	if limits.MaxPendingPerChannel > 0 && largest > limits.MaxPendingPerChannel {
+		return failed(fmt.Sprintf("%s, over %d for one rocket", detail, limits.MaxPendingPerChannel))
+	}
+	return passed(detail)
+}
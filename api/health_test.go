@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	config "rocket-service/rockets-config"
+	inventory "rocket-service/rockets-inventory"
+	queries "rocket-service/rockets-queries"
+)
+
+func getReadiness(t *testing.T, server *httptest.Server) (int, readiness) {
+	resp, err := http.Get(server.URL + "/readyz")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var result readiness
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode readiness: %v", err)
+	}
+	return resp.StatusCode, result
+}
+
+func TestHealth(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	resp, err := http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	status, result := getReadiness(t, server)
+	if status != http.StatusOK || result.Status != "ready" {
+		t.Errorf("Expected ready, got %d %+v", status, result)
+	}
+	for _, name := range []string{"database", "schema", "ingestion", "backlog"} {
+		if result.Checks[name].Status != "ok" {
+			t.Errorf("Expected check %s to pass, got %+v", name, result.Checks[name])
+		}
+	}
+}
+
+func TestReady_Failures(t *testing.T) {
+	db, err := Init("")
+	if err != nil {
+		t.Fatalf("Failed to initialize server: %v", err)
+	}
+	defer db.Close()
+	inv := inventory.NewInventory(db)
+	api := NewAPI(inv, queries.NewQueries(db))
+	api.SetReadiness(config.Readiness{MaxPendingPerChannel: 1})
+	server := httptest.NewServer(api.InitHandlers())
+	defer server.Close()
+
+	// Two messages wait for message 1 and 2
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased_3.json"))
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased_4.json"))
+	status, result := getReadiness(t, server)
+	if status != http.StatusServiceUnavailable || result.Status != "not ready" {
+		t.Errorf("Expected not ready, got %d %+v", status, result)
+	}
+	backlog := result.Checks["backlog"]
+	if backlog.Status != "failed" || !strings.Contains(backlog.Detail, "2 for test-channel") {
+		t.Errorf("Expected the backlog check to fail, got %+v", backlog)
+	}
+
+	db.Exec("PRAGMA user_version = 1")
+	if _, result = getReadiness(t, server); result.Checks["schema"].Status != "failed" {
+		t.Errorf("Expected the schema check to fail, got %+v", result.Checks["schema"])
+	}
+
+	inv.Drain(context.Background())
+	if _, result = getReadiness(t, server); result.Checks["ingestion"].Status != "failed" {
+		t.Errorf("Expected the ingestion check to fail, got %+v", result.Checks["ingestion"])
+	}
+
+	db.Close()
+	_, result = getReadiness(t, server)
+	if result.Checks["database"] != (check{Status: "failed", Detail: "unavailable"}) {
+		t.Errorf("Expected the database check to fail, got %+v", result.Checks["database"])
+	}
+}
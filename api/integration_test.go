@@ -2,18 +2,80 @@ package api
 
 import (
 	"bytes"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	auth "rocket-service/rockets-auth"
+	config "rocket-service/rockets-config"
 	inventory "rocket-service/rockets-inventory"
 	queries "rocket-service/rockets-queries"
+	signing "rocket-service/rockets-signing"
+	storage "rocket-service/rockets-storage"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
-func setupTestServer(t *testing.T) (*httptest.Server, func()) {
+// serverOption configures the API of a test server before its handlers are
+// built.
+type serverOption func(a *API, db *sql.DB)
+
+// withHeartbeat sets the interval of stream heartbeats.
+func withHeartbeat(heartbeat time.Duration) serverOption {
+	return func(a *API, _ *sql.DB) {
+		a.heartbeat = heartbeat
+	}
+}
+
+// withReplayPage sets how many missed changes a stream replays at a time.
+func withReplayPage(size int) serverOption {
+	return func(a *API, _ *sql.DB) {
+		a.replayPage = size
+	}
+}
+
+// withSigning checks message signatures with keys managed by the admin token.
+func withSigning() serverOption {
+	return func(a *API, db *sql.DB) {
+		a.SetSigning(signing.NewKeys(db, 5*time.Minute), false)
+		a.SetAdminToken(testAdminToken)
+	}
+}
+
+// withAuth authenticates requests with the API keys of a store, which it
+// sets store to.
+func withAuth(store **auth.Store) serverOption {
+	return func(a *API, db *sql.DB) {
+		*store = auth.NewStore(db)
+		a.SetAuth(*store)
+	}
+}
+
+// withRateLimits limits the requests of channels and clients.
+func withRateLimits(limits config.RateLimit) serverOption {
+	return func(a *API, _ *sql.DB) {
+		a.SetRateLimits(limits)
+	}
+}
+
+// withCORS lets browser pages of origins call the API, with credentials
+// when credentials is set.
+func withCORS(credentials bool, origins ...string) serverOption {
+	return func(a *API, _ *sql.DB) {
+		cors := config.Default().CORS
+		cors.AllowedOrigins = origins
+		cors.AllowCredentials = credentials
+		cors.MaxAge = 5 * time.Minute
+		a.SetCORS(cors)
+	}
+}
+
+func setupTestServer(t *testing.T, options ...serverOption) (*httptest.Server, func()) {
 	db, err := Init("") // Use in-memory SQLite
 	if err != nil {
 		t.Fatalf("Failed to initialize server: %v", err)
@@ -21,14 +83,36 @@ func setupTestServer(t *testing.T) (*httptest.Server, func()) {
 	inventory := inventory.NewInventory(db)
 	queries := queries.NewQueries(db)
 	api := NewAPI(inventory, queries)
+	for _, option := range options {
+		option(api, db)
+	}
 	handlers := api.InitHandlers()
 	server := httptest.NewServer(handlers)
 	return server, func() {
+		// Streams stay open until their clients are gone
+		server.CloseClientConnections()
 		server.Close()
 		db.Close()
 	}
 }
 
+// postMessage posts body to /messages with headers, given as name and value
+// pairs, and returns the response with its body closed.
+func postMessage(t *testing.T, server *httptest.Server, body []byte, headers ...string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("POST", server.URL+"/messages", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to post message: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
 func loadTestMessage(t *testing.T, filePath string) []byte {
 	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
@@ -63,12 +147,24 @@ func TestIntegration_PostAndGetRocket(t *testing.T) {
 	json.NewDecoder(resp.Body).Decode(&rocket)
 	resp.Body.Close()
 
+	if rocket.UpdatedAt == nil {
+		t.Fatalf("Expected the update time, got %+v", rocket)
+	}
+	if _, err := time.Parse(storage.TimestampFormat, *rocket.UpdatedAt); err != nil {
+		t.Errorf("Invalid update time: %v", err)
+	}
+
 	expected := queries.RocketState{
-		Channel: "test-channel",
-		Type:    stringPtr("Falcon-9"),
-		Speed:   intPtr(500),
-		Mission: stringPtr("ARTEMIS"),
-		Status:  stringPtr("launched"),
+		Channel:           "test-channel",
+		Type:              stringPtr("Falcon-9"),
+		Speed:             intPtr(500),
+		Mission:           stringPtr("ARTEMIS"),
+		Status:            stringPtr("launched"),
+		LastMessageNumber: 1,
+		LastMessageTime:   stringPtr("2022-02-02T19:39:05.86337+01:00"),
+		LaunchedAt:        stringPtr("2022-02-02T19:39:05.86337+01:00"),
+		UpdatedAt:         rocket.UpdatedAt,
+		PendingMessages:   intPtr(0),
 	}
 	if !reflect.DeepEqual(rocket, expected) {
 		t.Errorf("Expected rocket %+v, got %+v", expected, rocket)
@@ -232,10 +328,11 @@ func TestIntegration_ListRockets_SortByMission(t *testing.T) {
 		t.Errorf("Expected status 200, got %d", resp.StatusCode)
 	}
 
-	var rockets []queries.RocketState
-	json.NewDecoder(resp.Body).Decode(&rockets)
+	var page queries.RocketPage
+	json.NewDecoder(resp.Body).Decode(&page)
 	resp.Body.Close()
 
+	rockets := page.Rockets
 	if len(rockets) != 2 {
 		t.Fatalf("Expected 2 rockets, got %d", len(rockets))
 	}
@@ -244,6 +341,697 @@ func TestIntegration_ListRockets_SortByMission(t *testing.T) {
 	}
 }
 
+func TestIntegration_ListRockets_Filter(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for _, file := range []string{
+		"testdata/rocket_launched_chan1.json",
+		"testdata/rocket_launched_chan2.json",
+	} {
+		body := loadTestMessage(t, file)
+		resp, err := http.Post(server.URL+"/messages", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to post message %s: %v", file, err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(server.URL + "/rockets?type=Starship&min_speed=600")
+	if err != nil {
+		t.Fatalf("Failed to list rockets: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var page queries.RocketPage
+	json.NewDecoder(resp.Body).Decode(&page)
+	resp.Body.Close()
+
+	if len(page.Rockets) != 1 || page.Rockets[0].Channel != "chan2" {
+		t.Errorf("Expected only chan2, got %+v", page.Rockets)
+	}
+}
+
+func TestIntegration_ListRockets_InvalidFilter(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for _, query := range []string{
+		"status=orbiting",
+		"min_speed=fast",
+		"max_speed=-10",
+		"min_speed=900&max_speed=100",
+		"mission=ARTEMIS&mission_prefix=ART",
+	} {
+		resp, err := http.Get(server.URL + "/rockets?" + query)
+		if err != nil {
+			t.Fatalf("Failed to list rockets: %v", err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %q, got %d", query, resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestIntegration_ListRockets_Pagination(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for _, file := range []string{
+		"testdata/rocket_launched_chan1.json",
+		"testdata/rocket_launched_chan2.json",
+		"testdata/rocket_launched.json",
+	} {
+		body := loadTestMessage(t, file)
+		resp, err := http.Post(server.URL+"/messages", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to post message %s: %v", file, err)
+		}
+		resp.Body.Close()
+	}
+
+	var channels []string
+	var cursor string
+	url := server.URL + "/rockets?sort_by=-speed,channel&limit=2"
+	for url != "" {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("Failed to list rockets: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		var page queries.RocketPage
+		json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+
+		for _, r := range page.Rockets {
+			channels = append(channels, r.Channel)
+		}
+		url = ""
+		if page.NextCursor != "" {
+			cursor = page.NextCursor
+			url = server.URL + "/rockets?sort_by=-speed,channel&limit=2&cursor=" + cursor
+		}
+	}
+
+	expected := []string{"chan2", "chan1", "test-channel"}
+	if !reflect.DeepEqual(channels, expected) {
+		t.Errorf("Expected channels %v, got %v", expected, channels)
+	}
+
+	// A cursor only continues the listing it was issued for
+	resp, err := http.Get(server.URL + "/rockets?sort_by=speed&limit=2&cursor=" + cursor)
+	if err != nil {
+		t.Fatalf("Failed to list rockets: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a cursor of another sort, got %d", resp.StatusCode)
+	}
+}
+
+func TestIntegration_ListRockets_InvalidPagination(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for _, query := range []string{
+		"limit=0",
+		"limit=abc",
+		"limit=100000",
+		"order=up",
+		"sort_by=altitude",
+		"cursor=bogus",
+	} {
+		resp, err := http.Get(server.URL + "/rockets?" + query)
+		if err != nil {
+			t.Fatalf("Failed to list rockets: %v", err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %q, got %d", query, resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestIntegration_Stats(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for _, file := range []string{
+		"testdata/rocket_launched_chan1.json",
+		"testdata/rocket_launched_chan2.json",
+	} {
+		body := loadTestMessage(t, file)
+		resp, err := http.Post(server.URL+"/messages", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to post message %s: %v", file, err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(server.URL + "/stats?status=launched")
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var stats queries.FleetStats
+	json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+
+	if stats.Total != 2 || stats.ActiveMissions != 2 || stats.ByType["Starship"] != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if stats.SpeedByType["Starship"].Max != 1000 {
+		t.Errorf("Expected Starship max speed 1000, got %+v", stats.SpeedByType["Starship"])
+	}
+
+	resp, err = http.Get(server.URL + "/stats?status=orbiting")
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+}
+
+func TestIntegration_GetRocketAt(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for _, file := range []string{
+		"testdata/rocket_launched.json",
+		"testdata/speed_increased.json",
+		"testdata/speed_increased_3.json",
+	} {
+		body := loadTestMessage(t, file)
+		resp, err := http.Post(server.URL+"/messages", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to post message %s: %v", file, err)
+		}
+		resp.Body.Close()
+	}
+
+	for query, expectedSpeed := range map[string]int{
+		"at_message=1":                          500,
+		"at_message=2":                          800,
+		"at_time=2022-02-02T19:39:06.9%2B01:00": 800,
+		"at_time=2022-02-02T18:39:08Z":          1000,
+	} {
+		resp, err := http.Get(server.URL + "/rockets/test-channel?" + query)
+		if err != nil {
+			t.Fatalf("Failed to get rocket: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 for %q, got %d", query, resp.StatusCode)
+		}
+		var rocket queries.RocketState
+		json.NewDecoder(resp.Body).Decode(&rocket)
+		resp.Body.Close()
+
+		if rocket.Speed == nil || *rocket.Speed != expectedSpeed {
+			t.Errorf("Expected speed %d for %q, got %+v", expectedSpeed, query, rocket)
+		}
+	}
+
+	for query, expectedStatus := range map[string]int{
+		"at_message=0":      http.StatusBadRequest,
+		"at_time=yesterday": http.StatusBadRequest,
+		"at_message=1&at_time=2022-02-02T18:39:08Z": http.StatusBadRequest,
+		"at_time=2020-01-01T00:00:00Z":              http.StatusNotFound,
+	} {
+		resp, err := http.Get(server.URL + "/rockets/test-channel?" + query)
+		if err != nil {
+			t.Fatalf("Failed to get rocket: %v", err)
+		}
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("Expected status %d for %q, got %d", expectedStatus, query, resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestIntegration_RocketEvents(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for _, file := range []string{
+		"testdata/speed_increased_3.json",
+		"testdata/rocket_launched.json",
+		"testdata/speed_increased.json",
+	} {
+		body := loadTestMessage(t, file)
+		resp, err := http.Post(server.URL+"/messages", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to post message %s: %v", file, err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(server.URL + "/rockets/test-channel/events?messageType=RocketSpeedIncreased&limit=1")
+	if err != nil {
+		t.Fatalf("Failed to get events: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var page queries.EventPage
+	json.NewDecoder(resp.Body).Decode(&page)
+	resp.Body.Close()
+
+	if len(page.Events) != 1 || page.NextCursor == "" {
+		t.Fatalf("Expected one event and a next cursor, got %+v", page)
+	}
+	event := page.Events[0]
+	if event.MessageNumber != 2 || event.MessageTime != "2022-02-02T19:39:06.86337+01:00" ||
+		*event.Speed != 800 || *event.Status != "launched" || string(event.Message) != `{"by":300}` {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+
+	resp, err = http.Get(server.URL + "/rockets/test-channel/events?messageType=RocketSpeedIncreased&limit=1&cursor=" + page.NextCursor)
+	if err != nil {
+		t.Fatalf("Failed to get events: %v", err)
+	}
+	page = queries.EventPage{}
+	json.NewDecoder(resp.Body).Decode(&page)
+	resp.Body.Close()
+
+	if len(page.Events) != 1 || page.Events[0].MessageNumber != 3 || page.NextCursor != "" {
+		t.Errorf("Expected message 3 on the last page, got %+v", page)
+	}
+
+	for query, expectedStatus := range map[string]int{
+		"test-channel/events?messageType=RocketLanded": http.StatusBadRequest,
+		"test-channel/events?limit=-1":                 http.StatusBadRequest,
+		"non-existent/events":                          http.StatusNotFound,
+	} {
+		resp, err := http.Get(server.URL + "/rockets/" + query)
+		if err != nil {
+			t.Fatalf("Failed to get events: %v", err)
+		}
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("Expected status %d for %q, got %d", expectedStatus, query, resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestIntegration_ConditionalGetRocket(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	post := func(file string) {
+		body := loadTestMessage(t, file)
+		resp, err := http.Post(server.URL+"/messages", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to post message %s: %v", file, err)
+		}
+		resp.Body.Close()
+	}
+	get := func(path string, header, value string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	post("testdata/rocket_launched.json")
+
+	resp := get("/rockets/test-channel", "", "")
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag != `"1-0"` || lastModified == "" {
+		t.Fatalf("Expected ETag \"1-0\" and a Last-Modified header, got %q and %q", etag, lastModified)
+	}
+
+	if resp := get("/rockets/test-channel", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected status 304 for matching ETag, got %d", resp.StatusCode)
+	}
+	if resp := get("/rockets/test-channel", "If-None-Match", `"0-0", W/"1-0"`); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected status 304 for a list containing a weak match, got %d", resp.StatusCode)
+	}
+	if resp := get("/rockets/test-channel", "If-Modified-Since", lastModified); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected status 304 for unchanged Last-Modified, got %d", resp.StatusCode)
+	}
+
+	// A buffered message changes the pending messages of the rocket
+	post("testdata/speed_increased_3.json")
+	resp = get("/rockets/test-channel", "If-None-Match", etag)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"1-1"` {
+		t.Errorf("Expected status 200 with ETag \"1-1\" after a buffered message, got %d with %q",
+			resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if resp := get("/rockets/test-channel", "If-Modified-Since", lastModified); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 for Last-Modified after a buffered message, got %d", resp.StatusCode)
+	}
+
+	post("testdata/speed_increased.json")
+	resp = get("/rockets/test-channel", "If-None-Match", etag)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"3-0"` {
+		t.Errorf("Expected status 200 with ETag \"3-0\", got %d with %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
+
+func TestIntegration_ConditionalListRockets(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	post := func(file string) {
+		body := loadTestMessage(t, file)
+		resp, err := http.Post(server.URL+"/messages", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to post message %s: %v", file, err)
+		}
+		resp.Body.Close()
+	}
+	getWithETag := func(etag string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+"/rockets", nil)
+		req.Header.Set("If-None-Match", etag)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to list rockets: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	post("testdata/rocket_launched_chan1.json")
+
+	resp := getWithETag(`"none"`)
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("Expected status 200 with an ETag, got %d with %q", resp.StatusCode, etag)
+	}
+	if resp := getWithETag(etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected status 304 for an unchanged fleet, got %d", resp.StatusCode)
+	}
+
+	post("testdata/rocket_launched.json")
+	resp = getWithETag(etag)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 after a new rocket, got %d", resp.StatusCode)
+	}
+
+	// Rockets report their pending messages, so buffering one changes the list
+	etag = resp.Header.Get("ETag")
+	post("testdata/speed_increased_3.json")
+	if resp := getWithETag(etag); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 after a buffered message, got %d", resp.StatusCode)
+	}
+}
+
+func TestIntegration_ExportRockets(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for _, file := range []string{
+		"testdata/rocket_launched_chan1.json",
+		"testdata/rocket_launched_chan2.json",
+	} {
+		body := loadTestMessage(t, file)
+		resp, err := http.Post(server.URL+"/messages", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to post message %s: %v", file, err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(server.URL + "/rockets?format=csv&sort_by=mission")
+	if err != nil {
+		t.Fatalf("Failed to export rockets: %v", err)
+	}
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Invalid CSV export: %v", err)
+	}
+	if resp.Header.Get("Content-Type") != "text/csv" {
+		t.Errorf("Expected text/csv, got %s", resp.Header.Get("Content-Type"))
+	}
+
+	// Update times depend on when the test runs, so only check they are set
+	expected := [][]string{
+		{"channel", "type", "speed", "mission", "status", "lastMessageNumber", "lastMessageTime", "launchedAt", "pendingMessages"},
+		{"chan2", "Starship", "1000", "ARTEMIS", "launched", "1", "2022-02-02T19:39:05.86337+01:00", "2022-02-02T19:39:05.86337+01:00", "0"},
+		{"chan1", "Falcon-9", "500", "ZEBRA", "launched", "1", "2022-02-02T19:39:05.86337+01:00", "2022-02-02T19:39:05.86337+01:00", "0"},
+	}
+	for i, record := range records {
+		if len(record) != 10 || i > 0 && record[8] == "" {
+			t.Fatalf("Unexpected CSV record %v", record)
+		}
+		records[i] = append(record[:8], record[9])
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Expected CSV records %v, got %v", expected, records)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/rockets?type=Falcon-9", nil)
+	req.Header.Set("Accept", "application/json;q=0.5, application/x-ndjson")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to export rockets: %v", err)
+	}
+	var rockets []queries.RocketState
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		var r queries.RocketState
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("Invalid NDJSON line: %v", err)
+		}
+		rockets = append(rockets, r)
+	}
+	resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "application/x-ndjson" || len(rockets) != 1 || rockets[0].Channel != "chan1" {
+		t.Errorf("Unexpected NDJSON export (%s): %+v", resp.Header.Get("Content-Type"), rockets)
+	}
+
+	for _, query := range []string{"format=xml", "format=csv&limit=1"} {
+		resp, err := http.Get(server.URL + "/rockets?" + query)
+		if err != nil {
+			t.Fatalf("Failed to export rockets: %v", err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %q, got %d", query, resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestIntegration_ExportRocketsEscapesFormulas(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	body := strings.Replace(string(loadTestMessage(t, "testdata/rocket_launched.json")),
+		`"ARTEMIS"`, `"=HYPERLINK(\"http://example.com\")"`, 1)
+	resp, err := http.Post(server.URL+"/messages", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to post message: %v", err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(server.URL + "/rockets?format=csv")
+	if err != nil {
+		t.Fatalf("Failed to export rockets: %v", err)
+	}
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Invalid CSV export: %v", err)
+	}
+	if len(records) != 2 || records[1][3] != `'=HYPERLINK("http://example.com")` || records[1][2] != "500" {
+		t.Errorf("Expected the mission to be escaped, got %v", records)
+	}
+}
+
+func TestIntegration_ExportRocketsReportsErrors(t *testing.T) {
+	db, err := Init("")
+	if err != nil {
+		t.Fatalf("Failed to initialize server: %v", err)
+	}
+	server := httptest.NewServer(NewAPI(inventory.NewInventory(db), queries.NewQueries(db)).InitHandlers())
+	defer server.Close()
+
+	// Nothing has been written when the query fails, so the status says so
+	db.Close()
+	resp, err := http.Get(server.URL + "/rockets?format=csv")
+	if err != nil {
+		t.Fatalf("Failed to export rockets: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", resp.StatusCode)
+	}
+}
+
+func TestIntegration_ExportRocketEvents(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for _, file := range []string{
+		"testdata/rocket_launched.json",
+		"testdata/speed_increased.json",
+	} {
+		body := loadTestMessage(t, file)
+		resp, err := http.Post(server.URL+"/messages", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to post message %s: %v", file, err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(server.URL + "/rockets/test-channel/events?format=csv&messageType=RocketSpeedIncreased")
+	if err != nil {
+		t.Fatalf("Failed to export events: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	expected := "messageNumber,messageTime,messageType,message,speed,status\n" +
+		"2,2022-02-02T19:39:06.86337+01:00,RocketSpeedIncreased,\"{\"\"by\"\":300}\",800,launched\n"
+	if string(body) != expected {
+		t.Errorf("Unexpected CSV export:\n%s", body)
+	}
+
+	resp, err = http.Get(server.URL + "/rockets/test-channel/events?format=ndjson")
+	if err != nil {
+		t.Fatalf("Failed to export events: %v", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if lines := bytes.Split(bytes.TrimSpace(body), []byte("\n")); len(lines) != 2 {
+		t.Errorf("Expected 2 NDJSON lines, got:\n%s", body)
+	}
+
+	resp, err = http.Get(server.URL + "/rockets/non-existent/events?format=csv")
+	if err != nil {
+		t.Fatalf("Failed to export events: %v", err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+}
+
+func TestIntegration_RocketFreshness(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	getRocket := func() queries.RocketState {
+		resp, err := http.Get(server.URL + "/rockets/test-channel")
+		if err != nil {
+			t.Fatalf("Failed to get rocket: %v", err)
+		}
+		defer resp.Body.Close()
+		var rocket queries.RocketState
+		json.NewDecoder(resp.Body).Decode(&rocket)
+		return rocket
+	}
+
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched.json"))
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased_3.json"))
+
+	rocket := getRocket()
+	if rocket.LastMessageNumber != 1 || rocket.PendingMessages == nil || *rocket.PendingMessages != 1 {
+		t.Errorf("Expected message 1 applied and one pending, got %+v", rocket)
+	}
+	launchedUpdate := *rocket.UpdatedAt
+
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased.json"))
+
+	rocket = getRocket()
+	if rocket.LastMessageNumber != 3 || *rocket.PendingMessages != 0 ||
+		*rocket.LastMessageTime != "2022-02-02T19:39:07.86337+01:00" ||
+		*rocket.LaunchedAt != "2022-02-02T19:39:05.86337+01:00" {
+		t.Errorf("Expected message 3 applied and none pending, got %+v", rocket)
+	}
+	if *rocket.UpdatedAt < launchedUpdate {
+		t.Errorf("Expected the update time to move forward from %s, got %s", launchedUpdate, *rocket.UpdatedAt)
+	}
+}
+
+func TestIntegration_Missions(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched_chan1.json"))
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched_chan2.json"))
+
+	resp, err := http.Get(server.URL + "/missions")
+	if err != nil {
+		t.Fatalf("Failed to list missions: %v", err)
+	}
+	var missions []queries.Mission
+	json.NewDecoder(resp.Body).Decode(&missions)
+	resp.Body.Close()
+
+	if len(missions) != 2 || missions[0].Name != "ARTEMIS" || missions[0].RocketCount != 1 ||
+		missions[0].Speed.Average != 1000 || missions[1].Name != "ZEBRA" {
+		t.Errorf("Unexpected missions: %+v", missions)
+	}
+
+	resp, err = http.Get(server.URL + "/missions/ARTEMIS")
+	if err != nil {
+		t.Fatalf("Failed to get mission: %v", err)
+	}
+	var mission queries.MissionRockets
+	json.NewDecoder(resp.Body).Decode(&mission)
+	resp.Body.Close()
+
+	if len(mission.Rockets) != 1 || mission.Rockets[0].Channel != "chan2" || !mission.Rockets[0].Current {
+		t.Errorf("Unexpected mission: %+v", mission)
+	}
+
+	resp, err = http.Get(server.URL + "/missions/APOLLO")
+	if err != nil {
+		t.Fatalf("Failed to get mission: %v", err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+}
+
+func TestIntegration_DisabledFeatures(t *testing.T) {
+	db, err := Init("")
+	if err != nil {
+		t.Fatalf("Failed to initialize server: %v", err)
+	}
+	defer db.Close()
+	api := NewAPI(inventory.NewInventory(db), queries.NewQueries(db))
+	api.SetFeatures(config.Features{Streams: true})
+	server := httptest.NewServer(api.InitHandlers())
+	defer server.Close()
+
+	for path, expectedStatus := range map[string]int{
+		"/graphql?query={stats{total}}": http.StatusNotFound,
+		"/metrics":                      http.StatusNotFound,
+		"/rockets/ws":                   http.StatusNotFound,
+		"/rockets":                      http.StatusOK,
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("Expected status %d for %s, got %d", expectedStatus, path, resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+}
+
 func TestIntegration_RocketNotFound(t *testing.T) {
 	server, cleanup := setupTestServer(t)
 	defer cleanup()
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	logging "rocket-service/rockets-logging"
+)
+
+func TestLogging_RequestAndMessageIDs(t *testing.T) {
+	var out bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(logging.New(&out, "json", slog.LevelDebug))
+	defer slog.SetDefault(previous)
+
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	req, _ := http.NewRequest("POST", server.URL+"/messages",
+		bytes.NewBuffer(loadTestMessage(t, "testdata/speed_increased_3.json")))
+	req.Header.Set("X-Request-ID", "req-42")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to post message: %v", err)
+	}
+	resp.Body.Close()
+	if id := resp.Header.Get("X-Request-ID"); id != "req-42" {
+		t.Errorf("Expected the request ID to be echoed, got %q", id)
+	}
+
+	found := false
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid log line %q: %v", scanner.Text(), err)
+		}
+		if record["msg"] == "Message ingested" {
+			found = true
+			if record["requestId"] != "req-42" || record["channel"] != "test-channel" ||
+				record["messageNumber"] != float64(3) || record["outcome"] != "buffered" {
+				t.Errorf("Unexpected log record: %v", record)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected the message to be logged, got %q", out.String())
+	}
+
+	// IDs that could break log lines are replaced
+	req, _ = http.NewRequest("GET", server.URL+"/rockets/unknown", nil)
+	req.Header.Set("X-Request-ID", strings.Repeat("x", maxRequestIDLength+1))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if id := resp.Header.Get("X-Request-ID"); len(id) != 32 {
+		t.Errorf("Expected a generated request ID, got %q", id)
+	}
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape returns the value of every sample exposed by /metrics, keyed by name and labels.
+func scrape(t *testing.T, server *httptest.Server) map[string]float64 {
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to get metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	samples := map[string]float64{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.LastIndex(line, " ")
+		if strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("Invalid sample %q: %v", line, err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	// Counters are shared by every server of the test binary, so compare them
+	// with their values before the test
+	before := scrape(t, server)
+
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased_3.json"))
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched.json"))
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched.json"))
+	postMessage(t, server, loadTestMessage(t, "testdata/invalid_json.json"))
+
+	samples := scrape(t, server)
+	for sample, expected := range map[string]float64{
+		`rocket_buffer_depth_channel{channel="test-channel"}`: 1,
+		`rocket_buffer_depth`:                     1,
+		`rocket_fleet_rockets{status="launched"}`: 1,
+	} {
+		if samples[sample] != expected {
+			t.Errorf("Expected %s to be %v, got %v", sample, expected, samples[sample])
+		}
+	}
+
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased.json"))
+
+	// A scrape is observed once it has been served, so this one only sees the
+	// first two
+	samples = scrape(t, server)
+	for sample, expected := range map[string]float64{
+		`rocket_messages_ingested_total{message_type="RocketLaunched",outcome="applied"}`:        1,
+		`rocket_messages_ingested_total{message_type="RocketLaunched",outcome="duplicate"}`:      1,
+		`rocket_messages_ingested_total{message_type="RocketSpeedIncreased",outcome="buffered"}`: 1,
+		`rocket_messages_ingested_total{message_type="RocketSpeedIncreased",outcome="applied"}`:  2,
+		`rocket_messages_ingested_total{message_type="unknown",outcome="rejected"}`:              1,
+		`rocket_message_handler_duration_seconds_count{message_type="RocketSpeedIncreased"}`:     2,
+		`rocket_ingestion_transaction_duration_seconds_count`:                                    4,
+		`http_requests_total{code="200",method="post",route="/messages"}`:                        4,
+		`http_requests_total{code="400",method="post",route="/messages"}`:                        1,
+		`http_request_duration_seconds_count{code="200",method="get",route="/metrics"}`:          2,
+	} {
+		if delta := samples[sample] - before[sample]; delta != expected {
+			t.Errorf("Expected %s to grow by %v, got %v", sample, expected, delta)
+		}
+	}
+	if samples[`rocket_buffer_depth`] != 0 {
+		t.Errorf("Expected the buffer to be drained, got %v", samples[`rocket_buffer_depth`])
+	}
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// openAPISpec is the OpenAPI 3 document of every route. TestOpenAPI_Routes
+// fails when a route is missing from it.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// docsPage renders openAPISpec in a browser. It loads nothing but the
+// document, so it works without internet access.
+//
+//go:embed docs.html
+var docsPage []byte
+
+// openAPIETag versions openAPISpec, which only changes with the binary.
+var openAPIETag = func() string {
+	sum := sha256.Sum256(openAPISpec)
+	return fmt.Sprintf(`"%x"`, sum[:8])
+}()
+
+func (a *API) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if notModified(w, r, openAPIETag, time.Time{}) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func (a *API) handleDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
@@ -0,0 +1,486 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	inventory "rocket-service/rockets-inventory"
+	queries "rocket-service/rockets-queries"
+	signing "rocket-service/rockets-signing"
+
+	"github.com/gorilla/mux"
+)
+
+// specValidator checks JSON values against the schemas of openAPISpec. It
+// covers the parts of OpenAPI 3.0 the document uses: type, properties,
+// required, additionalProperties, items, enum, nullable, allOf, oneOf and
+// local $refs. Objects with properties may not hold undocumented fields,
+// so a field added to a response fails until it is documented.
+type specValidator struct {
+	spec map[string]interface{}
+}
+
+func loadSpec(t *testing.T) *specValidator {
+	t.Helper()
+	var spec map[string]interface{}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("Invalid OpenAPI document: %v", err)
+	}
+	return &specValidator{spec: spec}
+}
+
+// resolve follows the $ref of node, if any.
+func (v *specValidator) resolve(node map[string]interface{}) map[string]interface{} {
+	for {
+		ref, ok := node["$ref"].(string)
+		if !ok {
+			return node
+		}
+		var target interface{} = v.spec
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			object, _ := target.(map[string]interface{})
+			target = object[part]
+		}
+		resolved, ok := target.(map[string]interface{})
+		if !ok {
+			panic("unresolved $ref " + ref)
+		}
+		node = resolved
+	}
+}
+
+func (v *specValidator) schema(name string) map[string]interface{} {
+	return v.resolve(map[string]interface{}{"$ref": "#/components/schemas/" + name})
+}
+
+// properties gathers the properties of schema and of its allOf schemas.
+func (v *specValidator) properties(schema map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	if own, ok := schema["properties"].(map[string]interface{}); ok {
+		for name, property := range own {
+			properties[name] = property
+		}
+	}
+	all, _ := schema["allOf"].([]interface{})
+	for _, sub := range all {
+		for name, property := range v.properties(v.resolve(sub.(map[string]interface{}))) {
+			properties[name] = property
+		}
+	}
+	return properties
+}
+
+// validate returns what is wrong with value. Parts of an allOf are open: the
+// undocumented fields are looked for across all of them.
+func (v *specValidator) validate(schema map[string]interface{}, value interface{}, path string, open bool) []string {
+	schema = v.resolve(schema)
+	if value == nil && schema["nullable"] == true {
+		return nil
+	}
+
+	var errs []string
+	all, _ := schema["allOf"].([]interface{})
+	for _, sub := range all {
+		errs = append(errs, v.validate(sub.(map[string]interface{}), value, path, true)...)
+	}
+	if one, ok := schema["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, sub := range one {
+			if len(v.validate(sub.(map[string]interface{}), value, path, open)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			errs = append(errs, fmt.Sprintf("%s: matches %d schemas of oneOf", path, matched))
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			found = found || reflect.DeepEqual(allowed, value)
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: %v is not one of %v", path, value, enum))
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected an object, got %T", path, value))
+		}
+		errs = append(errs, v.validateObject(schema, object, path, open)...)
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected an array, got %T", path, value))
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range array {
+			errs = append(errs, v.validate(items, item, fmt.Sprintf("%s[%d]", path, i), false)...)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected a string, got %T", path, value))
+		}
+	case "integer":
+		if number, ok := value.(float64); !ok || number != math.Trunc(number) {
+			errs = append(errs, fmt.Sprintf("%s: expected an integer, got %v", path, value))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected a number, got %T", path, value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected a boolean, got %T", path, value))
+		}
+	case nil:
+		// Schemas made of allOf check their fields here
+		if object, ok := value.(map[string]interface{}); ok && len(all) > 0 && !open {
+			errs = append(errs, v.validateObject(schema, object, path, false)...)
+		}
+	}
+	return errs
+}
+
+func (v *specValidator) validateObject(schema, object map[string]interface{}, path string, open bool) []string {
+	var errs []string
+	required, _ := schema["required"].([]interface{})
+	for _, name := range required {
+		if _, ok := object[name.(string)]; !ok {
+			errs = append(errs, fmt.Sprintf("%s.%s: is required", path, name))
+		}
+	}
+
+	own, _ := schema["properties"].(map[string]interface{})
+	properties := v.properties(schema)
+	additional, hasAdditional := schema["additionalProperties"].(map[string]interface{})
+	for name, value := range object {
+		if property, ok := own[name].(map[string]interface{}); ok {
+			errs = append(errs, v.validate(property, value, path+"."+name, false)...)
+		} else if hasAdditional {
+			errs = append(errs, v.validate(additional, value, path+"."+name, false)...)
+		} else if _, ok := properties[name]; !ok && !open && len(properties) > 0 {
+			errs = append(errs, fmt.Sprintf("%s.%s: is not documented", path, name))
+		}
+	}
+	return errs
+}
+
+// operation returns the operation of a path template and method.
+func (v *specValidator) operation(template, method string) map[string]interface{} {
+	paths := v.spec["paths"].(map[string]interface{})
+	item, _ := paths[template].(map[string]interface{})
+	operation, _ := item[strings.ToLower(method)].(map[string]interface{})
+	return operation
+}
+
+// checkResponse validates a response against the operation of its route:
+// the status must be documented, with the content type, and JSON bodies
+// must match their schema. It returns the decoded JSON body.
+func (v *specValidator) checkResponse(t *testing.T, router *mux.Router, resp *http.Response) interface{} {
+	t.Helper()
+	defer resp.Body.Close()
+	name := resp.Request.Method + " " + resp.Request.URL.RequestURI()
+
+	var match mux.RouteMatch
+	if !router.Match(resp.Request, &match) || match.Route == nil {
+		t.Fatalf("%s: no route", name)
+	}
+	template, _ := match.Route.GetPathTemplate()
+	operation := v.operation(template, resp.Request.Method)
+	if operation == nil {
+		t.Fatalf("%s: %s %s is not documented", name, resp.Request.Method, template)
+	}
+
+	responses := operation["responses"].(map[string]interface{})
+	documented, ok := responses[fmt.Sprint(resp.StatusCode)].(map[string]interface{})
+	if !ok {
+		t.Errorf("%s: status %d is not documented", name, resp.StatusCode)
+		return nil
+	}
+	content, _ := v.resolve(documented)["content"].(map[string]interface{})
+	if len(content) == 0 {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	media, ok := content[mediaType].(map[string]interface{})
+	if !ok {
+		t.Errorf("%s: content type %q is not documented for status %d", name, mediaType, resp.StatusCode)
+		return nil
+	}
+	if mediaType != "application/json" && mediaType != "application/problem+json" {
+		return nil
+	}
+
+	var body interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("%s: invalid JSON: %v", name, err)
+	}
+	for _, err := range v.validate(media["schema"].(map[string]interface{}), body, "body", false) {
+		t.Errorf("%s: %s", name, err)
+	}
+	return body
+}
+
+func TestOpenAPI_Routes(t *testing.T) {
+	v := loadSpec(t)
+	db, err := Init("")
+	if err != nil {
+		t.Fatalf("Failed to initialize server: %v", err)
+	}
+	defer db.Close()
+	router := NewAPI(inventory.NewInventory(db), queries.NewQueries(db)).InitHandlers()
+
+	routed := map[string]bool{}
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		for _, method := range methods {
+			routed[method+" "+template] = true
+			if v.operation(template, method) == nil {
+				t.Errorf("%s %s is not documented", method, template)
+			}
+		}
+		return nil
+	})
+
+	for template, item := range v.spec["paths"].(map[string]interface{}) {
+		for method := range item.(map[string]interface{}) {
+			if !routed[strings.ToUpper(method)+" "+template] {
+				t.Errorf("%s %s is documented but not routed", strings.ToUpper(method), template)
+			}
+		}
+	}
+
+	// Every reference points somewhere
+	var walk func(node interface{})
+	walk = func(node interface{}) {
+		switch node := node.(type) {
+		case map[string]interface{}:
+			if ref, ok := node["$ref"].(string); ok {
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							t.Errorf("Unresolved reference %s", ref)
+						}
+					}()
+					v.resolve(node)
+				}()
+			}
+			for _, child := range node {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range node {
+				walk(child)
+			}
+		}
+	}
+	walk(v.spec)
+}
+
+func TestOpenAPI_Messages(t *testing.T) {
+	v := loadSpec(t)
+	message := v.schema("RocketMessage")
+
+	var valid []string
+	for _, file := range []string{
+		"testdata/rocket_launched.json",
+		"testdata/speed_increased.json",
+		"testdata/rocket_launched_chan1.json",
+	} {
+		valid = append(valid, string(loadTestMessage(t, file)))
+	}
+	valid = append(valid,
+		`{"metadata": {"channel": "c", "messageNumber": 3, "messageTime": "2022-02-02T19:39:05Z", "messageType": "RocketSpeedDecreased"}, "message": {"by": 100}}`,
+		`{"metadata": {"channel": "c", "messageNumber": 4, "messageTime": "2022-02-02T19:39:05Z", "messageType": "RocketExploded"}, "message": {"reason": "PRESSURE_VESSEL_FAILURE"}}`,
+		`{"metadata": {"channel": "c", "messageNumber": 5, "messageTime": "2022-02-02T19:39:05Z", "messageType": "RocketMissionChanged"}, "message": {"newMission": "SHUTTLE_MIR"}}`,
+	)
+	for _, body := range valid {
+		var value interface{}
+		json.Unmarshal([]byte(body), &value)
+		if errs := v.validate(message, value, "message", false); len(errs) > 0 {
+			t.Errorf("Expected %s to be valid, got %v", body, errs)
+		}
+	}
+
+	// The payload must be the one of the message type
+	for _, body := range []string{
+		`{"metadata": {"channel": "c", "messageNumber": 1, "messageTime": "2022-02-02T19:39:05Z", "messageType": "RocketExploded"}, "message": {"by": 100}}`,
+		`{"metadata": {"channel": "c", "messageNumber": 1, "messageTime": "2022-02-02T19:39:05Z", "messageType": "RocketLaunched"}, "message": {"type": "Falcon-9", "launchSpeed": "fast", "mission": "ARTEMIS"}}`,
+		`{"metadata": {"channel": "c", "messageNumber": 1, "messageTime": "2022-02-02T19:39:05Z", "messageType": "RocketLanded"}, "message": {}}`,
+		`{"metadata": {"channel": "c", "messageNumber": 1, "messageTime": "2022-02-02T19:39:05Z", "messageType": "RocketSpeedIncreased"}}`,
+	} {
+		var value interface{}
+		json.Unmarshal([]byte(body), &value)
+		if errs := v.validate(message, value, "message", false); len(errs) == 0 {
+			t.Errorf("Expected %s to be invalid", body)
+		}
+	}
+}
+
+func TestOpenAPI_Responses(t *testing.T) {
+	v := loadSpec(t)
+	db, err := Init("")
+	if err != nil {
+		t.Fatalf("Failed to initialize server: %v", err)
+	}
+	api := NewAPI(inventory.NewInventory(db), queries.NewQueries(db))
+	api.SetSigning(signing.NewKeys(db, 5*time.Minute), false)
+	api.SetAdminToken(testAdminToken)
+	router := api.InitHandlers()
+	server := httptest.NewServer(router)
+	defer func() {
+		server.Close()
+		db.Close()
+	}()
+
+	request := func(method, path, token, body string, headers ...string) interface{} {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return v.checkResponse(t, router, resp)
+	}
+
+	for _, file := range []string{
+		"testdata/rocket_launched.json",
+		"testdata/speed_increased.json",
+		"testdata/rocket_launched_chan1.json",
+		"testdata/rocket_launched_chan2.json",
+		"testdata/speed_increased_4.json",
+	} {
+		request("POST", "/messages", "", string(loadTestMessage(t, file)))
+	}
+	request("POST", "/messages", "", `{"metadata": {"channel": "chan2", "messageNumber": 2, "messageTime": "2022-02-02T19:40:05Z", "messageType": "RocketExploded"}, "message": {"reason": "PRESSURE_VESSEL_FAILURE"}}`)
+	request("POST", "/messages", "", `{"metadata": {"channel": "chan1", "messageNumber": 2, "messageTime": "2022-02-02T19:40:05Z", "messageType": "RocketMissionChanged"}, "message": {"newMission": "SHUTTLE_MIR"}}`)
+	request("POST", "/messages", "", `{"metadata": {"channel": "chan1"`)
+	request("POST", "/messages", "", `{"metadata": {"channel": "chan1", "messageNumber": 3, "messageType": "RocketLanded"}, "message": {}}`)
+
+	for _, path := range []string{
+		"/rockets",
+		"/rockets?limit=1&sort_by=-speed",
+		"/rockets?status=orbiting",
+		"/rockets?format=csv",
+		"/rockets?format=ndjson",
+		"/rockets/test-channel",
+		"/rockets/test-channel?at_message=1",
+		"/rockets/unknown",
+		"/rockets/test-channel/events",
+		"/rockets/test-channel/events?limit=1",
+		"/rockets/chan2/events?format=csv",
+		"/stats",
+		"/stats?type=Falcon-9",
+		"/missions",
+		"/missions/ARTEMIS",
+		"/missions/unknown",
+		"/graphql?query=" + url.QueryEscape("{ stats { total } }"),
+		"/healthz",
+		"/readyz",
+		"/metrics",
+		"/docs",
+	} {
+		request("GET", path, "", "")
+	}
+	request("POST", "/graphql", "", `{"query": "{ rockets { rockets { channel speed } } }"}`)
+	request("POST", "/graphql", "", `{"query": `)
+
+	// Conditional requests
+	resp, err := http.Get(server.URL + "/rockets/test-channel")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	request("GET", "/rockets/test-channel", "", "", "If-None-Match", resp.Header.Get("ETag"))
+
+	// The signing keys
+	request("GET", "/admin/keys", "", "")
+	created, _ := request("POST", "/admin/keys", testAdminToken, `{"channel": "test-channel"}`).(map[string]interface{})
+	id, _ := created["id"].(string)
+	request("POST", "/admin/keys/"+id+"/rotate", testAdminToken, `{"overlap": "1h"}`)
+	request("GET", "/admin/keys", testAdminToken, "")
+	request("DELETE", "/admin/keys/"+id, testAdminToken, "")
+	request("POST", "/admin/keys/"+id+"/rotate", testAdminToken, `{"overlap": "1h"}`)
+	request("DELETE", "/admin/keys/unknown", testAdminToken, "")
+
+	// Stream events hold state changes
+	streamResp, events := openStream(t, server.URL+"/rockets/stream", "0")
+	defer streamResp.Body.Close()
+	e := nextEvent(t, events)
+	var change interface{}
+	if err := json.Unmarshal([]byte(e.data), &change); err != nil {
+		t.Fatalf("Invalid event data %q: %v", e.data, err)
+	}
+	for _, err := range v.validate(v.schema("StateChange"), change, "event", false) {
+		t.Error(err)
+	}
+}
+
+func TestOpenAPI_Serve(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	resp, err := http.Get(server.URL + "/openapi.json")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected a JSON document, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if !bytes.Equal(body, openAPISpec) {
+		t.Error("Expected the embedded document")
+	}
+
+	// The document only changes with the binary
+	req, _ := http.NewRequest("GET", server.URL+"/openapi.json", nil)
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected status 304, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/docs")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(body), `fetch("openapi.json")`) {
+		t.Errorf("Expected the docs page, got %q", resp.Header.Get("Content-Type"))
+	}
+}
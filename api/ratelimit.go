@@ -0,0 +1,76 @@
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	auth "rocket-service/rockets-auth"
+	config "rocket-service/rockets-config"
+	metrics "rocket-service/rockets-metrics"
+	ratelimit "rocket-service/rockets-ratelimit"
+
+	"github.com/gorilla/mux"
+)
+
+// Scopes of the rate limits.
+const (
+	channelScope = "channel"
+	clientScope  = "client"
+	addressScope = "address"
+)
+
+// SetRateLimits limits the messages of each channel and the requests of each
+// client. Failed authentications are limited per address with the rate of
+// clients, so guessing API keys is throttled too. Call it before
+// InitHandlers.
+func (a *API) SetRateLimits(limits config.RateLimit) {
+	a.channelLimit = ratelimit.New(limits.PerChannel, limits.ChannelBurst)
+	a.clientLimit = ratelimit.New(limits.PerClient, limits.ClientBurst)
+	a.authFailureLimit = ratelimit.New(limits.PerClient, limits.ClientBurst)
+}
+
+// limitClient throttles clients making too many requests. Clients are told
+// apart by their API key, or by their address without one. Public routes are
+// not limited, so probes and scrapers keep working under load.
+func (a *API) limitClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := mux.CurrentRoute(r).GetPathTemplate()
+		if !publicRoutes[route] {
+			if ok, wait := a.clientLimit.Allow(clientID(r)); !ok {
+				throttle(w, r, clientScope, wait)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func clientID(r *http.Request) string {
+	if key := auth.FromContext(r.Context()); key != nil {
+		return key.ID
+	}
+	return clientAddress(r)
+}
+
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// throttle refuses a request over the rate limit of scope, telling the client
+// to retry once a token is available.
+func throttle(w http.ResponseWriter, r *http.Request, scope string, wait time.Duration) {
+	metrics.ObserveThrottled(scope)
+	// Throttled requests come in floods, so they are not logged above debug
+	slog.DebugContext(r.Context(), "Request throttled", "scope", scope, "wait", wait)
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+	writeProblem(w, r, http.StatusTooManyRequests, fmt.Sprintf("rate limit of the %s exceeded", scope))
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	auth "rocket-service/rockets-auth"
+	config "rocket-service/rockets-config"
+)
+
+func TestRateLimit_Channel(t *testing.T) {
+	// A slow refill, so no token comes back during the test
+	server, cleanup := setupTestServer(t, withRateLimits(config.RateLimit{PerChannel: 0.01, ChannelBurst: 2, ClientBurst: 1}))
+	defer cleanup()
+	launched := loadTestMessage(t, "testdata/rocket_launched.json")
+	speedIncreased := loadTestMessage(t, "testdata/speed_increased.json")
+
+	for _, body := range [][]byte{launched, speedIncreased} {
+		if resp := postMessage(t, server, body); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected the burst to be accepted, got %d", resp.StatusCode)
+		}
+	}
+	resp := postMessage(t, server, loadTestMessage(t, "testdata/speed_increased_3.json"))
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") != "100" {
+		t.Errorf("Expected Retry-After 100, got %q", resp.Header.Get("Retry-After"))
+	}
+
+	// Other channels keep their own limit
+	if resp := postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched_chan1.json")); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected another channel to be accepted, got %d", resp.StatusCode)
+	}
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to get metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `rocket_throttled_requests_total{scope="channel"}`) {
+		t.Error("Expected throttled messages to be counted")
+	}
+}
+
+func TestRateLimit_Client(t *testing.T) {
+	server, cleanup := setupTestServer(t, withRateLimits(config.RateLimit{PerClient: 0.01, ClientBurst: 3, ChannelBurst: 1}))
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(server.URL + "/rockets")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected request %d to be accepted, got %d", i+1, resp.StatusCode)
+		}
+	}
+	// The limit covers every route of the client
+	resp := postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched.json"))
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected status 429 with Retry-After, got %d", resp.StatusCode)
+	}
+
+	// Probes are not limited
+	resp, err := http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected /healthz not to be limited, got %d", resp.StatusCode)
+	}
+}
+
+func TestRateLimit_AuthFailures(t *testing.T) {
+	var store *auth.Store
+	server, cleanup := setupTestServer(t, withAuth(&store),
+		withRateLimits(config.RateLimit{PerClient: 0.01, ClientBurst: 2, ChannelBurst: 1}))
+	defer cleanup()
+	token, _ := issueKey(t, store, []auth.Role{auth.RoleRead})
+
+	get := func(token string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+"/rockets", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Valid keys have their own limit, and do not use up the address
+	if resp := get(token); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the key to be accepted, got %d", resp.StatusCode)
+	}
+	for i := 0; i < 2; i++ {
+		if resp := get("rk_guess"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected guess %d to be refused with 401, got %d", i+1, resp.StatusCode)
+		}
+	}
+	// Once the address has failed too often, no key is checked from it, even
+	// one with tokens left
+	for _, attempt := range []string{"rk_guess", token} {
+		resp := get(attempt)
+		if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+			t.Errorf("Expected status 429 with Retry-After, got %d", resp.StatusCode)
+		}
+	}
+}
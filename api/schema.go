@@ -0,0 +1,127 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations upgrade the database schema, in order. The number of migrations
+// applied is kept in the user_version pragma, so each runs once per database.
+// Append new migrations; never edit one that has been released.
+var migrations = []string{
+	// 1: rocket states and the messages applied to them. Databases created
+	// before migrations existed already have these tables.
+	`
+    CREATE TABLE IF NOT EXISTS rockets (
+        channel TEXT PRIMARY KEY,
+        type TEXT,
+        speed INTEGER,
+        mission TEXT,
+        status TEXT,
+        last_message_number INTEGER DEFAULT 0
+    );
+    CREATE TABLE IF NOT EXISTS rocket_events (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        channel TEXT NOT NULL,
+        message_number INTEGER NOT NULL,
+        message_time TEXT,
+        message_type TEXT NOT NULL,
+        payload TEXT NOT NULL,
+        type TEXT,
+        speed INTEGER,
+        mission TEXT,
+        status TEXT,
+        applied_at TEXT,
+        UNIQUE(channel, message_number)
+    );`,
+
+	// 2: how current each rocket is, backfilled from the recorded messages
+	`
+    ALTER TABLE rockets ADD COLUMN last_message_time TEXT;
+    ALTER TABLE rockets ADD COLUMN launched_at TEXT;
+    ALTER TABLE rockets ADD COLUMN updated_at TEXT;
+    UPDATE rockets SET
+        last_message_time = (
+            SELECT message_time FROM rocket_events e
+            WHERE e.channel = rockets.channel AND e.message_number = rockets.last_message_number),
+        updated_at = (
+            SELECT applied_at FROM rocket_events e
+            WHERE e.channel = rockets.channel AND e.message_number = rockets.last_message_number),
+        launched_at = (
+            SELECT message_time FROM rocket_events e
+            WHERE e.channel = rockets.channel AND e.message_type = 'RocketLaunched'
+                AND e.message_number <= rockets.last_message_number
+            ORDER BY e.message_number DESC LIMIT 1);`,
+
+	// 3: out of order messages saved on shutdown, loaded back on start
+	`
+    CREATE TABLE pending_messages (
+        channel TEXT NOT NULL,
+        message_number INTEGER NOT NULL,
+        message_time TEXT,
+        message_type TEXT NOT NULL,
+        payload TEXT NOT NULL,
+        PRIMARY KEY (channel, message_number)
+    );`,
+
+	// 4: shared secrets signing the messages of a channel, or of any channel
+	`
+    CREATE TABLE signing_keys (
+        id TEXT PRIMARY KEY,
+        channel TEXT NOT NULL,
+        secret TEXT NOT NULL,
+        created_at TEXT NOT NULL,
+        expires_at TEXT,
+        revoked_at TEXT
+    );
+    CREATE INDEX signing_keys_channel ON signing_keys (channel);`,
+
+	// 5: API keys, stored as hashes, with their roles and channels
+	`
+    CREATE TABLE api_keys (
+        id TEXT PRIMARY KEY,
+        name TEXT NOT NULL,
+        hash TEXT NOT NULL UNIQUE,
+        roles TEXT NOT NULL,
+        channels TEXT NOT NULL DEFAULT '',
+        created_at TEXT NOT NULL,
+        revoked_at TEXT
+    );`,
+
+	// 6: the messages of each rocket in the order they were recorded, so
+	// listings find the state a rocket was in when they started
+	`
+    CREATE INDEX rocket_events_channel_id ON rocket_events (channel, id);`,
+}
+
+// migrate applies the migrations a database has not seen yet. Each one runs
+// in its own transaction together with the version bump.
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this service (%d)", version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+		// Pragmas do not take parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
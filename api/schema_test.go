@@ -0,0 +1,90 @@
+package api
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate_UpgradesUnversionedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rockets.db")
+
+	// The schema and data of a database created before migrations existed
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = db.Exec(`
+        CREATE TABLE rockets (
+            channel TEXT PRIMARY KEY,
+            type TEXT,
+            speed INTEGER,
+            mission TEXT,
+            status TEXT,
+            last_message_number INTEGER DEFAULT 0
+        );
+        CREATE TABLE rocket_events (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            channel TEXT NOT NULL,
+            message_number INTEGER NOT NULL,
+            message_time TEXT,
+            message_type TEXT NOT NULL,
+            payload TEXT NOT NULL,
+            type TEXT,
+            speed INTEGER,
+            mission TEXT,
+            status TEXT,
+            applied_at TEXT,
+            UNIQUE(channel, message_number)
+        );
+        INSERT INTO rockets VALUES ('chan1', 'Falcon-9', 800, 'ARTEMIS', 'launched', 2);
+        INSERT INTO rocket_events (channel, message_number, message_time, message_type, payload, applied_at) VALUES
+            ('chan1', 1, '2022-02-02T19:39:05+01:00', 'RocketLaunched', '{}', '2024-01-01T00:00:01.000000Z'),
+            ('chan1', 2, '2022-02-02T19:39:06+01:00', 'RocketSpeedIncreased', '{}', '2024-01-01T00:00:02.000000Z');
+    `)
+	db.Close()
+	if err != nil {
+		t.Fatalf("Failed to create tables: %v", err)
+	}
+
+	// Opening it twice checks migrations are not applied again
+	for i := 0; i < 2; i++ {
+		db, err = Init(path)
+		if err != nil {
+			t.Fatalf("Init failed: %v", err)
+		}
+
+		var version int
+		var lastMessageTime, launchedAt, updatedAt string
+		db.QueryRow("PRAGMA user_version").Scan(&version)
+		err = db.QueryRow("SELECT last_message_time, launched_at, updated_at FROM rockets WHERE channel = 'chan1'").
+			Scan(&lastMessageTime, &launchedAt, &updatedAt)
+		db.Close()
+		if err != nil {
+			t.Fatalf("Failed to read rocket: %v", err)
+		}
+
+		if version != len(migrations) {
+			t.Errorf("Expected schema version %d, got %d", len(migrations), version)
+		}
+		if lastMessageTime != "2022-02-02T19:39:06+01:00" || launchedAt != "2022-02-02T19:39:05+01:00" ||
+			updatedAt != "2024-01-01T00:00:02.000000Z" {
+			t.Errorf("Unexpected backfill: %s, %s, %s", lastMessageTime, launchedAt, updatedAt)
+		}
+	}
+}
+
+func TestMigrate_RejectsNewerDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rockets.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.Exec("PRAGMA user_version = 1000")
+	db.Close()
+
+	if db, err := Init(path); err == nil {
+		db.Close()
+		t.Errorf("Expected a database from a newer version to be rejected")
+	}
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	inventory "rocket-service/rockets-inventory"
+	queries "rocket-service/rockets-queries"
+)
+
+func TestShutdown_KeepsAcknowledgedMessages(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rockets.db")
+	db, err := Open(dbPath, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	url := "http://" + listener.Addr().String()
+	ctx, shutdown := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- NewAPI(inventory.NewInventory(db), queries.NewQueries(db)).Serve(ctx, listener, 5*time.Second)
+	}()
+
+	// Streams would hold the shutdown until its deadline if left open
+	stream, events := openStream(t, url+"/rockets/stream", "")
+	defer stream.Body.Close()
+
+	// Rockets are never launched, so every message waits in the buffers
+	var mu sync.Mutex
+	acknowledged := map[string]bool{}
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		wg.Add(1)
+		go func(channel string) {
+			defer wg.Done()
+			for number := 2; number < 200; number++ {
+				body, _ := json.Marshal(inventory.RocketMessage{
+					Metadata: inventory.Metadata{Channel: channel, MessageNumber: number, MessageType: "RocketSpeedIncreased"},
+					Message:  json.RawMessage(`{"by":1}`),
+				})
+				resp, err := http.Post(url+"/messages", "application/json", bytes.NewBuffer(body))
+				if err != nil {
+					// The server has stopped listening
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					mu.Lock()
+					acknowledged[fmt.Sprintf("%s/%d", channel, number)] = true
+					mu.Unlock()
+				} else if resp.StatusCode != http.StatusServiceUnavailable {
+					t.Errorf("Unexpected status %d", resp.StatusCode)
+				}
+			}
+		}(fmt.Sprintf("chan%d", c))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	shutdown()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the shutdown")
+	}
+	wg.Wait()
+	for range events {
+		// The stream ends with the shutdown
+	}
+
+	saved := map[string]bool{}
+	rows, err := db.Query("SELECT channel, message_number FROM pending_messages")
+	if err != nil {
+		t.Fatalf("Failed to read pending messages: %v", err)
+	}
+	for rows.Next() {
+		var channel string
+		var number int
+		rows.Scan(&channel, &number)
+		saved[fmt.Sprintf("%s/%d", channel, number)] = true
+	}
+	rows.Close()
+	if len(acknowledged) == 0 {
+		t.Fatal("Expected some messages to be acknowledged before the shutdown")
+	}
+	for message := range acknowledged {
+		if !saved[message] {
+			t.Errorf("Acknowledged message %s was lost", message)
+		}
+	}
+
+	// The next instance applies the saved messages once the gap is filled
+	restarted := inventory.NewInventory(db)
+	if _, err := restarted.RestorePending(); err != nil {
+		t.Fatalf("Failed to restore pending messages: %v", err)
+	}
+	err = restarted.UpdateRocketState(inventory.RocketMessage{
+		Metadata: inventory.Metadata{Channel: "chan0", MessageNumber: 1, MessageType: "RocketLaunched"},
+		Message:  json.RawMessage(`{"type":"Falcon-9","launchSpeed":500,"mission":"ARTEMIS"}`),
+	})
+	if err != nil {
+		t.Fatalf("Failed to process message: %v", err)
+	}
+	if !acknowledged["chan0/2"] {
+		return
+	}
+	rocket, err := queries.NewQueries(db).GetRocket("chan0")
+	if err != nil {
+		t.Fatalf("Failed to get rocket: %v", err)
+	}
+	if rocket.LastMessageNumber < 2 {
+		t.Errorf("Expected the restored messages to be applied, got message %d", rocket.LastMessageNumber)
+	}
+}
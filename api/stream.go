@@ -0,0 +1,195 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	inventory "rocket-service/rockets-inventory"
+	queries "rocket-service/rockets-queries"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultHeartbeat is how often an idle stream sends a comment to keep
+// proxies from closing the connection.
+const defaultHeartbeat = 15 * time.Second
+
+// defaultReplayPage is how many missed changes a resuming stream reads from
+// the database at a time.
+const defaultReplayPage = 500
+
+// stateChange is the payload of a stream event: the state of a rocket right
+// after a message was applied.
+type stateChange struct {
+	queries.RocketState
+	MessageNumber int    `json:"messageNumber"`
+	MessageType   string `json:"messageType"`
+}
+
+func newStateChange(c inventory.Change) stateChange {
+	return stateChange{
+		RocketState: queries.RocketState{
+			Channel:           c.Channel,
+			Type:              c.Type,
+			Speed:             c.Speed,
+			Mission:           c.Mission,
+			Status:            c.Status,
+			LastMessageNumber: c.MessageNumber,
+			LastMessageTime:   &c.MessageTime,
+			UpdatedAt:         &c.AppliedAt,
+		},
+		MessageNumber: c.MessageNumber,
+		MessageType:   c.MessageType,
+	}
+}
+
+// handleStream sends a Server-Sent Event for every state change, optionally
+// restricted to channels and the filters of GET /rockets. Event ids are
+// change sequence numbers: a client reconnecting with Last-Event-ID first
+// receives the changes it missed.
+func (a *API) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeProblem(w, r, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	values := r.URL.Query()
+	filter, err := parseRocketFilter(values)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	channels := parseChannels(values)
+	if channel := mux.Vars(r)["channel"]; channel != "" {
+		channels = map[string]bool{channel: true}
+	}
+
+	// EventSource sends Last-Event-ID when reconnecting; the query parameter
+	// lets a new connection resume too
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = values.Get("last_event_id")
+	}
+	var lastSeq int64
+	if lastEventID != "" {
+		lastSeq, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || lastSeq < 0 {
+			writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("invalid Last-Event-ID: %s", lastEventID))
+			return
+		}
+	}
+
+	// Subscribe before reading missed changes so none falls in between
+	changes, unsubscribe := a.inventory.Subscribe()
+	defer unsubscribe()
+
+	// Missed changes are read a page at a time, so resuming from an old
+	// event id does not load the whole history at once
+	var missed []inventory.Change
+	if lastEventID != "" {
+		missed, err = a.queries.ChangesSince(lastSeq, a.replayPage)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(c inventory.Change) error {
+		if c.Seq <= lastSeq {
+			return nil
+		}
+		lastSeq = c.Seq
+		change := newStateChange(c)
+		if len(channels) > 0 && !channels[c.Channel] || !filter.Matches(change.RocketState) {
+			return nil
+		}
+		data, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: rocket\ndata: %s\n\n", c.Seq, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	for len(missed) > 0 {
+		for _, c := range missed {
+			if err := send(c); err != nil {
+				return
+			}
+		}
+		if len(missed) < a.replayPage {
+			break
+		}
+		// The client resumes from the last event it received
+		missed, err = a.queries.ChangesSince(lastSeq, a.replayPage)
+		if err != nil {
+			return
+		}
+	}
+
+	ctx, cancel := a.streamContext(r)
+	defer cancel()
+	heartbeat := time.NewTicker(a.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c, ok := <-changes:
+			// A closed channel means this stream fell behind; the client
+			// reconnects and resumes from its last event id
+			if !ok {
+				return
+			}
+			if err := send(c); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// streamContext returns the context of a stream or websocket, which is done
+// with its request or once the server shuts down.
+func (a *API) streamContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(r.Context())
+	stop := context.AfterFunc(a.closing, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// parseChannels reads the channel query parameter, which can be repeated or
+// hold a comma separated list.
+func parseChannels(values map[string][]string) map[string]bool {
+	channels := map[string]bool{}
+	for _, value := range values["channel"] {
+		for _, channel := range strings.Split(value, ",") {
+			if channel = strings.TrimSpace(channel); channel != "" {
+				channels[channel] = true
+			}
+		}
+	}
+	return channels
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	id      string
+	event   string
+	data    string
+	comment string
+}
+
+// readEvents parses Server-Sent Events from a response body into a channel.
+func readEvents(resp *http.Response) <-chan sseEvent {
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		var e sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				events <- e
+				e = sseEvent{}
+			case strings.HasPrefix(line, ":"):
+				e.comment = strings.TrimSpace(line[1:])
+			case strings.HasPrefix(line, "id: "):
+				e.id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				e.event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				e.data = line[6:]
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("Stream closed")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+	return sseEvent{}
+}
+
+func openStream(t *testing.T, url string, lastEventID string) (*http.Response, <-chan sseEvent) {
+	req, _ := http.NewRequest("GET", url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %q", ct)
+	}
+	return resp, readEvents(resp)
+}
+
+func TestStream_FiltersChanges(t *testing.T) {
+	server, cleanup := setupTestServer(t, withHeartbeat(time.Hour))
+	defer cleanup()
+
+	resp, events := openStream(t, server.URL+"/rockets/stream?type=Starship", "")
+	defer resp.Body.Close()
+
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched_chan1.json"))
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched_chan2.json"))
+
+	e := nextEvent(t, events)
+	if e.event != "rocket" || e.id != "2" {
+		t.Errorf("Expected rocket event with id 2, got %+v", e)
+	}
+	var change stateChange
+	if err := json.Unmarshal([]byte(e.data), &change); err != nil {
+		t.Fatalf("Failed to decode event data %q: %v", e.data, err)
+	}
+	if change.Channel != "chan2" || *change.Speed != 1000 || change.MessageType != "RocketLaunched" {
+		t.Errorf("Unexpected change: %+v", change)
+	}
+}
+
+func TestStream_ChannelStreamResumesFromLastEventID(t *testing.T) {
+	server, cleanup := setupTestServer(t, withHeartbeat(time.Hour))
+	defer cleanup()
+
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched.json"))
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched_chan1.json"))
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased.json"))
+
+	resp, events := openStream(t, server.URL+"/rockets/test-channel/stream", "1")
+	defer resp.Body.Close()
+
+	// Missed changes are replayed first, then live ones follow
+	e := nextEvent(t, events)
+	if e.id != "3" || !strings.Contains(e.data, `"speed":800`) {
+		t.Errorf("Expected missed change 3 with speed 800, got %+v", e)
+	}
+
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased_3.json"))
+	e = nextEvent(t, events)
+	if e.id != "4" || !strings.Contains(e.data, `"speed":1000`) {
+		t.Errorf("Expected live change 4 with speed 1000, got %+v", e)
+	}
+}
+
+func TestStream_ReplaysMissedChangesInPages(t *testing.T) {
+	server, cleanup := setupTestServer(t, withHeartbeat(time.Hour), withReplayPage(2))
+	defer cleanup()
+
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched.json"))
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched_chan1.json"))
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased.json"))
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased_3.json"))
+
+	resp, events := openStream(t, server.URL+"/rockets/stream", "0")
+	defer resp.Body.Close()
+
+	for _, id := range []string{"1", "2", "3", "4"} {
+		if e := nextEvent(t, events); e.id != id {
+			t.Errorf("Expected missed change %s, got %+v", id, e)
+		}
+	}
+
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched_chan2.json"))
+	if e := nextEvent(t, events); e.id != "5" {
+		t.Errorf("Expected live change 5, got %+v", e)
+	}
+}
+
+func TestStream_Heartbeat(t *testing.T) {
+	server, cleanup := setupTestServer(t, withHeartbeat(10*time.Millisecond))
+	defer cleanup()
+
+	resp, events := openStream(t, server.URL+"/rockets/stream", "")
+	defer resp.Body.Close()
+
+	if e := nextEvent(t, events); e.comment != "heartbeat" {
+		t.Errorf("Expected heartbeat comment, got %+v", e)
+	}
+}
+
+func TestStream_InvalidParameters(t *testing.T) {
+	server, cleanup := setupTestServer(t, withHeartbeat(time.Hour))
+	defer cleanup()
+
+	for _, query := range []string{"status=orbiting", "last_event_id=abc", "last_event_id=-1"} {
+		resp, err := http.Get(server.URL + "/rockets/stream?" + query)
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %q, got %d", query, resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing_Spans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	}()
+
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	// Message 2 is buffered, then message 1 drains it
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased.json"))
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest("POST", server.URL+"/messages",
+		bytes.NewBuffer(loadTestMessage(t, "testdata/rocket_launched.json")))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to post message: %v", err)
+	}
+	resp.Body.Close()
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() == traceID {
+			spans[span.Name()] = span
+		}
+	}
+	parents := map[string]string{
+		"POST /messages":             "",
+		"UpdateRocketState":          "POST /messages",
+		"wait for channel lock":      "UpdateRocketState",
+		"SELECT rockets":             "UpdateRocketState",
+		"apply RocketLaunched":       "UpdateRocketState",
+		"drain buffer":               "UpdateRocketState",
+		"apply RocketSpeedIncreased": "drain buffer",
+		"COMMIT":                     "UpdateRocketState",
+	}
+	for name, parent := range parents {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("Expected a span %q in the trace of the sender", name)
+			continue
+		}
+		if parent == "" {
+			if span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+				t.Errorf("Expected %q to continue the span of the sender, got parent %s", name, span.Parent().SpanID())
+			}
+		} else if spans[parent] != nil && span.Parent().SpanID() != spans[parent].SpanContext().SpanID() {
+			t.Errorf("Expected %q to be a child of %q", name, parent)
+		}
+	}
+
+	outcome := ""
+	for _, attr := range spans["UpdateRocketState"].Attributes() {
+		if attr.Key == "rocket.outcome" {
+			outcome = attr.Value.AsString()
+		}
+	}
+	if outcome != "applied" {
+		t.Errorf("Expected the applied outcome, got %q", outcome)
+	}
+}
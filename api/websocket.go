@@ -0,0 +1,299 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	inventory "rocket-service/rockets-inventory"
+	queries "rocket-service/rockets-queries"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		writeProblem(w, r, status, reason.Error())
+	},
+}
+
+// wsCommand is sent by clients to manage their subscriptions. A subscription
+// selects rockets by channel, by a filter expression using the query
+// parameters of GET /rockets (e.g. "status=launched&type=Falcon-9"), or both.
+type wsCommand struct {
+	Action   string   `json:"action"`
+	ID       string   `json:"id"`
+	Channels []string `json:"channels,omitempty"`
+	Filter   string   `json:"filter,omitempty"`
+}
+
+// wsRequest is a command read from a connection, or the reason it could not be decoded.
+type wsRequest struct {
+	cmd wsCommand
+	err error
+}
+
+type wsMessage struct {
+	Type    string                 `json:"type"`
+	ID      string                 `json:"id,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+	Rockets []queries.RocketState  `json:"rockets,omitempty"`
+	Seq     int64                  `json:"seq,omitempty"`
+	Channel string                 `json:"channel,omitempty"`
+	Changes map[string]interface{} `json:"changes,omitempty"`
+	Removed bool                   `json:"removed,omitempty"`
+}
+
+type subscription struct {
+	channels map[string]bool
+	filter   queries.RocketFilter
+}
+
+func (s subscription) matches(r queries.RocketState) bool {
+	return (len(s.channels) == 0 || s.channels[r.Channel]) && s.filter.Matches(r)
+}
+
+// knownRocket is the last state of a rocket sent over a connection and the
+// change sequence it reflects.
+type knownRocket struct {
+	state queries.RocketState
+	seq   int64
+}
+
+// wsSession holds the subscriptions of one connection and what it has been sent.
+type wsSession struct {
+	api           *API
+	conn          *websocket.Conn
+	subscriptions map[string]subscription
+	known         map[string]knownRocket
+}
+
+// handleWebSocket lets dashboards subscribe to rockets and receive only the
+// fields that changed. Subscribing sends a snapshot of the matching rockets,
+// then a delta follows each change. A rocket that stops matching gets a last
+// delta marked as removed.
+func (a *API) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	wsUpgrader := upgrader
+	wsUpgrader.CheckOrigin = a.checkOrigin
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error
+		return
+	}
+	defer conn.Close()
+
+	s := &wsSession{
+		api:           a,
+		conn:          conn,
+		subscriptions: map[string]subscription{},
+		known:         map[string]knownRocket{},
+	}
+
+	changes, unsubscribe := a.inventory.Subscribe()
+	defer unsubscribe()
+
+	// Reads happen in their own goroutine; every write stays in this one
+	commands := make(chan wsRequest)
+	done := make(chan struct{})
+	defer close(done)
+	conn.SetReadDeadline(time.Now().Add(2 * a.heartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * a.heartbeat))
+	})
+	go func() {
+		defer close(commands)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var req wsRequest
+			req.err = json.Unmarshal(data, &req.cmd)
+			select {
+			case commands <- req:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := a.streamContext(r)
+	defer cancel()
+	ping := time.NewTicker(a.heartbeat)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+			return
+		case req, ok := <-commands:
+			if !ok {
+				return
+			}
+			if err := s.handleCommand(req); err != nil {
+				return
+			}
+		case c, ok := <-changes:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber fell behind"))
+				return
+			}
+			if err := s.handleChange(c); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *wsSession) handleCommand(req wsRequest) error {
+	cmd := req.cmd
+	if req.err != nil {
+		return s.conn.WriteJSON(wsMessage{Type: "error", Error: "invalid command: " + req.err.Error()})
+	}
+
+	switch cmd.Action {
+	case "subscribe":
+		return s.subscribe(cmd)
+	case "unsubscribe":
+		if _, ok := s.subscriptions[cmd.ID]; !ok {
+			return s.conn.WriteJSON(wsMessage{Type: "error", ID: cmd.ID, Error: "unknown subscription"})
+		}
+		delete(s.subscriptions, cmd.ID)
+		for channel, k := range s.known {
+			if !s.matches(k.state) {
+				delete(s.known, channel)
+			}
+		}
+		return s.conn.WriteJSON(wsMessage{Type: "unsubscribed", ID: cmd.ID})
+	default:
+		return s.conn.WriteJSON(wsMessage{Type: "error", ID: cmd.ID, Error: fmt.Sprintf("unknown action: %s", cmd.Action)})
+	}
+}
+
+func (s *wsSession) subscribe(cmd wsCommand) error {
+	if cmd.ID == "" {
+		return s.conn.WriteJSON(wsMessage{Type: "error", Error: "subscription id is required"})
+	}
+
+	values, err := url.ParseQuery(cmd.Filter)
+	if err != nil {
+		return s.conn.WriteJSON(wsMessage{Type: "error", ID: cmd.ID, Error: "invalid filter: " + err.Error()})
+	}
+	filter, err := parseRocketFilter(values)
+	if err != nil {
+		return s.conn.WriteJSON(wsMessage{Type: "error", ID: cmd.ID, Error: err.Error()})
+	}
+	sub := subscription{channels: parseChannels(values), filter: filter}
+	for _, channel := range cmd.Channels {
+		sub.channels[channel] = true
+	}
+
+	// Changes up to this version are part of the snapshot, later ones are
+	// sent as deltas
+	version, err := s.api.queries.FleetVersion()
+	if err != nil {
+		return s.conn.WriteJSON(wsMessage{Type: "error", ID: cmd.ID, Error: err.Error()})
+	}
+	page, err := s.api.queries.ListRockets(queries.ListOptions{Filter: filter})
+	if err != nil {
+		return s.conn.WriteJSON(wsMessage{Type: "error", ID: cmd.ID, Error: err.Error()})
+	}
+
+	s.subscriptions[cmd.ID] = sub
+	snapshot := []queries.RocketState{}
+	for _, r := range page.Rockets {
+		if sub.matches(r) {
+			snapshot = append(snapshot, r)
+			s.known[r.Channel] = knownRocket{state: r, seq: version.Number}
+		}
+	}
+
+	return s.conn.WriteJSON(wsMessage{Type: "snapshot", ID: cmd.ID, Rockets: snapshot})
+}
+
+func (s *wsSession) handleChange(c inventory.Change) error {
+	state := newStateChange(c).RocketState
+	previous, wasKnown := s.known[c.Channel]
+	if wasKnown && c.Seq <= previous.seq {
+		return nil
+	}
+
+	matches := s.matches(state)
+	if !matches && !wasKnown {
+		return nil
+	}
+
+	changes := diffRocket(previous.state, state, wasKnown)
+	if matches {
+		s.known[c.Channel] = knownRocket{state: state, seq: c.Seq}
+	} else {
+		delete(s.known, c.Channel)
+	}
+	if len(changes) == 0 && matches {
+		return nil
+	}
+
+	return s.conn.WriteJSON(wsMessage{
+		Type:    "delta",
+		Seq:     c.Seq,
+		Channel: c.Channel,
+		Changes: changes,
+		Removed: !matches,
+	})
+}
+
+func (s *wsSession) matches(r queries.RocketState) bool {
+	for _, sub := range s.subscriptions {
+		if sub.matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// diffRocket returns the fields of next that differ from previous, or all of
+// its known fields when previous was never sent. Fields that became unknown
+// are set to nil.
+func diffRocket(previous, next queries.RocketState, wasKnown bool) map[string]interface{} {
+	fields := []struct {
+		name           string
+		previous, next interface{}
+	}{
+		{"type", stringValue(previous.Type), stringValue(next.Type)},
+		{"speed", intValue(previous.Speed), intValue(next.Speed)},
+		{"mission", stringValue(previous.Mission), stringValue(next.Mission)},
+		{"status", stringValue(previous.Status), stringValue(next.Status)},
+	}
+
+	changes := map[string]interface{}{}
+	for _, f := range fields {
+		if wasKnown && f.previous == f.next || !wasKnown && f.next == nil {
+			continue
+		}
+		changes[f.name] = f.next
+	}
+	return changes
+}
+
+func stringValue(s *string) interface{} {
+	if s == nil {
+		return nil
+	}
+	return *s
+}
+
+func intValue(i *int) interface{} {
+	if i == nil {
+		return nil
+	}
+	return *i
+}
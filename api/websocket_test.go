@@ -0,0 +1,106 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func readWS(t *testing.T, conn *websocket.Conn) wsMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg wsMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	return msg
+}
+
+func TestWebSocket_SubscriptionsAndDeltas(t *testing.T) {
+	server, cleanup := setupTestServer(t, withHeartbeat(time.Hour))
+	defer cleanup()
+
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched_chan1.json"))
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched_chan2.json"))
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/rockets/ws", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// A filter subscription starts with a snapshot of the matching rockets
+	conn.WriteJSON(wsCommand{Action: "subscribe", ID: "starships", Filter: "type=Starship"})
+	msg := readWS(t, conn)
+	if msg.Type != "snapshot" || msg.ID != "starships" || len(msg.Rockets) != 1 || msg.Rockets[0].Channel != "chan2" {
+		t.Fatalf("Expected snapshot with chan2, got %+v", msg)
+	}
+
+	conn.WriteJSON(wsCommand{Action: "subscribe", ID: "test", Channels: []string{"test-channel"}})
+	if msg := readWS(t, conn); msg.Type != "snapshot" || len(msg.Rockets) != 0 {
+		t.Fatalf("Expected empty snapshot, got %+v", msg)
+	}
+
+	// A rocket seen for the first time is sent whole, then only what changes
+	postMessage(t, server, loadTestMessage(t, "testdata/rocket_launched.json"))
+	msg = readWS(t, conn)
+	expected := map[string]interface{}{"type": "Falcon-9", "speed": float64(500), "mission": "ARTEMIS", "status": "launched"}
+	if msg.Type != "delta" || msg.Channel != "test-channel" || !reflect.DeepEqual(msg.Changes, expected) {
+		t.Errorf("Expected full delta for test-channel, got %+v", msg)
+	}
+
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased.json"))
+	msg = readWS(t, conn)
+	if msg.Channel != "test-channel" || !reflect.DeepEqual(msg.Changes, map[string]interface{}{"speed": float64(800)}) {
+		t.Errorf("Expected speed delta for test-channel, got %+v", msg)
+	}
+
+	conn.WriteJSON(wsCommand{Action: "unsubscribe", ID: "test"})
+	if msg := readWS(t, conn); msg.Type != "unsubscribed" || msg.ID != "test" {
+		t.Errorf("Expected unsubscribed, got %+v", msg)
+	}
+
+	// Neither unsubscribed nor unmatched rockets send deltas
+	postMessage(t, server, loadTestMessage(t, "testdata/speed_increased_3.json"))
+	postMessage(t, server, []byte(`{"metadata":{"channel":"chan1","messageNumber":2,"messageType":"RocketSpeedIncreased"},"message":{"by":10}}`))
+	postMessage(t, server, []byte(`{"metadata":{"channel":"chan2","messageNumber":2,"messageType":"RocketMissionChanged"},"message":{"newMission":"SHUTTLE_MIR"}}`))
+	msg = readWS(t, conn)
+	if msg.Channel != "chan2" || !reflect.DeepEqual(msg.Changes, map[string]interface{}{"mission": "SHUTTLE_MIR"}) || msg.Removed {
+		t.Errorf("Expected mission delta for chan2, got %+v", msg)
+	}
+
+	conn.WriteJSON(wsCommand{Action: "subscribe", ID: "starships", Filter: "type=Starship&status=launched"})
+	readWS(t, conn)
+	postMessage(t, server, []byte(`{"metadata":{"channel":"chan2","messageNumber":3,"messageType":"RocketExploded"},"message":{"reason":"PRESSURE_VESSEL_FAILURE"}}`))
+	msg = readWS(t, conn)
+	if msg.Channel != "chan2" || !msg.Removed || msg.Changes["status"] != "exploded" {
+		t.Errorf("Expected removal delta for chan2, got %+v", msg)
+	}
+}
+
+func TestWebSocket_InvalidCommands(t *testing.T) {
+	server, cleanup := setupTestServer(t, withHeartbeat(time.Hour))
+	defer cleanup()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/rockets/ws", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	for _, command := range []string{
+		`not json`,
+		`{"action":"launch","id":"x"}`,
+		`{"action":"subscribe"}`,
+		`{"action":"subscribe","id":"x","filter":"status=orbiting"}`,
+		`{"action":"unsubscribe","id":"unknown"}`,
+	} {
+		conn.WriteMessage(websocket.TextMessage, []byte(command))
+		if msg := readWS(t, conn); msg.Type != "error" || msg.Error == "" {
+			t.Errorf("Expected error for %s, got %+v", command, msg)
+		}
+	}
+}
@@ -1,23 +1,207 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
 	"rocket-service/api"
+	auth "rocket-service/rockets-auth"
+	config "rocket-service/rockets-config"
 	inventory "rocket-service/rockets-inventory"
+	logging "rocket-service/rockets-logging"
 	queries "rocket-service/rockets-queries"
+	signing "rocket-service/rockets-signing"
+	tracing "rocket-service/rockets-tracing"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 )
 
 func main() {
-	db, err := api.Init("./rockets.db")
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		err := runKeys(os.Args[2:], os.Getenv, os.Stdout)
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatal(err)
+		fatal("Invalid configuration", err)
+	}
+
+	// Validated by config.Load
+	var level slog.Level
+	level.UnmarshalText([]byte(cfg.LogLevel))
+	slog.SetDefault(logging.New(os.Stderr, cfg.LogFormat, level))
+
+	shutdownTracing, err := tracing.Setup(cfg.Tracing.Exporter, cfg.Tracing.File, cfg.Tracing.SampleRatio)
+	if err != nil {
+		fatal("Failed to set up tracing", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("Failed to flush traces", "error", err)
+		}
+	}()
+
+	db, err := api.Open(cfg.DBPath, cfg.BusyTimeout)
+	if err != nil {
+		fatal("Failed to open the database", err)
 	}
 	defer db.Close()
 	inventory := inventory.NewInventory(db)
+	inventory.SetBufferLimits(cfg.Buffer.MaxPerChannel, cfg.Buffer.MaxTotal)
+	if _, err := inventory.RestorePending(); err != nil {
+		fatal("Failed to restore buffered messages", err)
+	}
 	queries := queries.NewQueries(db)
 	api := api.NewAPI(inventory, queries)
-	startError := api.Start()
+	api.SetFeatures(cfg.Features)
+	api.SetReadiness(cfg.Readiness)
+	api.SetRateLimits(cfg.RateLimit)
+	api.SetDecoding(cfg.MaxBodyBytes, cfg.StrictJSON)
+	api.SetCORS(cfg.CORS)
+	api.SetSigning(signing.NewKeys(db, cfg.Signing.MaxSkew), cfg.Signing.Required)
+	api.SetAdminToken(cfg.AdminToken)
+	if cfg.RequireAPIKeys {
+		api.SetAuth(auth.NewStore(db))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	startError := api.Start(ctx, cfg.Addr, cfg.ShutdownTimeout)
 	if startError != nil {
-		log.Fatal(startError)
+		fatal("Server failed", startError)
+	}
+	slog.Info("Server stopped")
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+const keysUsage = `usage: rocket-service keys <command> [flags]
+
+commands:
+  issue -name NAME -roles ROLES [-channels CHANNELS]
+        issue a key with comma separated roles (ingest, read, admin),
+        limited to comma separated channels when given
+  list  list the keys, revoked or not
+  revoke [flags] ID
+        revoke a key at once
+
+Every command takes -config and -db to find the database, like the server.`
+
+// runKeys runs the keys subcommand, which manages the API keys in the
+// database of the server.
+func runKeys(args []string, getenv func(string) string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command\n%s", keysUsage)
+	}
+	command := args[0]
+	if command != "issue" && command != "list" && command != "revoke" {
+		return fmt.Errorf("unknown command %q\n%s", command, keysUsage)
+	}
+	fs := flag.NewFlagSet("keys "+command, flag.ContinueOnError)
+	fs.String("config", "", "YAML or JSON config file (env ROCKETS_CONFIG)")
+	fs.String("db", "", "SQLite database file (env ROCKETS_DB_PATH)")
+	name := fs.String("name", "", "name of the key, such as who it is for")
+	roles := fs.String("roles", "", "comma separated roles: ingest, read, admin")
+	channels := fs.String("channels", "", "comma separated channels the key is limited to, empty for every channel")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if command != "revoke" && fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	// The database is found the way the server finds it
+	var configArgs []string
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "db" {
+			configArgs = append(configArgs, "-"+f.Name, f.Value.String())
+		}
+	})
+	cfg, err := config.Load(configArgs, getenv)
+	if err != nil {
+		return err
+	}
+	if cfg.DBPath == "" {
+		return fmt.Errorf("keys of an in-memory database would be lost, set -db")
+	}
+	db, err := api.Open(cfg.DBPath, cfg.BusyTimeout)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	store := auth.NewStore(db)
+
+	switch command {
+	case "issue":
+		if *name == "" || *roles == "" {
+			return fmt.Errorf("issue needs -name and -roles")
+		}
+		parsed, err := auth.ParseRoles(*roles)
+		if err != nil {
+			return err
+		}
+		var scope []string
+		if *channels != "" {
+			for _, channel := range strings.Split(*channels, ",") {
+				scope = append(scope, strings.TrimSpace(channel))
+			}
+		}
+		token, key, err := store.Issue(*name, parsed, scope)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Issued %s. Its token is only shown now:\n%s\n", key.ID, token)
+	case "list":
+		keys, err := store.List()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tROLES\tCHANNELS\tCREATED\tREVOKED")
+		for _, key := range keys {
+			roleNames := make([]string, len(key.Roles))
+			for i, role := range key.Roles {
+				roleNames[i] = string(role)
+			}
+			scope, revoked := "*", "-"
+			if key.Scoped() {
+				scope = strings.Join(key.Channels, ",")
+			}
+			if key.RevokedAt != nil {
+				revoked = *key.RevokedAt
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				key.ID, key.Name, strings.Join(roleNames, ","), scope, key.CreatedAt, revoked)
+		}
+		return tw.Flush()
+	case "revoke":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("revoke needs the ID of the key")
+		}
+		if err := store.Revoke(fs.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Revoked %s\n", fs.Arg(0))
 	}
+	return nil
 }
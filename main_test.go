@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"rocket-service/api"
+	auth "rocket-service/rockets-auth"
+)
+
+func noEnv(string) string {
+	return ""
+}
+
+func TestRunKeys(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rockets.db")
+	run := func(args ...string) string {
+		t.Helper()
+		var out bytes.Buffer
+		if err := runKeys(args, noEnv, &out); err != nil {
+			t.Fatalf("keys %s failed: %v", strings.Join(args, " "), err)
+		}
+		return out.String()
+	}
+
+	issued := run("issue", "-db", dbPath, "-name", "dashboard", "-roles", "read,ingest", "-channels", "chan1, chan2")
+	match := regexp.MustCompile(`Issued (ak_\w+)\. .*\n(rk_\w+)\n`).FindStringSubmatch(issued)
+	if match == nil {
+		t.Fatalf("Unexpected output of issue: %q", issued)
+	}
+	id, token := match[1], match[2]
+
+	db, err := api.Open(dbPath, 0)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	key, err := auth.NewStore(db).Authenticate(token)
+	if err != nil {
+		t.Fatalf("Expected the issued token to authenticate: %v", err)
+	}
+	if key.ID != id || !key.Has(auth.RoleRead) || !key.Has(auth.RoleIngest) || !key.Allows("chan2") || key.Allows("chan3") {
+		t.Errorf("Unexpected key: %+v", key)
+	}
+
+	run("issue", "-db", dbPath, "-name", "admin", "-roles", "admin")
+	listed := run("list", "-db", dbPath)
+	lines := strings.Split(strings.TrimSpace(listed), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "ID") {
+		t.Fatalf("Expected a header and 2 keys, got:\n%s", listed)
+	}
+	if fields := strings.Fields(lines[1]); fields[0] != id || fields[1] != "dashboard" ||
+		fields[2] != "read,ingest" || fields[3] != "chan1,chan2" || fields[5] != "-" {
+		t.Errorf("Unexpected listed key: %q", lines[1])
+	}
+	if fields := strings.Fields(lines[2]); fields[1] != "admin" || fields[3] != "*" {
+		t.Errorf("Expected the admin key to allow every channel: %q", lines[2])
+	}
+
+	if out := run("revoke", "-db", dbPath, id); out != "Revoked "+id+"\n" {
+		t.Errorf("Unexpected output of revoke: %q", out)
+	}
+	if _, err := auth.NewStore(db).Authenticate(token); !errors.Is(err, auth.ErrUnauthenticated) {
+		t.Errorf("Expected the revoked token to be refused, got %v", err)
+	}
+	lines = strings.Split(strings.TrimSpace(run("list", "-db", dbPath)), "\n")
+	if fields := strings.Fields(lines[1]); fields[5] == "-" {
+		t.Errorf("Expected the key to be listed as revoked: %q", lines[1])
+	}
+}
+
+func TestRunKeys_Errors(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rockets.db")
+
+	tests := []struct {
+		name     string
+		args     []string
+		contains string
+	}{
+		{"no command", nil, "missing command"},
+		{"unknown command", []string{"rotate"}, `unknown command "rotate"`},
+		{"in-memory database", []string{"list", "-db", ""}, "set -db"},
+		{"missing name", []string{"issue", "-db", dbPath, "-roles", "read"}, "issue needs -name and -roles"},
+		{"unknown role", []string{"issue", "-db", dbPath, "-name", "n", "-roles", "write"}, "invalid role"},
+		{"empty channel", []string{"issue", "-db", dbPath, "-name", "n", "-roles", "read", "-channels", "chan1,,chan2"},
+			"invalid channel"},
+		{"unexpected arguments", []string{"list", "-db", dbPath, "extra"}, "unexpected arguments: extra"},
+		{"revoke without ID", []string{"revoke", "-db", dbPath}, "revoke needs the ID"},
+		{"revoke unknown key", []string{"revoke", "-db", dbPath, "ak_unknown"}, "API key not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := runKeys(tt.args, noEnv, &out)
+			if err == nil || !strings.Contains(err.Error(), tt.contains) {
+				t.Errorf("Expected error containing %q, got %v", tt.contains, err)
+			}
+		})
+	}
+}
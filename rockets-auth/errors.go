@@ -0,0 +1,23 @@
+package auth
+
+import "errors"
+
+var (
+	// ErrUnauthenticated is returned when a request has no API key, or one
+	// that is unknown or revoked.
+	ErrUnauthenticated = errors.New("a valid API key is required")
+
+	// ErrForbidden is returned when an API key lacks the role or the channel
+	// a request needs.
+	ErrForbidden = errors.New("the API key is not allowed to do this")
+
+	// ErrKeyNotFound is returned when no API key has the requested ID.
+	ErrKeyNotFound = errors.New("API key not found")
+
+	// ErrInvalidRole is returned when issuing a key with an unknown role.
+	ErrInvalidRole = errors.New("invalid role")
+
+	// ErrInvalidChannel is returned when issuing a key limited to an empty
+	// channel, or to one with a comma, which separates the stored channels.
+	ErrInvalidChannel = errors.New("invalid channel")
+)
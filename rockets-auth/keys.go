@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	storage "rocket-service/rockets-storage"
+)
+
+// Role grants access to a group of endpoints.
+type Role string
+
+const (
+	// RoleIngest sends messages.
+	RoleIngest Role = "ingest"
+	// RoleRead reads rockets, their events, statistics and streams.
+	RoleRead Role = "read"
+	// RoleAdmin manages keys, and has every other role too.
+	RoleAdmin Role = "admin"
+)
+
+var roles = map[Role]bool{RoleIngest: true, RoleRead: true, RoleAdmin: true}
+
+// ParseRoles parses a comma separated list of roles.
+func ParseRoles(s string) ([]Role, error) {
+	var parsed []Role
+	for _, name := range strings.Split(s, ",") {
+		role := Role(strings.TrimSpace(name))
+		if !roles[role] {
+			return nil, fmt.Errorf("%w: %q, must be ingest, read or admin", ErrInvalidRole, role)
+		}
+		parsed = append(parsed, role)
+	}
+	return parsed, nil
+}
+
+// Key is an API key as stored: the secret token itself is only known when
+// the key is issued, and only its hash is kept.
+type Key struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Roles     []Role   `json:"roles"`
+	Channels  []string `json:"channels,omitempty"`
+	CreatedAt string   `json:"createdAt"`
+	RevokedAt *string  `json:"revokedAt,omitempty"`
+}
+
+// Has reports whether the key has role, which admin keys always do.
+func (k *Key) Has(role Role) bool {
+	for _, r := range k.Roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Scoped reports whether the key is limited to some channels.
+func (k *Key) Scoped() bool {
+	return len(k.Channels) > 0
+}
+
+// Allows reports whether the key may access channel.
+func (k *Key) Allows(channel string) bool {
+	if !k.Scoped() {
+		return true
+	}
+	for _, c := range k.Channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+type keyContextKey struct{}
+
+// WithKey returns a copy of ctx carrying the key that authenticated a request.
+func WithKey(ctx context.Context, key *Key) context.Context {
+	return context.WithValue(ctx, keyContextKey{}, key)
+}
+
+// FromContext returns the key of the request, or nil when it was not
+// authenticated.
+func FromContext(ctx context.Context) *Key {
+	key, _ := ctx.Value(keyContextKey{}).(*Key)
+	return key
+}
+
+// Store keeps the API keys in the database.
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Issue creates a key with roles, limited to channels unless channels is
+// empty. It returns the token to hand to the client, which cannot be
+// recovered later.
+func (s *Store) Issue(name string, roles []Role, channels []string) (string, *Key, error) {
+	if len(roles) == 0 {
+		return "", nil, fmt.Errorf("%w: a key needs at least one role", ErrInvalidRole)
+	}
+	for _, channel := range channels {
+		if channel == "" || strings.Contains(channel, ",") {
+			return "", nil, fmt.Errorf("%w: %q", ErrInvalidChannel, channel)
+		}
+	}
+	id, err := storage.RandomHex(8)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := storage.RandomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+	token := "rk_" + secret
+
+	key := &Key{
+		ID:        "ak_" + id,
+		Name:      name,
+		Roles:     roles,
+		Channels:  channels,
+		CreatedAt: time.Now().UTC().Format(storage.TimestampFormat),
+	}
+	roleNames := make([]string, len(roles))
+	for i, role := range roles {
+		roleNames[i] = string(role)
+	}
+	_, err = s.db.Exec("INSERT INTO api_keys (id, name, hash, roles, channels, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		key.ID, key.Name, hash(token), strings.Join(roleNames, ","), strings.Join(channels, ","), key.CreatedAt)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, key, nil
+}
+
+// Authenticate returns the active key of token.
+func (s *Store) Authenticate(token string) (*Key, error) {
+	key, err := scanKey(s.db.QueryRow("SELECT "+keyColumns+" FROM api_keys WHERE hash = ? AND revoked_at IS NULL", hash(token)))
+	if err == sql.ErrNoRows {
+		return nil, ErrUnauthenticated
+	}
+	return key, err
+}
+
+// List returns every key, revoked or not.
+func (s *Store) List() ([]Key, error) {
+	rows, err := s.db.Query("SELECT " + keyColumns + " FROM api_keys ORDER BY created_at, rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []Key{}
+	for rows.Next() {
+		key, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+// Revoke disables a key at once.
+func (s *Store) Revoke(id string) error {
+	result, err := s.db.Exec("UPDATE api_keys SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?",
+		time.Now().UTC().Format(storage.TimestampFormat), id)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		if err == nil {
+			err = ErrKeyNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+const keyColumns = "id, name, roles, channels, created_at, revoked_at"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanKey(row scanner) (*Key, error) {
+	var key Key
+	var roleNames, channels string
+	if err := row.Scan(&key.ID, &key.Name, &roleNames, &channels, &key.CreatedAt, &key.RevokedAt); err != nil {
+		return nil, err
+	}
+	for _, role := range strings.Split(roleNames, ",") {
+		key.Roles = append(key.Roles, Role(role))
+	}
+	if channels != "" {
+		key.Channels = strings.Split(channels, ",")
+	}
+	return &key, nil
+}
+
+// hash is what is stored of a token. Tokens are long and random, so a fast
+// hash is enough to keep them from being read back from the database.
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
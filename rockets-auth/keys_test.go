@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func setupStore(t *testing.T) (*Store, *sql.DB) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(`
+        CREATE TABLE api_keys (
+            id TEXT PRIMARY KEY,
+            name TEXT NOT NULL,
+            hash TEXT NOT NULL UNIQUE,
+            roles TEXT NOT NULL,
+            channels TEXT NOT NULL DEFAULT '',
+            created_at TEXT NOT NULL,
+            revoked_at TEXT
+        )
+    `)
+	if err != nil {
+		t.Fatalf("Failed to create tables: %v", err)
+	}
+	return NewStore(db), db
+}
+
+func TestAuthenticate(t *testing.T) {
+	store, db := setupStore(t)
+	token, key, err := store.Issue("ingester", []Role{RoleIngest}, []string{"chan1"})
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+
+	var stored string
+	db.QueryRow("SELECT hash FROM api_keys WHERE id = ?", key.ID).Scan(&stored)
+	if stored == token || stored != hash(token) {
+		t.Errorf("Expected the hash of the token to be stored, got %q", stored)
+	}
+
+	found, err := store.Authenticate(token)
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if found.ID != key.ID || !found.Has(RoleIngest) || found.Has(RoleRead) {
+		t.Errorf("Unexpected key: %+v", found)
+	}
+	if !found.Allows("chan1") || found.Allows("chan2") {
+		t.Errorf("Expected the key to be scoped to chan1, got %v", found.Channels)
+	}
+	if _, err := store.Authenticate("rk_unknown"); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("Expected ErrUnauthenticated for an unknown token, got %v", err)
+	}
+
+	if err := store.Revoke(key.ID); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if _, err := store.Authenticate(token); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("Expected ErrUnauthenticated for a revoked key, got %v", err)
+	}
+	if err := store.Revoke("ak_unknown"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	keys, err := store.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(keys) != 1 || keys[0].RevokedAt == nil {
+		t.Errorf("Expected the revoked key to be listed, got %+v", keys)
+	}
+}
+
+func TestIssue_InvalidChannels(t *testing.T) {
+	store, _ := setupStore(t)
+	// Channels are stored comma separated, so a comma would split a channel
+	for _, channels := range [][]string{{"chan1,chan2"}, {"chan1", ""}} {
+		if _, _, err := store.Issue("reader", []Role{RoleRead}, channels); !errors.Is(err, ErrInvalidChannel) {
+			t.Errorf("Expected ErrInvalidChannel for %q, got %v", channels, err)
+		}
+	}
+	if keys, _ := store.List(); len(keys) != 0 {
+		t.Errorf("Expected no key to be issued, got %+v", keys)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	roles, err := ParseRoles("read, ingest")
+	if err != nil || len(roles) != 2 || roles[0] != RoleRead || roles[1] != RoleIngest {
+		t.Errorf("Unexpected roles %v, err %v", roles, err)
+	}
+	if _, err := ParseRoles("read,write"); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("Expected ErrInvalidRole, got %v", err)
+	}
+
+	admin := Key{Roles: []Role{RoleAdmin}}
+	for _, role := range []Role{RoleIngest, RoleRead, RoleAdmin} {
+		if !admin.Has(role) {
+			t.Errorf("Expected admin keys to have role %s", role)
+		}
+	}
+	if !admin.Allows("any-channel") {
+		t.Error("Expected unscoped keys to allow every channel")
+	}
+}
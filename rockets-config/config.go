@@ -0,0 +1,459 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings of the service. Each setting is read, from the
+// lowest precedence to the highest, from its default, the config file, an
+// environment variable and a command line flag.
+type Config struct {
+	// Addr is the address the HTTP server listens on
+	Addr string `yaml:"addr"`
+	// DBPath is the SQLite database file; empty keeps the database in memory
+	DBPath string `yaml:"dbPath"`
+	// BusyTimeout is how long a query waits for a locked database
+	BusyTimeout time.Duration `yaml:"busyTimeout"`
+	// ShutdownTimeout is how long a shutdown waits for the work in flight
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	// MaxBodyBytes is the largest request body accepted
+	MaxBodyBytes int64 `yaml:"maxBodyBytes"`
+	// StrictJSON refuses messages with unknown fields or data after them
+	StrictJSON bool      `yaml:"strictJson"`
+	Buffer     Buffer    `yaml:"buffer"`
+	Readiness  Readiness `yaml:"readiness"`
+	RateLimit  RateLimit `yaml:"rateLimit"`
+	// LogLevel is the lowest level logged: debug, info, warn or error
+	LogLevel string `yaml:"logLevel"`
+	// LogFormat is text for key=value lines or json for one object per line
+	LogFormat string  `yaml:"logFormat"`
+	Tracing   Tracing `yaml:"tracing"`
+	Signing   Signing `yaml:"signing"`
+	// AdminToken is the bearer token of the /admin endpoints, which are
+	// disabled when it is empty
+	AdminToken string `yaml:"adminToken"`
+	// RequireAPIKeys makes every endpoint but the health checks and the
+	// metrics require an API key
+	RequireAPIKeys bool     `yaml:"requireApiKeys"`
+	CORS           CORS     `yaml:"cors"`
+	Features       Features `yaml:"features"`
+}
+
+// Buffer limits the messages kept while waiting for an earlier message.
+// Zero means no limit.
+type Buffer struct {
+	MaxPerChannel int `yaml:"maxPerChannel"`
+	MaxTotal      int `yaml:"maxTotal"`
+}
+
+// Readiness sets the buffered messages above which GET /readyz reports the
+// service as not ready, so traffic moves away before the buffers fill up.
+// Zero means no threshold.
+type Readiness struct {
+	MaxPendingPerChannel int `yaml:"maxPendingPerChannel"`
+	MaxPending           int `yaml:"maxPending"`
+}
+
+// RateLimit sets the token buckets of the API. PerChannel is the messages
+// per second each channel may send, PerClient the requests per second each
+// client may make, with bursts of ChannelBurst and ClientBurst. A zero rate
+// means no limit.
+type RateLimit struct {
+	PerChannel   float64 `yaml:"perChannel"`
+	ChannelBurst int     `yaml:"channelBurst"`
+	PerClient    float64 `yaml:"perClient"`
+	ClientBurst  int     `yaml:"clientBurst"`
+}
+
+// Tracing sets where OpenTelemetry spans go: nowhere, stdout or File, as
+// JSON lines. SampleRatio is the fraction of the traces started by the
+// service that are kept; traces of senders follow their sampling decision.
+type Tracing struct {
+	Exporter    string  `yaml:"exporter"`
+	File        string  `yaml:"file"`
+	SampleRatio float64 `yaml:"sampleRatio"`
+}
+
+// Signing sets how message signatures are checked. Messages of a channel
+// with a signing key must always be signed; Required extends that to every
+// channel. MaxSkew is how far the timestamp of a signature may be from the
+// server time.
+type Signing struct {
+	Required bool          `yaml:"required"`
+	MaxSkew  time.Duration `yaml:"maxSkew"`
+}
+
+// CORS lets the browser pages of AllowedOrigins, or of any origin with "*",
+// call the API with AllowedMethods and AllowedHeaders. Browsers cache the
+// answer to a preflight request for MaxAge. Without origins, cross-origin
+// requests are not allowed.
+type CORS struct {
+	AllowedOrigins   []string      `yaml:"allowedOrigins"`
+	AllowedMethods   []string      `yaml:"allowedMethods"`
+	AllowedHeaders   []string      `yaml:"allowedHeaders"`
+	AllowCredentials bool          `yaml:"allowCredentials"`
+	MaxAge           time.Duration `yaml:"maxAge"`
+}
+
+// Features turns optional endpoints on or off.
+type Features struct {
+	GraphQL   bool `yaml:"graphql"`
+	WebSocket bool `yaml:"websocket"`
+	Streams   bool `yaml:"streams"`
+	Metrics   bool `yaml:"metrics"`
+}
+
+// Default returns the settings used when nothing else is configured.
+func Default() Config {
+	return Config{
+		Addr:            ":8088",
+		DBPath:          "./rockets.db",
+		BusyTimeout:     5 * time.Second,
+		ShutdownTimeout: 15 * time.Second,
+		MaxBodyBytes:    1 << 20,
+		Buffer: Buffer{
+			MaxPerChannel: 1000,
+			MaxTotal:      100000,
+		},
+		Readiness: Readiness{
+			MaxPendingPerChannel: 800,
+			MaxPending:           80000,
+		},
+		RateLimit: RateLimit{
+			ChannelBurst: 50,
+			ClientBurst:  100,
+		},
+		LogLevel:  "info",
+		LogFormat: "text",
+		Tracing: Tracing{
+			Exporter:    "none",
+			File:        "./traces.jsonl",
+			SampleRatio: 1,
+		},
+		Signing: Signing{
+			MaxSkew: 5 * time.Minute,
+		},
+		CORS: CORS{
+			AllowedMethods: []string{"GET", "POST", "DELETE"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "X-API-Key", "X-Request-ID"},
+			MaxAge:         10 * time.Minute,
+		},
+		Features: Features{
+			GraphQL:   true,
+			WebSocket: true,
+			Streams:   true,
+			Metrics:   true,
+		},
+	}
+}
+
+// setting is a value that can be set from the environment or a flag.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"addr", "ROCKETS_ADDR", "address the HTTP server listens on", func(c *Config, v string) error {
+		c.Addr = v
+		return nil
+	}},
+	{"db", "ROCKETS_DB_PATH", "SQLite database file, empty for an in-memory database", func(c *Config, v string) error {
+		c.DBPath = v
+		return nil
+	}},
+	{"busy-timeout", "ROCKETS_BUSY_TIMEOUT", "how long a query waits for a locked database, e.g. 5s", func(c *Config, v string) (err error) {
+		c.BusyTimeout, err = time.ParseDuration(v)
+		return err
+	}},
+	{"shutdown-timeout", "ROCKETS_SHUTDOWN_TIMEOUT", "how long a shutdown waits for the work in flight, e.g. 15s", func(c *Config, v string) (err error) {
+		c.ShutdownTimeout, err = time.ParseDuration(v)
+		return err
+	}},
+	{"max-body-bytes", "ROCKETS_MAX_BODY_BYTES", "largest request body accepted, in bytes", func(c *Config, v string) (err error) {
+		c.MaxBodyBytes, err = strconv.ParseInt(v, 10, 64)
+		return err
+	}},
+	{"strict-json", "ROCKETS_STRICT_JSON", "refuse messages with unknown fields or data after them", func(c *Config, v string) (err error) {
+		c.StrictJSON, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"max-pending-per-channel", "ROCKETS_MAX_PENDING_PER_CHANNEL", "out of order messages kept per rocket, 0 for no limit", func(c *Config, v string) (err error) {
+		c.Buffer.MaxPerChannel, err = strconv.Atoi(v)
+		return err
+	}},
+	{"max-pending", "ROCKETS_MAX_PENDING", "out of order messages kept across rockets, 0 for no limit", func(c *Config, v string) (err error) {
+		c.Buffer.MaxTotal, err = strconv.Atoi(v)
+		return err
+	}},
+	{"ready-max-pending-per-channel", "ROCKETS_READY_MAX_PENDING_PER_CHANNEL", "out of order messages of one rocket above which the service is not ready, 0 for no threshold", func(c *Config, v string) (err error) {
+		c.Readiness.MaxPendingPerChannel, err = strconv.Atoi(v)
+		return err
+	}},
+	{"ready-max-pending", "ROCKETS_READY_MAX_PENDING", "out of order messages across rockets above which the service is not ready, 0 for no threshold", func(c *Config, v string) (err error) {
+		c.Readiness.MaxPending, err = strconv.Atoi(v)
+		return err
+	}},
+	{"rate-limit-channel", "ROCKETS_RATE_LIMIT_CHANNEL", "messages per second each channel may send, 0 for no limit", func(c *Config, v string) (err error) {
+		c.RateLimit.PerChannel, err = strconv.ParseFloat(v, 64)
+		return err
+	}},
+	{"rate-limit-channel-burst", "ROCKETS_RATE_LIMIT_CHANNEL_BURST", "messages a channel may send at once above its rate", func(c *Config, v string) (err error) {
+		c.RateLimit.ChannelBurst, err = strconv.Atoi(v)
+		return err
+	}},
+	{"rate-limit-client", "ROCKETS_RATE_LIMIT_CLIENT", "requests per second each API key or address may make, 0 for no limit", func(c *Config, v string) (err error) {
+		c.RateLimit.PerClient, err = strconv.ParseFloat(v, 64)
+		return err
+	}},
+	{"rate-limit-client-burst", "ROCKETS_RATE_LIMIT_CLIENT_BURST", "requests a client may make at once above its rate", func(c *Config, v string) (err error) {
+		c.RateLimit.ClientBurst, err = strconv.Atoi(v)
+		return err
+	}},
+	{"log-level", "ROCKETS_LOG_LEVEL", "lowest level logged: debug, info, warn or error", func(c *Config, v string) error {
+		c.LogLevel = v
+		return nil
+	}},
+	{"log-format", "ROCKETS_LOG_FORMAT", "log output: text or json", func(c *Config, v string) error {
+		c.LogFormat = v
+		return nil
+	}},
+	{"trace-exporter", "ROCKETS_TRACE_EXPORTER", "where spans are written: none, stdout or file", func(c *Config, v string) error {
+		c.Tracing.Exporter = v
+		return nil
+	}},
+	{"trace-file", "ROCKETS_TRACE_FILE", "file spans are appended to with the file exporter", func(c *Config, v string) error {
+		c.Tracing.File = v
+		return nil
+	}},
+	{"trace-sample-ratio", "ROCKETS_TRACE_SAMPLE_RATIO", "fraction of the traces started by the service that are kept, from 0 to 1", func(c *Config, v string) (err error) {
+		c.Tracing.SampleRatio, err = strconv.ParseFloat(v, 64)
+		return err
+	}},
+	{"require-signatures", "ROCKETS_REQUIRE_SIGNATURES", "refuse unsigned messages of every channel, not only those with a key", func(c *Config, v string) (err error) {
+		c.Signing.Required, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"signature-max-skew", "ROCKETS_SIGNATURE_MAX_SKEW", "how far the timestamp of a signature may be from the server time, e.g. 5m", func(c *Config, v string) (err error) {
+		c.Signing.MaxSkew, err = time.ParseDuration(v)
+		return err
+	}},
+	{"admin-token", "ROCKETS_ADMIN_TOKEN", "bearer token of the /admin endpoints, empty to disable them", func(c *Config, v string) error {
+		c.AdminToken = v
+		return nil
+	}},
+	{"require-api-keys", "ROCKETS_REQUIRE_API_KEYS", "require an API key with the role of each endpoint", func(c *Config, v string) (err error) {
+		c.RequireAPIKeys, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"cors-origins", "ROCKETS_CORS_ORIGINS", "comma separated origins allowed to call the API from a browser, * for any", func(c *Config, v string) error {
+		c.CORS.AllowedOrigins = splitList(v)
+		return nil
+	}},
+	{"cors-methods", "ROCKETS_CORS_METHODS", "comma separated methods allowed from other origins", func(c *Config, v string) error {
+		c.CORS.AllowedMethods = splitList(v)
+		return nil
+	}},
+	{"cors-headers", "ROCKETS_CORS_HEADERS", "comma separated request headers allowed from other origins", func(c *Config, v string) error {
+		c.CORS.AllowedHeaders = splitList(v)
+		return nil
+	}},
+	{"cors-credentials", "ROCKETS_CORS_CREDENTIALS", "let other origins send credentials", func(c *Config, v string) (err error) {
+		c.CORS.AllowCredentials, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"cors-max-age", "ROCKETS_CORS_MAX_AGE", "how long browsers cache a preflight answer, e.g. 10m", func(c *Config, v string) (err error) {
+		c.CORS.MaxAge, err = time.ParseDuration(v)
+		return err
+	}},
+	{"graphql", "ROCKETS_GRAPHQL", "serve POST /graphql", func(c *Config, v string) (err error) {
+		c.Features.GraphQL, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"websocket", "ROCKETS_WEBSOCKET", "serve GET /rockets/ws", func(c *Config, v string) (err error) {
+		c.Features.WebSocket, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"streams", "ROCKETS_STREAMS", "serve the Server-Sent Events streams", func(c *Config, v string) (err error) {
+		c.Features.Streams, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"metrics", "ROCKETS_METRICS", "serve GET /metrics", func(c *Config, v string) (err error) {
+		c.Features.Metrics, err = strconv.ParseBool(v)
+		return err
+	}},
+}
+
+// Load reads the configuration from the command line arguments, the
+// environment and the config file named by -config or ROCKETS_CONFIG, then
+// validates it. A flag.ErrHelp error means usage was printed on -h.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet("rocket-service", flag.ContinueOnError)
+	configPath := fs.String("config", getenv("ROCKETS_CONFIG"), "YAML or JSON config file (env ROCKETS_CONFIG)")
+	values := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		values[s.flag] = fs.String(s.flag, "", fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	c := Default()
+	if *configPath != "" {
+		if err := c.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := lookupEnv(getenv, s.env); ok {
+			if err := s.set(&c, v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", s.env, err)
+			}
+		}
+	}
+
+	// Only flags given on the command line override the other sources
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if setErr := s.set(&c, *values[s.flag]); setErr != nil {
+					err = fmt.Errorf("invalid -%s: %w", s.flag, setErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// lookupEnv treats empty variables as unset, as getenv cannot tell them apart.
+func lookupEnv(getenv func(string) string, name string) (string, bool) {
+	v := getenv(name)
+	return v, v != ""
+}
+
+// loadFile overrides c with the settings of a YAML file. JSON is valid YAML,
+// so JSON files are read too. Unknown settings are rejected to catch typos.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+var logLevels = map[string]bool{"debug": true, "info": true, "warn": true, "error": true}
+
+// Validate checks the settings together, once every source has been read.
+func (c *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return fmt.Errorf("invalid addr %q: %w", c.Addr, err)
+	}
+	if c.BusyTimeout < 0 {
+		return fmt.Errorf("busy timeout must not be negative, got %s", c.BusyTimeout)
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown timeout must be positive, got %s", c.ShutdownTimeout)
+	}
+	if c.MaxBodyBytes <= 0 {
+		return fmt.Errorf("max body bytes must be positive, got %d", c.MaxBodyBytes)
+	}
+	if c.Buffer.MaxPerChannel < 0 || c.Buffer.MaxTotal < 0 {
+		return fmt.Errorf("buffer limits must not be negative, got %d per channel and %d in total",
+			c.Buffer.MaxPerChannel, c.Buffer.MaxTotal)
+	}
+	if c.Buffer.MaxTotal > 0 && c.Buffer.MaxPerChannel > c.Buffer.MaxTotal {
+		return fmt.Errorf("buffer limit per channel (%d) must not exceed the total limit (%d)",
+			c.Buffer.MaxPerChannel, c.Buffer.MaxTotal)
+	}
+	if c.Readiness.MaxPendingPerChannel < 0 || c.Readiness.MaxPending < 0 {
+		return fmt.Errorf("readiness thresholds must not be negative, got %d per channel and %d in total",
+			c.Readiness.MaxPendingPerChannel, c.Readiness.MaxPending)
+	}
+	if c.RateLimit.PerChannel < 0 || c.RateLimit.PerClient < 0 {
+		return fmt.Errorf("rate limits must not be negative, got %g per channel and %g per client",
+			c.RateLimit.PerChannel, c.RateLimit.PerClient)
+	}
+	if c.RateLimit.ChannelBurst < 1 || c.RateLimit.ClientBurst < 1 {
+		return fmt.Errorf("rate limit bursts must be at least 1, got %d per channel and %d per client",
+			c.RateLimit.ChannelBurst, c.RateLimit.ClientBurst)
+	}
+	if !logLevels[c.LogLevel] {
+		return fmt.Errorf("invalid log level %q: must be debug, info, warn or error", c.LogLevel)
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("invalid log format %q: must be text or json", c.LogFormat)
+	}
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "file":
+		if c.Tracing.File == "" {
+			return fmt.Errorf("the file trace exporter needs a trace file")
+		}
+	default:
+		return fmt.Errorf("invalid trace exporter %q: must be none, stdout or file", c.Tracing.Exporter)
+	}
+	if c.Signing.MaxSkew <= 0 {
+		return fmt.Errorf("signature max skew must be positive, got %s", c.Signing.MaxSkew)
+	}
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" {
+			if c.CORS.AllowCredentials {
+				return fmt.Errorf("CORS credentials cannot be allowed for any origin")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return fmt.Errorf("invalid CORS origin %q: must be a scheme and host such as https://dashboard.example.com", origin)
+		}
+	}
+	if c.CORS.MaxAge < 0 {
+		return fmt.Errorf("CORS max age must not be negative, got %s", c.CORS.MaxAge)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("trace sample ratio must be between 0 and 1, got %g", c.Tracing.SampleRatio)
+	}
+	return nil
+}
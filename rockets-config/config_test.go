@@ -0,0 +1,137 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func env(values map[string]string) func(string) string {
+	return func(name string) string { return values[name] }
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	c, err := Load(nil, env(nil))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if !reflect.DeepEqual(*c, Default()) {
+		t.Errorf("Expected defaults %+v, got %+v", Default(), *c)
+	}
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+addr: ":9000"
+dbPath: /var/lib/rockets.db
+busyTimeout: 2s
+buffer:
+  maxPerChannel: 10
+logLevel: warn
+features:
+  graphql: false
+`)
+
+	c, err := Load([]string{"-config", path, "-log-level", "debug", "-metrics=false"}, env(map[string]string{
+		"ROCKETS_DB_PATH":      "/tmp/rockets.db",
+		"ROCKETS_LOG_LEVEL":    "error",
+		"ROCKETS_CORS_ORIGINS": "https://dashboard.example.com, http://localhost:3000,",
+	}))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	expected := Default()
+	expected.Addr = ":9000"                // file
+	expected.DBPath = "/tmp/rockets.db"    // env over file
+	expected.BusyTimeout = 2 * time.Second // file
+	expected.Buffer.MaxPerChannel = 10     // file
+	expected.LogLevel = "debug"            // flag over env and file
+	expected.Features.GraphQL = false      // file
+	expected.Features.Metrics = false      // flag
+
+	expected.CORS.AllowedOrigins = []string{"https://dashboard.example.com", "http://localhost:3000"} // env
+
+	if !reflect.DeepEqual(*c, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, *c)
+	}
+}
+
+func TestLoad_JSONFileFromEnv(t *testing.T) {
+	path := writeFile(t, "config.json", `{"addr": "127.0.0.1:8080", "buffer": {"maxPerChannel": 5, "maxTotal": 50}}`)
+
+	c, err := Load(nil, env(map[string]string{"ROCKETS_CONFIG": path}))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if c.Addr != "127.0.0.1:8080" || c.Buffer.MaxPerChannel != 5 || c.Buffer.MaxTotal != 50 {
+		t.Errorf("Unexpected config: %+v", *c)
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	unknown := writeFile(t, "unknown.yaml", "adress: :9000\n")
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		expected string
+	}{
+		{"unknown file setting", []string{"-config", unknown}, nil, "field adress not found"},
+		{"missing file", []string{"-config", "/does/not/exist.yaml"}, nil, "reading config file"},
+		{"invalid env duration", nil, map[string]string{"ROCKETS_BUSY_TIMEOUT": "soon"}, "invalid ROCKETS_BUSY_TIMEOUT"},
+		{"invalid flag number", []string{"-max-pending", "many"}, nil, "invalid -max-pending"},
+		{"invalid addr", []string{"-addr", "8088"}, nil, "invalid addr"},
+		{"negative timeout", []string{"-busy-timeout", "-1s"}, nil, "busy timeout must not be negative"},
+		{"zero shutdown timeout", nil, map[string]string{"ROCKETS_SHUTDOWN_TIMEOUT": "0s"}, "shutdown timeout must be positive"},
+		{"body size", []string{"-max-body-bytes", "0"}, nil, "max body bytes must be positive"},
+		{"limits", []string{"-max-pending", "10", "-max-pending-per-channel", "20"}, nil, "must not exceed the total limit"},
+		{"readiness", []string{"-ready-max-pending", "-1"}, nil, "readiness thresholds must not be negative"},
+		{"rate limit", []string{"-rate-limit-client", "-5"}, nil, "rate limits must not be negative"},
+		{"rate limit burst", nil, map[string]string{"ROCKETS_RATE_LIMIT_CHANNEL_BURST": "0"}, "bursts must be at least 1"},
+		{"log level", nil, map[string]string{"ROCKETS_LOG_LEVEL": "verbose"}, `invalid log level "verbose"`},
+		{"log format", []string{"-log-format", "xml"}, nil, `invalid log format "xml"`},
+		{"trace exporter", []string{"-trace-exporter", "jaeger"}, nil, `invalid trace exporter "jaeger"`},
+		{"trace file", []string{"-trace-exporter", "file", "-trace-file", ""}, nil, "needs a trace file"},
+		{"sample ratio", nil, map[string]string{"ROCKETS_TRACE_SAMPLE_RATIO": "1.5"}, "between 0 and 1"},
+		{"signature skew", []string{"-signature-max-skew", "0s"}, nil, "signature max skew must be positive"},
+		{"CORS origin", []string{"-cors-origins", "dashboard.example.com"}, nil, `invalid CORS origin "dashboard.example.com"`},
+		{"CORS credentials", []string{"-cors-origins", "*", "-cors-credentials", "true"}, nil, "cannot be allowed for any origin"},
+		{"arguments", []string{"serve"}, nil, "unexpected arguments: serve"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.args, env(tt.env))
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Expected error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestLoad_Help(t *testing.T) {
+	// Keep the usage out of the test output
+	devNull, _ := os.Open(os.DevNull)
+	defer devNull.Close()
+	stderr := os.Stderr
+	os.Stderr = devNull
+	defer func() { os.Stderr = stderr }()
+
+	if _, err := Load([]string{"-h"}, env(nil)); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("Expected flag.ErrHelp, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package inventory
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// Change is a message applied to a rocket and the state it left the rocket
+// in. Seq is the id of the recorded message and grows with every change
+// across the fleet, so it can be used to resume a feed. AppliedAt is the
+// server time the message was applied, in storage.TimestampFormat.
+type Change struct {
+	Seq           int64
+	Channel       string
+	MessageNumber int
+	MessageTime   string
+	MessageType   string
+	AppliedAt     string
+	Type          *string
+	Speed         *int
+	Mission       *string
+	Status        *string
+}
+
+// changeBufferSize is how many changes a subscriber can fall behind before
+// it is dropped.
+const changeBufferSize = 256
+
+// changeFeed fans committed changes out to subscribers.
+type changeFeed struct {
+	mu          sync.Mutex
+	subscribers map[chan Change]struct{}
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{subscribers: make(map[chan Change]struct{})}
+}
+
+// Subscribe returns a channel receiving every change committed from now on,
+// in Seq order, and a function to stop the subscription. A subscriber that
+// falls too far behind has its channel closed and should resume from the
+// stored changes after the last Seq it saw.
+func (i *Inventory) Subscribe() (<-chan Change, func()) {
+	f := i.changes
+	ch := make(chan Change, changeBufferSize)
+
+	f.mu.Lock()
+	f.subscribers[ch] = struct{}{}
+	f.mu.Unlock()
+
+	return ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.subscribers[ch]; ok {
+			delete(f.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// commit commits tx and publishes its changes. SQLite serializes write
+// transactions, so holding the feed lock across the commit publishes changes
+// from all channels in Seq order.
+func (f *changeFeed) commit(tx *sql.Tx, changes []Change) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		for ch := range f.subscribers {
+			select {
+			case ch <- change:
+			default:
+				delete(f.subscribers, ch)
+				close(ch)
+			}
+		}
+	}
+	return nil
+}
+
+func appendChange(changes []Change, change *Change) []Change {
+	if change == nil {
+		return changes
+	}
+	return append(changes, *change)
+}
@@ -0,0 +1,151 @@
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// FieldError is an invalid message with the path of the offending field,
+// such as message.launchSpeed. Field is empty when the message is not JSON.
+type FieldError struct {
+	Field  string
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%v: %s", ErrInvalidMessage, e.Reason)
+	}
+	return fmt.Sprintf("%v: %s: %s", ErrInvalidMessage, e.Field, e.Reason)
+}
+
+func (e *FieldError) Unwrap() error {
+	return ErrInvalidMessage
+}
+
+// DecodeMessage decodes a message as sent and checks its payload against its
+// type. A strict decoding also refuses unknown fields, in the envelope and in
+// the payload, missing channels, types and payloads, and data after the
+// message. Errors are FieldErrors, but for unknown message types, which are
+// ErrInvalidMessageType.
+func DecodeMessage(body []byte, strict bool) (RocketMessage, error) {
+	var msg RocketMessage
+	if !strict {
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return msg, fieldError("", err)
+		}
+		return msg, checkMessage(msg)
+	}
+
+	// The metadata is decoded on its own, so its unknown fields are named
+	// under it
+	var envelope struct {
+		Metadata json.RawMessage `json:"metadata"`
+		Message  json.RawMessage `json:"message"`
+	}
+	if err := decodeStrict(body, &envelope); err != nil {
+		return msg, fieldError("", err)
+	}
+	if len(envelope.Metadata) == 0 || string(envelope.Metadata) == "null" {
+		return msg, &FieldError{Field: "metadata", Reason: "is required"}
+	}
+	if err := decodeStrict(envelope.Metadata, &msg.Metadata); err != nil {
+		return msg, fieldError("metadata", err)
+	}
+	msg.Message = envelope.Message
+
+	switch {
+	case msg.Metadata.Channel == "":
+		return msg, &FieldError{Field: "metadata.channel", Reason: "is required"}
+	case msg.Metadata.MessageType == "":
+		return msg, &FieldError{Field: "metadata.messageType", Reason: "is required"}
+	case len(msg.Message) == 0 || string(msg.Message) == "null":
+		return msg, &FieldError{Field: "message", Reason: "is required"}
+	}
+	handler, ok := MessageHandlers[msg.Metadata.MessageType]
+	if !ok {
+		return msg, fmt.Errorf("%w: %s", ErrInvalidMessageType, msg.Metadata.MessageType)
+	}
+	if err := decodeStrict(msg.Message, handler.NewPayload()); err != nil {
+		return msg, fieldError("message", err)
+	}
+	return msg, nil
+}
+
+// checkMessage refuses the messages no handler could apply: those of an
+// unknown type, or whose payload does not decode into the payload of their
+// type. Out of order messages are checked before they are buffered, since
+// one that fails once applied would block the messages after it.
+func checkMessage(msg RocketMessage) error {
+	handler, ok := MessageHandlers[msg.Metadata.MessageType]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrInvalidMessageType, msg.Metadata.MessageType)
+	}
+	if err := json.Unmarshal(msg.Message, handler.NewPayload()); err != nil {
+		return fieldError("message", err)
+	}
+	return nil
+}
+
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after the top-level value")
+	}
+	return nil
+}
+
+// fieldError names the field of a decoding error, under prefix when the
+// error is in a nested document.
+func fieldError(prefix string, err error) *FieldError {
+	join := func(field string) string {
+		if prefix == "" {
+			return field
+		}
+		return prefix + "." + field
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return &FieldError{Field: join(typeErr.Field), Reason: fmt.Sprintf("cannot be a JSON %s, expected %s", typeErr.Value, jsonKind(typeErr.Type))}
+	case errors.As(err, &typeErr):
+		return &FieldError{Field: prefix, Reason: fmt.Sprintf("must be a JSON object, not %s", typeErr.Value)}
+	case errors.As(err, &syntaxErr):
+		return &FieldError{Field: prefix, Reason: fmt.Sprintf("%v at byte %d", syntaxErr, syntaxErr.Offset)}
+	}
+	// DisallowUnknownFields has no error type of its own
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &FieldError{Field: join(strings.Trim(name, `"`)), Reason: "is not a known field"}
+	}
+	return &FieldError{Field: prefix, Reason: strings.TrimPrefix(err.Error(), "json: ")}
+}
+
+// jsonKind names the JSON value a Go type is decoded from.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	default:
+		return "string"
+	}
+}
@@ -0,0 +1,20 @@
+package inventory
+
+import "errors"
+
+var (
+	// ErrShuttingDown is returned for messages sent once the inventory has
+	// started draining. The message can be sent again to the next instance.
+	ErrShuttingDown = errors.New("service is shutting down")
+
+	// ErrInvalidMessageType is returned for messages no handler supports.
+	ErrInvalidMessageType = errors.New("invalid message type")
+
+	// ErrBufferFull is returned when an out of order message would exceed the
+	// buffer limits. The message can be sent again later.
+	ErrBufferFull = errors.New("out of order message buffer is full")
+
+	// ErrInvalidMessage is returned when the payload of a message cannot be
+	// decoded for its type.
+	ErrInvalidMessage = errors.New("invalid message")
+)
@@ -1,10 +1,26 @@
 package inventory
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"sort"
 	"sync"
+	"time"
+
+	logging "rocket-service/rockets-logging"
+	metrics "rocket-service/rockets-metrics"
+	storage "rocket-service/rockets-storage"
+	tracing "rocket-service/rockets-tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Inventory manages rocket state updates
@@ -13,6 +29,14 @@ type Inventory struct {
 	locks          map[string]*sync.Mutex
 	global         sync.Mutex
 	messageBuffers map[string][]RocketMessage
+	// buffered counts the messages across buffers, checked against the limits
+	buffered         int
+	maxPerChannel    int
+	maxBufferedTotal int
+	// draining is set once Drain starts; inflight counts the updates begun before
+	draining bool
+	inflight sync.WaitGroup
+	changes  *changeFeed
 }
 
 func NewInventory(db *sql.DB) *Inventory {
@@ -20,9 +44,20 @@ func NewInventory(db *sql.DB) *Inventory {
 		db:             db,
 		locks:          make(map[string]*sync.Mutex),
 		messageBuffers: make(map[string][]RocketMessage),
+		changes:        newChangeFeed(),
 	}
 }
 
+// SetBufferLimits caps the out of order messages kept per channel and across
+// channels. Messages over a limit are rejected with ErrBufferFull until
+// buffered messages are applied. Zero means no limit.
+func (i *Inventory) SetBufferLimits(perChannel, total int) {
+	i.global.Lock()
+	defer i.global.Unlock()
+	i.maxPerChannel = perChannel
+	i.maxBufferedTotal = total
+}
+
 func (i *Inventory) getLock(channel string) *sync.Mutex {
 	i.global.Lock()
 	defer i.global.Unlock()
@@ -36,13 +71,51 @@ func (i *Inventory) getLock(channel string) *sync.Mutex {
 }
 
 func (i *Inventory) UpdateRocketState(msg RocketMessage) error {
+	return i.UpdateRocketStateContext(context.Background(), msg)
+}
+
+// UpdateRocketStateContext is UpdateRocketState logging with the attributes
+// of ctx, such as the ID of the request that carried the message, and tracing
+// in the span of ctx.
+func (i *Inventory) UpdateRocketStateContext(ctx context.Context, msg RocketMessage) (err error) {
 	metadata := msg.Metadata
 	channel := metadata.Channel
+	ctx = logging.With(ctx, slog.String("channel", channel), slog.Int("messageNumber", metadata.MessageNumber))
+	ctx, span := tracer().Start(ctx, "UpdateRocketState", trace.WithAttributes(
+		attribute.String("rocket.channel", channel),
+		attribute.Int("rocket.message_number", metadata.MessageNumber),
+		attribute.String("rocket.message_type", metadata.MessageType)))
+
+	outcome := metrics.Applied
+	defer func() {
+		if err != nil {
+			outcome = metrics.Rejected
+			slog.DebugContext(ctx, "Message ingested", "messageType", metadata.MessageType, "outcome", outcome, "error", err)
+		} else {
+			slog.DebugContext(ctx, "Message ingested", "messageType", metadata.MessageType, "outcome", outcome)
+		}
+		metrics.ObserveMessage(messageTypeLabel(metadata.MessageType), outcome)
+		span.SetAttributes(attribute.String("rocket.outcome", outcome))
+		tracing.End(span, err)
+	}()
+
+	if err := checkMessage(msg); err != nil {
+		return err
+	}
+	if !i.begin() {
+		return ErrShuttingDown
+	}
+	defer i.inflight.Done()
 
 	lock := i.getLock(channel)
+	_, wait := tracer().Start(ctx, "wait for channel lock")
 	lock.Lock()
+	wait.End()
 	defer lock.Unlock()
 
+	start := time.Now()
+	defer metrics.ObserveTransaction(start)
+
 	tx, err := i.db.Begin()
 	if err != nil {
 		return err
@@ -50,13 +123,19 @@ func (i *Inventory) UpdateRocketState(msg RocketMessage) error {
 	defer tx.Rollback()
 
 	var lastMessageNumber int
+	_, query := startSQL(ctx, "SELECT rockets")
 	err = tx.QueryRow("SELECT last_message_number FROM rockets WHERE channel = ?", channel).Scan(&lastMessageNumber)
-	if err != nil && err != sql.ErrNoRows {
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	tracing.End(query, err)
+	if err != nil {
 		return err
 	}
 
 	// Ignore duplicates or already processed messages
 	if metadata.MessageNumber <= lastMessageNumber {
+		outcome = metrics.Duplicate
 		return tx.Commit()
 	}
 
@@ -71,7 +150,14 @@ func (i *Inventory) UpdateRocketState(msg RocketMessage) error {
 				break
 			}
 		}
+		outcome = metrics.Duplicate
 		if !alreadyBuffered {
+			if i.bufferFull(channel) {
+				i.global.Unlock()
+				return ErrBufferFull
+			}
+			outcome = metrics.Buffered
+			i.buffered++
 			i.messageBuffers[channel] = append(i.messageBuffers[channel], msg)
 			// Sort buffer by messageNumber
 			sort.Slice(i.messageBuffers[channel], func(a, b int) bool {
@@ -82,7 +168,7 @@ func (i *Inventory) UpdateRocketState(msg RocketMessage) error {
 		return tx.Commit()
 	}
 
-	err = i.processMessage(tx, msg)
+	change, err := i.processMessage(ctx, tx, msg)
 	if err != nil {
 		return err
 	}
@@ -91,7 +177,36 @@ func (i *Inventory) UpdateRocketState(msg RocketMessage) error {
 	if err != nil {
 		return err
 	}
-	lastMessageNumber = metadata.MessageNumber
+
+	changes, drained, err := i.applyBuffered(ctx, tx, channel, metadata.MessageNumber, appendChange(nil, change))
+	if err != nil {
+		return err
+	}
+
+	_, commit := startSQL(ctx, "COMMIT")
+	err = i.changes.commit(tx, changes)
+	tracing.End(commit, err)
+	if err != nil {
+		return err
+	}
+	for _, messageType := range drained {
+		metrics.ObserveMessage(messageTypeLabel(messageType), metrics.Applied)
+	}
+	return nil
+}
+
+// applyBuffered applies the buffered messages of channel that follow
+// lastMessageNumber, up to the next gap. It returns changes with theirs
+// appended, and their types.
+func (i *Inventory) applyBuffered(ctx context.Context, tx *sql.Tx, channel string, lastMessageNumber int, changes []Change) (_ []Change, drained []string, err error) {
+	if i.PendingMessages(channel) == 0 {
+		return changes, nil, nil
+	}
+	ctx, span := tracer().Start(ctx, "drain buffer")
+	defer func() {
+		span.SetAttributes(attribute.Int("rocket.drained", len(drained)))
+		tracing.End(span, err)
+	}()
 
 	for {
 		i.global.Lock()
@@ -108,19 +223,241 @@ func (i *Inventory) UpdateRocketState(msg RocketMessage) error {
 			continue
 		}
 
-		err = i.processMessage(tx, *nextMsg)
+		change, err := i.processMessage(ctx, tx, *nextMsg)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
+		changes = appendChange(changes, change)
+		drained = append(drained, nextMsg.Metadata.MessageType)
+		slog.DebugContext(ctx, "Buffered message applied", "bufferedMessageNumber", nextMsg.Metadata.MessageNumber)
 
 		lastMessageNumber = nextMsg.Metadata.MessageNumber
 		_, err = tx.Exec("UPDATE rockets SET last_message_number = ? WHERE channel = ?", lastMessageNumber, channel)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return changes, drained, nil
+}
+
+// begin counts an update as in flight, unless the inventory is draining.
+func (i *Inventory) begin() bool {
+	i.global.Lock()
+	defer i.global.Unlock()
+	if i.draining {
+		return false
+	}
+	i.inflight.Add(1)
+	return true
+}
+
+// Draining reports whether Drain has started, after which messages are refused.
+func (i *Inventory) Draining() bool {
+	i.global.Lock()
+	defer i.global.Unlock()
+	return i.draining
+}
+
+// Drain stops accepting messages, waits for the updates in flight and saves
+// the buffered messages to the database, where RestorePending finds them on
+// the next start. When ctx is done before the updates finish, the buffers are
+// saved as they are and the error of ctx is returned with any other.
+func (i *Inventory) Drain(ctx context.Context) error {
+	i.global.Lock()
+	i.draining = true
+	i.global.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		i.inflight.Wait()
+		close(finished)
+	}()
+	var waitErr error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		waitErr = ctx.Err()
+		slog.WarnContext(ctx, "Saving buffered messages before the updates in flight finished", "error", waitErr)
+	}
+
+	return errors.Join(waitErr, i.savePending(ctx))
+}
+
+// savePending writes every buffered message to the pending_messages table.
+func (i *Inventory) savePending(ctx context.Context) error {
+	i.global.Lock()
+	var pending []RocketMessage
+	for _, buffer := range i.messageBuffers {
+		pending = append(pending, buffer...)
+	}
+	i.global.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// The deadline may have passed already; saving is still worth a try
+	tx, err := i.db.BeginTx(context.WithoutCancel(ctx), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, msg := range pending {
+		metadata := msg.Metadata
+		_, err := tx.Exec(`
+            INSERT OR REPLACE INTO pending_messages (channel, message_number, message_time, message_type, payload)
+            VALUES (?, ?, ?, ?, ?)`,
+			metadata.Channel, metadata.MessageNumber, metadata.MessageTime, metadata.MessageType, string(msg.Message))
 		if err != nil {
 			return err
 		}
 	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Saved buffered messages", "count", len(pending))
+	return nil
+}
 
-	return tx.Commit()
+// RestorePending loads the messages saved by Drain back into the buffers and
+// removes them from the database, along with those applied since they were
+// saved. Messages over the buffer limits, past the lowest message numbers of
+// each channel, stay in the database for a later start with higher limits.
+// It returns the number of messages restored.
+func (i *Inventory) RestorePending() (int, error) {
+	tx, err := i.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+        SELECT p.channel, p.message_number, COALESCE(p.message_time, ''), p.message_type, p.payload
+        FROM pending_messages p LEFT JOIN rockets r ON r.channel = p.channel
+        WHERE p.message_number > COALESCE(r.last_message_number, 0)
+        ORDER BY p.channel, p.message_number`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var saved []RocketMessage
+	for rows.Next() {
+		var msg RocketMessage
+		var payload string
+		metadata := &msg.Metadata
+		if err := rows.Scan(&metadata.Channel, &metadata.MessageNumber, &metadata.MessageTime, &metadata.MessageType, &payload); err != nil {
+			return 0, err
+		}
+		msg.Message = json.RawMessage(payload)
+		saved = append(saved, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Messages already buffered are removed too
+	var restored []Metadata
+	count, kept := 0, 0
+	i.global.Lock()
+	for _, msg := range saved {
+		channel := msg.Metadata.Channel
+		if i.getNextMessage(channel, msg.Metadata.MessageNumber) != nil {
+			restored = append(restored, msg.Metadata)
+			continue
+		}
+		if i.bufferFull(channel) {
+			kept++
+			continue
+		}
+		i.messageBuffers[channel] = append(i.messageBuffers[channel], msg)
+		i.buffered++
+		restored = append(restored, msg.Metadata)
+		count++
+	}
+	// Rows come in message number order, but messages may have been buffered
+	// since the inventory was created
+	for channel, buffer := range i.messageBuffers {
+		sort.Slice(buffer, func(a, b int) bool {
+			return buffer[a].Metadata.MessageNumber < buffer[b].Metadata.MessageNumber
+		})
+		i.messageBuffers[channel] = buffer
+	}
+	i.global.Unlock()
+
+	_, err = tx.Exec(`
+        DELETE FROM pending_messages WHERE message_number <= (
+            SELECT last_message_number FROM rockets r WHERE r.channel = pending_messages.channel)`)
+	if err != nil {
+		return 0, err
+	}
+	for _, metadata := range restored {
+		_, err := tx.Exec("DELETE FROM pending_messages WHERE channel = ? AND message_number = ?",
+			metadata.Channel, metadata.MessageNumber)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if count > 0 {
+		slog.Info("Restored buffered messages", "count", count)
+	}
+	if kept > 0 {
+		slog.Warn("Kept buffered messages over the buffer limits in the database", "count", kept,
+			"max_per_channel", i.maxPerChannel, "max_total", i.maxBufferedTotal)
+	}
+	return count, nil
+}
+
+// bufferFull reports whether buffering another message for channel would
+// exceed a limit. The caller holds the global lock.
+func (i *Inventory) bufferFull(channel string) bool {
+	return i.maxPerChannel > 0 && len(i.messageBuffers[channel]) >= i.maxPerChannel ||
+		i.maxBufferedTotal > 0 && i.buffered >= i.maxBufferedTotal
+}
+
+// tracer returns the tracer of the inventory from the global provider, which
+// is only set up once the service has started.
+func tracer() trace.Tracer {
+	return otel.Tracer("rocket-service/rockets-inventory")
+}
+
+// startSQL starts a span for statements run against the database.
+func startSQL(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(append(attrs, semconv.DBSystemSqlite)...))
+}
+
+// messageTypeLabel returns the metrics label of a message type.
+func messageTypeLabel(messageType string) string {
+	if _, exists := MessageHandlers[messageType]; !exists {
+		return metrics.UnknownType
+	}
+	return messageType
+}
+
+// PendingMessages returns the number of out of order messages buffered for
+// channel until the gap before them is filled.
+func (i *Inventory) PendingMessages(channel string) int {
+	i.global.Lock()
+	defer i.global.Unlock()
+	return len(i.messageBuffers[channel])
+}
+
+// BufferDepths returns the number of out of order messages buffered for each
+// channel that has any.
+func (i *Inventory) BufferDepths() map[string]int {
+	i.global.Lock()
+	defer i.global.Unlock()
+
+	depths := make(map[string]int)
+	for channel, buffer := range i.messageBuffers {
+		if len(buffer) > 0 {
+			depths[channel] = len(buffer)
+		}
+	}
+	return depths
 }
 
 func (i *Inventory) getNextMessage(channel string, messageNumber int) *RocketMessage {
@@ -139,20 +476,91 @@ func (i *Inventory) removeMessage(channel string, messageNumber int) {
 			updated = append(updated, msg)
 		}
 	}
+	i.buffered -= len(i.messageBuffers[channel]) - len(updated)
 	i.messageBuffers[channel] = updated
 }
 
-func (i *Inventory) processMessage(tx *sql.Tx, msg RocketMessage) error {
+// processMessage applies a message and records it. It returns the resulting
+// change, or nil when the message had already been recorded.
+func (i *Inventory) processMessage(ctx context.Context, tx *sql.Tx, msg RocketMessage) (_ *Change, err error) {
+	metadata := msg.Metadata
+	appliedAt := time.Now().UTC().Format(storage.TimestampFormat)
+
+	start := time.Now()
+	_, apply := startSQL(ctx, "apply "+messageTypeLabel(metadata.MessageType),
+		attribute.Int("rocket.message_number", metadata.MessageNumber))
+	err = ApplyMessage(tx, msg, appliedAt)
+	tracing.End(apply, err)
+	if err != nil {
+		return nil, err
+	}
+	metrics.ObserveHandler(metadata.MessageType, start)
+
+	change := Change{
+		Channel:       metadata.Channel,
+		MessageNumber: metadata.MessageNumber,
+		MessageTime:   metadata.MessageTime,
+		MessageType:   metadata.MessageType,
+		AppliedAt:     appliedAt,
+	}
+	err = tx.QueryRow("SELECT type, speed, mission, status FROM rockets WHERE channel = ?", metadata.Channel).
+		Scan(&change.Type, &change.Speed, &change.Mission, &change.Status)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// Handlers have decoded the payload, so it is valid JSON
+	var payload bytes.Buffer
+	if err := json.Compact(&payload, msg.Message); err != nil {
+		return nil, err
+	}
+
+	// Keep the applied message and the state it led to, so past states can be
+	// rebuilt by replaying it. A message applied before its rocket was launched
+	// leaves no state behind and may be applied again when resent.
+	_, record := startSQL(ctx, "INSERT rocket_events")
+	defer func() { tracing.End(record, err) }()
+	result, err := tx.Exec(`
+        INSERT OR IGNORE INTO rocket_events
+            (channel, message_number, message_time, message_type, payload, type, speed, mission, status, applied_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		metadata.Channel, metadata.MessageNumber, metadata.MessageTime, metadata.MessageType, payload.String(),
+		change.Type, change.Speed, change.Mission, change.Status, appliedAt)
+	if err != nil {
+		return nil, err
+	}
+	if recorded, err := result.RowsAffected(); err != nil || recorded == 0 {
+		return nil, err
+	}
+	if change.Seq, err = result.LastInsertId(); err != nil {
+		return nil, err
+	}
+
+	return &change, nil
+}
+
+// ApplyMessage applies a message to the state of its rocket with the matching
+// handler, then records when the rocket was last updated: the sending time
+// of the message and appliedAt, the server time in storage.TimestampFormat.
+func ApplyMessage(tx *sql.Tx, msg RocketMessage, appliedAt string) error {
 	metadata := msg.Metadata
 
 	handler, exists := MessageHandlers[metadata.MessageType]
 	if !exists {
-		return fmt.Errorf("invalid message type: %s", metadata.MessageType)
+		return fmt.Errorf("%w: %s", ErrInvalidMessageType, metadata.MessageType)
 	}
-
 	if err := handler.Process(tx, metadata.Channel, metadata.MessageNumber, msg.Message); err != nil {
 		return err
 	}
 
-	return nil
+	var launchedAt *string
+	if metadata.MessageType == "RocketLaunched" {
+		launchedAt = &metadata.MessageTime
+	}
+	_, err := tx.Exec(`
+        UPDATE rockets
+        SET last_message_time = ?, updated_at = ?, launched_at = COALESCE(?, launched_at)
+        WHERE channel = ?`,
+		metadata.MessageTime, appliedAt, launchedAt, metadata.Channel)
+	return err
 }
@@ -1,8 +1,11 @@
 package inventory
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"reflect"
 	"sync"
 	"testing"
 
@@ -21,11 +24,36 @@ func setupDB(t *testing.T) *sql.DB {
             speed INTEGER,
             mission TEXT,
             status TEXT,
-            last_message_number INTEGER DEFAULT 0
+            last_message_number INTEGER DEFAULT 0,
+            last_message_time TEXT,
+            launched_at TEXT,
+            updated_at TEXT
+        );
+        CREATE TABLE rocket_events (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            channel TEXT NOT NULL,
+            message_number INTEGER NOT NULL,
+            message_time TEXT,
+            message_type TEXT NOT NULL,
+            payload TEXT NOT NULL,
+            type TEXT,
+            speed INTEGER,
+            mission TEXT,
+            status TEXT,
+            applied_at TEXT,
+            UNIQUE(channel, message_number)
+        );
+        CREATE TABLE pending_messages (
+            channel TEXT NOT NULL,
+            message_number INTEGER NOT NULL,
+            message_time TEXT,
+            message_type TEXT NOT NULL,
+            payload TEXT NOT NULL,
+            PRIMARY KEY (channel, message_number)
         )
     `)
 	if err != nil {
-		t.Fatalf("Failed to create table: %v", err)
+		t.Fatalf("Failed to create tables: %v", err)
 	}
 	return db
 }
@@ -344,6 +372,116 @@ func TestUpdateRocketState_OutOfOrderWithGaps(t *testing.T) {
 	}
 }
 
+func TestUpdateRocketState_RecordsEvents(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	inventory := NewInventory(db)
+	channel := "test-channel"
+
+	// Message 2 is buffered until message 1 arrives
+	messages := []RocketMessage{
+		{
+			Metadata: Metadata{
+				Channel:       channel,
+				MessageNumber: 2,
+				MessageTime:   "2022-02-02T19:39:06.86337+01:00",
+				MessageType:   "RocketSpeedIncreased",
+			},
+			Message: json.RawMessage(`{"by":300}`),
+		},
+		{
+			Metadata: Metadata{
+				Channel:       channel,
+				MessageNumber: 1,
+				MessageTime:   "2022-02-02T19:39:05.86337+01:00",
+				MessageType:   "RocketLaunched",
+			},
+			Message: json.RawMessage(`{"type":"Falcon-9","launchSpeed":500,"mission":"ARTEMIS"}`),
+		},
+	}
+	for _, msg := range messages {
+		if err := inventory.UpdateRocketState(msg); err != nil {
+			t.Fatalf("Failed to process message %d: %v", msg.Metadata.MessageNumber, err)
+		}
+	}
+
+	rows, err := db.Query("SELECT message_number, message_time, message_type, payload FROM rocket_events WHERE channel = ? ORDER BY id", channel)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var got []RocketMessage
+	for rows.Next() {
+		var msg RocketMessage
+		var payload string
+		if err := rows.Scan(&msg.Metadata.MessageNumber, &msg.Metadata.MessageTime, &msg.Metadata.MessageType, &payload); err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		msg.Metadata.Channel = channel
+		msg.Message = json.RawMessage(payload)
+		got = append(got, msg)
+	}
+
+	expected := []RocketMessage{messages[1], messages[0]}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected events %+v, got %+v", expected, got)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	inventory := NewInventory(db)
+	changes, unsubscribe := inventory.Subscribe()
+	defer unsubscribe()
+
+	// Message 3 is buffered, message 1 is applied and resent, then message 2
+	// releases message 3
+	for _, msg := range []RocketMessage{
+		{
+			Metadata: Metadata{Channel: "test-channel", MessageNumber: 3, MessageType: "RocketSpeedIncreased"},
+			Message:  json.RawMessage(`{"by":200}`),
+		},
+		{
+			Metadata: Metadata{Channel: "test-channel", MessageNumber: 1, MessageType: "RocketLaunched"},
+			Message:  json.RawMessage(`{"type":"Falcon-9","launchSpeed":500,"mission":"ARTEMIS"}`),
+		},
+		{
+			Metadata: Metadata{Channel: "test-channel", MessageNumber: 1, MessageType: "RocketLaunched"},
+			Message:  json.RawMessage(`{"type":"Falcon-9","launchSpeed":500,"mission":"ARTEMIS"}`),
+		},
+		{
+			Metadata: Metadata{Channel: "test-channel", MessageNumber: 2, MessageType: "RocketSpeedIncreased"},
+			Message:  json.RawMessage(`{"by":300}`),
+		},
+	} {
+		if err := inventory.UpdateRocketState(msg); err != nil {
+			t.Fatalf("Failed to process message %d: %v", msg.Metadata.MessageNumber, err)
+		}
+	}
+	unsubscribe()
+
+	var got []Change
+	for change := range changes {
+		got = append(got, change)
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("Expected 3 changes, got %+v", got)
+	}
+	for i, change := range got {
+		if change.Seq != int64(i+1) || change.MessageNumber != i+1 {
+			t.Errorf("Expected change %d with message %d, got %+v", i+1, i+1, change)
+		}
+	}
+	if *got[2].Speed != 1000 || *got[2].Status != "launched" || *got[2].Mission != "ARTEMIS" {
+		t.Errorf("Unexpected final state: %+v", got[2])
+	}
+}
+
 func TestUpdateRocketState_Concurrent(t *testing.T) {
 	db := setupDB(t)
 	defer db.Close()
@@ -415,4 +553,279 @@ func TestUpdateRocketState_InvalidMessageType(t *testing.T) {
 	if err == nil || err.Error() != "invalid message type: InvalidType" {
 		t.Errorf("Expected error 'invalid message type: InvalidType', got %v", err)
 	}
+	if !errors.Is(err, ErrInvalidMessageType) {
+		t.Errorf("Expected ErrInvalidMessageType, got %v", err)
+	}
+}
+
+func TestUpdateRocketState_InvalidOutOfOrderMessage(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	inventory := NewInventory(db)
+	message := func(number int, messageType, payload string) RocketMessage {
+		return RocketMessage{
+			Metadata: Metadata{Channel: "chan1", MessageNumber: number, MessageType: messageType},
+			Message:  json.RawMessage(payload),
+		}
+	}
+
+	// Buffered, they would be acknowledged and then block the messages after them
+	if err := inventory.UpdateRocketState(message(3, "Bogus", `{}`)); !errors.Is(err, ErrInvalidMessageType) {
+		t.Errorf("Expected ErrInvalidMessageType, got %v", err)
+	}
+	if err := inventory.UpdateRocketState(message(3, "RocketSpeedIncreased", `{"by":"fast"}`)); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("Expected ErrInvalidMessage, got %v", err)
+	}
+	if pending := inventory.PendingMessages("chan1"); pending != 0 {
+		t.Fatalf("Expected nothing buffered, got %d messages", pending)
+	}
+
+	for _, msg := range []RocketMessage{
+		message(3, "RocketSpeedIncreased", `{"by":100}`),
+		message(1, "RocketLaunched", `{"type":"Falcon-9","launchSpeed":500,"mission":"ARTEMIS"}`),
+		message(2, "RocketSpeedIncreased", `{"by":100}`),
+	} {
+		if err := inventory.UpdateRocketState(msg); err != nil {
+			t.Fatalf("Failed to process message %d: %v", msg.Metadata.MessageNumber, err)
+		}
+	}
+	var speed, lastMessageNumber int
+	db.QueryRow("SELECT speed, last_message_number FROM rockets WHERE channel = 'chan1'").Scan(&speed, &lastMessageNumber)
+	if speed != 700 || lastMessageNumber != 3 {
+		t.Errorf("Expected speed 700 at message 3, got %d at message %d", speed, lastMessageNumber)
+	}
+}
+
+func TestUpdateRocketState_BufferLimits(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	inventory := NewInventory(db)
+	inventory.SetBufferLimits(2, 3)
+	speedIncreased := func(channel string, number int) RocketMessage {
+		return RocketMessage{
+			Metadata: Metadata{Channel: channel, MessageNumber: number, MessageType: "RocketSpeedIncreased"},
+			Message:  json.RawMessage(`{"by":100}`),
+		}
+	}
+
+	for _, msg := range []RocketMessage{speedIncreased("chan1", 2), speedIncreased("chan1", 3)} {
+		if err := inventory.UpdateRocketState(msg); err != nil {
+			t.Fatalf("Failed to buffer message: %v", err)
+		}
+	}
+	if err := inventory.UpdateRocketState(speedIncreased("chan1", 4)); !errors.Is(err, ErrBufferFull) {
+		t.Errorf("Expected the channel limit to be reached, got %v", err)
+	}
+	// Resending a buffered message is still a duplicate
+	if err := inventory.UpdateRocketState(speedIncreased("chan1", 3)); err != nil {
+		t.Errorf("Expected duplicate to be accepted, got %v", err)
+	}
+
+	if err := inventory.UpdateRocketState(speedIncreased("chan2", 2)); err != nil {
+		t.Fatalf("Failed to buffer message: %v", err)
+	}
+	if err := inventory.UpdateRocketState(speedIncreased("chan3", 2)); !errors.Is(err, ErrBufferFull) {
+		t.Errorf("Expected the total limit to be reached, got %v", err)
+	}
+
+	// Filling the gap of chan1 frees its buffer
+	launched := RocketMessage{
+		Metadata: Metadata{Channel: "chan1", MessageNumber: 1, MessageType: "RocketLaunched"},
+		Message:  json.RawMessage(`{"type":"Falcon-9","launchSpeed":500,"mission":"ARTEMIS"}`),
+	}
+	if err := inventory.UpdateRocketState(launched); err != nil {
+		t.Fatalf("Failed to process message: %v", err)
+	}
+	if err := inventory.UpdateRocketState(speedIncreased("chan3", 2)); err != nil {
+		t.Errorf("Expected room in the buffer, got %v", err)
+	}
+	if depths := inventory.BufferDepths(); !reflect.DeepEqual(depths, map[string]int{"chan2": 1, "chan3": 1}) {
+		t.Errorf("Unexpected buffer depths: %v", depths)
+	}
+}
+
+func TestUpdateRocketState_InvalidMessage(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	inventory := NewInventory(db)
+	msg := RocketMessage{
+		Metadata: Metadata{
+			Channel:       "test-channel",
+			MessageNumber: 1,
+			MessageType:   "RocketLaunched",
+		},
+		Message: json.RawMessage(`{"launchSpeed":"fast"}`),
+	}
+
+	if err := inventory.UpdateRocketState(msg); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("Expected ErrInvalidMessage, got %v", err)
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	const metadata = `"metadata":{"channel":"c","messageNumber":1,"messageType":"RocketLaunched"}`
+	tests := []struct {
+		name   string
+		body   string
+		strict bool
+		valid  bool
+		// field is the offending field of invalid messages
+		field string
+	}{
+		{"valid", `{` + metadata + `,"message":{"type":"Falcon-9","launchSpeed":500,"mission":"ARTEMIS"}}`, true, true, ""},
+		{"lenient unknown field", `{` + metadata + `,"message":{"launchSpeed":500,"color":"red"},"extra":1}`, false, true, ""},
+		{"not JSON", `{"metadata":`, false, false, ""},
+		{"wrong type", `{` + metadata + `,"message":{"launchSpeed":"fast"}}`, true, false, "message.launchSpeed"},
+		{"wrong metadata type", `{"metadata":{"channel":"c","messageNumber":"one","messageType":"RocketLaunched"},"message":{}}`, false, false, "metadata.messageNumber"},
+		{"unknown envelope field", `{` + metadata + `,"message":{},"extra":1}`, true, false, "extra"},
+		{"unknown metadata field", `{"metadata":{"channel":"c","messageType":"RocketLaunched","sender":"x"},"message":{}}`, true, false, "metadata.sender"},
+		{"unknown payload field", `{` + metadata + `,"message":{"launchSpeed":500,"color":"red"}}`, true, false, "message.color"},
+		{"trailing data", `{` + metadata + `,"message":{}} {}`, true, false, ""},
+		{"missing channel", `{"metadata":{"messageType":"RocketLaunched"},"message":{}}`, true, false, "metadata.channel"},
+		{"missing payload", `{` + metadata + `}`, true, false, "message"},
+		{"payload not an object", `{` + metadata + `,"message":[1]}`, true, false, "message"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeMessage([]byte(tt.body), tt.strict)
+			if tt.valid {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			var fieldErr *FieldError
+			if !errors.As(err, &fieldErr) || !errors.Is(err, ErrInvalidMessage) {
+				t.Fatalf("Expected a FieldError, got %v", err)
+			}
+			if fieldErr.Field != tt.field {
+				t.Errorf("Expected field %q, got %q (%v)", tt.field, fieldErr.Field, err)
+			}
+		})
+	}
+
+	// Unknown types are refused however the message is decoded
+	for _, strict := range []bool{false, true} {
+		body := `{"metadata":{"channel":"c","messageNumber":3,"messageType":"Bogus"},"message":{}}`
+		if _, err := DecodeMessage([]byte(body), strict); !errors.Is(err, ErrInvalidMessageType) {
+			t.Errorf("Expected ErrInvalidMessageType when strict is %v, got %v", strict, err)
+		}
+	}
+	if _, err := DecodeMessage([]byte(`{`+metadata+`,"message":{"launchSpeed":"fast"}}`), false); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("Expected the payload to be checked without strict decoding, got %v", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	speedIncreased := func(number int) RocketMessage {
+		return RocketMessage{
+			Metadata: Metadata{Channel: "chan1", MessageNumber: number, MessageType: "RocketSpeedIncreased"},
+			Message:  json.RawMessage(`{"by":100}`),
+		}
+	}
+	inventory := NewInventory(db)
+	for _, number := range []int{3, 2} {
+		if err := inventory.UpdateRocketState(speedIncreased(number)); err != nil {
+			t.Fatalf("Failed to buffer message: %v", err)
+		}
+	}
+
+	if err := inventory.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	if err := inventory.UpdateRocketState(speedIncreased(4)); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("Expected messages to be refused once draining, got %v", err)
+	}
+
+	// The next instance picks up the buffered messages
+	restarted := NewInventory(db)
+	restored, err := restarted.RestorePending()
+	if err != nil {
+		t.Fatalf("RestorePending failed: %v", err)
+	}
+	if restored != 2 || restarted.PendingMessages("chan1") != 2 {
+		t.Fatalf("Expected 2 restored messages, got %d", restored)
+	}
+	launched := RocketMessage{
+		Metadata: Metadata{Channel: "chan1", MessageNumber: 1, MessageType: "RocketLaunched"},
+		Message:  json.RawMessage(`{"type":"Falcon-9","launchSpeed":500,"mission":"ARTEMIS"}`),
+	}
+	if err := restarted.UpdateRocketState(launched); err != nil {
+		t.Fatalf("Failed to process message: %v", err)
+	}
+
+	var speed, lastMessageNumber int
+	db.QueryRow("SELECT speed, last_message_number FROM rockets WHERE channel = 'chan1'").Scan(&speed, &lastMessageNumber)
+	if speed != 700 || lastMessageNumber != 3 {
+		t.Errorf("Expected speed 700 at message 3, got %d at message %d", speed, lastMessageNumber)
+	}
+
+	// Restored messages are removed from the database
+	if restored, err := NewInventory(db).RestorePending(); err != nil || restored != 0 {
+		t.Errorf("Expected nothing left to restore, got %d, %v", restored, err)
+	}
+}
+
+func TestRestorePending_BufferLimits(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	inventory := NewInventory(db)
+	for _, msg := range []RocketMessage{
+		{Metadata: Metadata{Channel: "chan1", MessageNumber: 4}},
+		{Metadata: Metadata{Channel: "chan1", MessageNumber: 2}},
+		{Metadata: Metadata{Channel: "chan1", MessageNumber: 3}},
+		{Metadata: Metadata{Channel: "chan2", MessageNumber: 2}},
+		{Metadata: Metadata{Channel: "chan3", MessageNumber: 2}},
+	} {
+		msg.Metadata.MessageType = "RocketSpeedIncreased"
+		msg.Message = json.RawMessage(`{"by":100}`)
+		if err := inventory.UpdateRocketState(msg); err != nil {
+			t.Fatalf("Failed to buffer message: %v", err)
+		}
+	}
+	if err := inventory.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+
+	// The limits may have been lowered since the messages were saved
+	restarted := NewInventory(db)
+	restarted.SetBufferLimits(2, 3)
+	restored, err := restarted.RestorePending()
+	if err != nil {
+		t.Fatalf("RestorePending failed: %v", err)
+	}
+	depths := restarted.BufferDepths()
+	if restored != 3 || !reflect.DeepEqual(depths, map[string]int{"chan1": 2, "chan2": 1}) {
+		t.Errorf("Expected 3 messages restored within the limits, got %d: %v", restored, depths)
+	}
+	if restarted.getNextMessage("chan1", 2) == nil || restarted.getNextMessage("chan1", 3) == nil {
+		t.Error("Expected the lowest message numbers of chan1 to be kept")
+	}
+
+	// The others stay saved until the limits let them in
+	var left int
+	db.QueryRow("SELECT COUNT(*) FROM pending_messages").Scan(&left)
+	if left != 2 {
+		t.Errorf("Expected the 2 messages over the limits to stay saved, got %d", left)
+	}
+	restarted = NewInventory(db)
+	restored, err = restarted.RestorePending()
+	if err != nil {
+		t.Fatalf("RestorePending failed: %v", err)
+	}
+	depths = restarted.BufferDepths()
+	if restored != 2 || !reflect.DeepEqual(depths, map[string]int{"chan1": 1, "chan3": 1}) {
+		t.Errorf("Expected the 2 saved messages to be restored without limits, got %d: %v", restored, depths)
+	}
+	db.QueryRow("SELECT COUNT(*) FROM pending_messages").Scan(&left)
+	if left != 0 {
+		t.Errorf("Expected no message left saved, got %d", left)
+	}
 }
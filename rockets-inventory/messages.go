@@ -3,6 +3,7 @@ package inventory
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 )
 
 type Metadata struct {
@@ -18,6 +19,9 @@ type RocketMessage struct {
 }
 
 type MessageHandler interface {
+	// NewPayload returns an empty payload of the message type, which messages
+	// are checked against before they are buffered or applied.
+	NewPayload() interface{}
 	Process(tx *sql.Tx, channel string, messageNumber int, message json.RawMessage) error
 }
 
@@ -29,6 +33,14 @@ var MessageHandlers = map[string]MessageHandler{
 	"RocketMissionChanged": &RocketMissionChangedHandler{},
 }
 
+// decodeMessage decodes the payload of a message into m.
+func decodeMessage(message json.RawMessage, m interface{}) error {
+	if err := json.Unmarshal(message, m); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	return nil
+}
+
 type RocketLaunchedHandler struct{}
 
 type RocketLaunchedMessage struct {
@@ -37,9 +49,11 @@ type RocketLaunchedMessage struct {
 	Mission     string `json:"mission"`
 }
 
+func (h *RocketLaunchedHandler) NewPayload() interface{} { return &RocketLaunchedMessage{} }
+
 func (h *RocketLaunchedHandler) Process(tx *sql.Tx, channel string, messageNumber int, message json.RawMessage) error {
 	var m RocketLaunchedMessage
-	if err := json.Unmarshal(message, &m); err != nil {
+	if err := decodeMessage(message, &m); err != nil {
 		return err
 	}
 	_, err := tx.Exec(`
@@ -58,9 +72,11 @@ type RocketSpeedChangedMessage struct {
 	By int `json:"by"`
 }
 
+func (h *RocketSpeedIncreasedHandler) NewPayload() interface{} { return &RocketSpeedChangedMessage{} }
+
 func (h *RocketSpeedIncreasedHandler) Process(tx *sql.Tx, channel string, messageNumber int, message json.RawMessage) error {
 	var m RocketSpeedChangedMessage
-	if err := json.Unmarshal(message, &m); err != nil {
+	if err := decodeMessage(message, &m); err != nil {
 		return err
 	}
 	_, err := tx.Exec(`
@@ -72,9 +88,11 @@ func (h *RocketSpeedIncreasedHandler) Process(tx *sql.Tx, channel string, messag
 
 type RocketSpeedDecreasedHandler struct{}
 
+func (h *RocketSpeedDecreasedHandler) NewPayload() interface{} { return &RocketSpeedChangedMessage{} }
+
 func (h *RocketSpeedDecreasedHandler) Process(tx *sql.Tx, channel string, messageNumber int, message json.RawMessage) error {
 	var m RocketSpeedChangedMessage
-	if err := json.Unmarshal(message, &m); err != nil {
+	if err := decodeMessage(message, &m); err != nil {
 		return err
 	}
 	_, err := tx.Exec(`
@@ -92,9 +110,11 @@ type RocketExplodedMessage struct {
 	Reason string `json:"reason"`
 }
 
+func (h *RocketExplodedHandler) NewPayload() interface{} { return &RocketExplodedMessage{} }
+
 func (h *RocketExplodedHandler) Process(tx *sql.Tx, channel string, messageNumber int, message json.RawMessage) error {
 	var m RocketExplodedMessage
-	if err := json.Unmarshal(message, &m); err != nil {
+	if err := decodeMessage(message, &m); err != nil {
 		return err
 	}
 	_, err := tx.Exec(`
@@ -110,9 +130,11 @@ type RocketMissionChangedMessage struct {
 	NewMission string `json:"newMission"`
 }
 
+func (h *RocketMissionChangedHandler) NewPayload() interface{} { return &RocketMissionChangedMessage{} }
+
 func (h *RocketMissionChangedHandler) Process(tx *sql.Tx, channel string, messageNumber int, message json.RawMessage) error {
 	var m RocketMissionChangedMessage
-	if err := json.Unmarshal(message, &m); err != nil {
+	if err := decodeMessage(message, &m); err != nil {
 		return err
 	}
 	_, err := tx.Exec(`
@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+)
+
+type attrsKey struct{}
+
+// With returns a copy of ctx whose log records carry attrs on top of those
+// already added, such as the request ID or the message being applied.
+func With(ctx context.Context, attrs ...slog.Attr) context.Context {
+	previous := attrsFrom(ctx)
+	combined := make([]slog.Attr, 0, len(previous)+len(attrs))
+	combined = append(append(combined, previous...), attrs...)
+	return context.WithValue(ctx, attrsKey{}, combined)
+}
+
+func attrsFrom(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// contextHandler adds the attributes of the context to every record, so
+// callers only need to log with the *Context functions of slog.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.AddAttrs(attrsFrom(ctx)...)
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// New returns a logger writing to w as JSON when format is "json" and as
+// key=value text otherwise, dropping records below level.
+func New(w io.Writer, format string, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(contextHandler{handler})
+}
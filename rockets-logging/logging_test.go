@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNew_AddsContextAttrs(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, "json", slog.LevelInfo)
+
+	ctx := With(context.Background(), slog.String("requestId", "abc"))
+	ctx = With(ctx, slog.String("channel", "chan1"), slog.Int("messageNumber", 3))
+	logger.InfoContext(ctx, "message applied")
+	logger.DebugContext(ctx, "dropped below the level")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("Expected one JSON record, got %q: %v", out.String(), err)
+	}
+	expected := map[string]interface{}{
+		"msg":           "message applied",
+		"requestId":     "abc",
+		"channel":       "chan1",
+		"messageNumber": float64(3),
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("Expected %s=%v, got %v", key, value, record[key])
+		}
+	}
+}
+
+func TestNew_Text(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, "text", slog.LevelDebug).With("component", "test")
+
+	logger.DebugContext(With(context.Background(), slog.String("requestId", "abc")), "hello")
+	line := out.String()
+	for _, expected := range []string{"level=DEBUG", "msg=hello", "component=test", "requestId=abc"} {
+		if !strings.Contains(line, expected) {
+			t.Errorf("Expected %q in %q", expected, line)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcomes of an ingested message.
+const (
+	Applied   = "applied"
+	Buffered  = "buffered"
+	Duplicate = "duplicate"
+	Rejected  = "rejected"
+)
+
+// UnknownType labels messages whose type is not supported, so clients cannot
+// create an unbounded number of series.
+const UnknownType = "unknown"
+
+var (
+	messagesIngested = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rocket_messages_ingested_total",
+		Help: "Messages received, by message type and outcome. Buffered messages are counted again as applied once their gap is filled.",
+	}, []string{"message_type", "outcome"})
+
+	handlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rocket_message_handler_duration_seconds",
+		Help:    "Time spent applying a message to the rocket state, by message type.",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+	}, []string{"message_type"})
+
+	transactionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "rocket_ingestion_transaction_duration_seconds",
+		Help:    "Time spent in the database transaction that ingests a message, including its commit.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	throttledRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rocket_throttled_requests_total",
+		Help: "Requests refused with 429 by a rate limit, by scope: channel, client or address.",
+	}, []string{"scope"})
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests served, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time spent serving HTTP requests, by route, method and status code. Streams are observed when they end.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+// ObserveMessage counts a message received for ingestion with its outcome.
+func ObserveMessage(messageType, outcome string) {
+	messagesIngested.WithLabelValues(messageType, outcome).Inc()
+}
+
+// ObserveHandler records the time spent applying a message since start.
+func ObserveHandler(messageType string, start time.Time) {
+	handlerDuration.WithLabelValues(messageType).Observe(time.Since(start).Seconds())
+}
+
+// ObserveTransaction records the time spent in an ingestion transaction since start.
+func ObserveTransaction(start time.Time) {
+	transactionDuration.Observe(time.Since(start).Seconds())
+}
+
+// ObserveThrottled counts a request refused by the rate limit of scope.
+func ObserveThrottled(scope string) {
+	throttledRequests.WithLabelValues(scope).Inc()
+}
+
+// Fleet reads the state reported at each scrape.
+type Fleet struct {
+	// BufferDepths returns the number of out of order messages waiting for
+	// each channel that has any.
+	BufferDepths func() map[string]int
+	// RocketsByStatus returns the number of rockets with each status.
+	RocketsByStatus func() (map[string]int, error)
+}
+
+// NewRegistry returns a registry with the ingestion and HTTP metrics, the
+// state of fleet and the Go runtime metrics.
+func NewRegistry(fleet Fleet) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		messagesIngested,
+		handlerDuration,
+		transactionDuration,
+		throttledRequests,
+		httpRequests,
+		httpDuration,
+		&fleetCollector{fleet: fleet},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return registry
+}
+
+// Handler serves the metrics of registry in the Prometheus exposition format.
+func Handler(registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// InstrumentHandler counts and times the requests next serves for route.
+// Streaming and WebSocket responses keep working, as the wrapped
+// ResponseWriter still implements http.Flusher and http.Hijacker.
+func InstrumentHandler(route string, next http.Handler) http.Handler {
+	labels := prometheus.Labels{"route": route}
+	return promhttp.InstrumentHandlerDuration(httpDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(httpRequests.MustCurryWith(labels), next))
+}
+
+var (
+	bufferDepthDesc = prometheus.NewDesc("rocket_buffer_depth",
+		"Out of order messages waiting for a gap to be filled, across all channels.", nil, nil)
+	channelBufferDepthDesc = prometheus.NewDesc("rocket_buffer_depth_channel",
+		"Out of order messages waiting for a gap to be filled, by channel.", []string{"channel"}, nil)
+	rocketsDesc = prometheus.NewDesc("rocket_fleet_rockets",
+		"Rockets in the fleet, by status.", []string{"status"}, nil)
+)
+
+// fleetCollector reads the fleet state when scraped rather than tracking it,
+// so the values always match the inventory and the database.
+type fleetCollector struct {
+	fleet Fleet
+}
+
+func (c *fleetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bufferDepthDesc
+	ch <- channelBufferDepthDesc
+	ch <- rocketsDesc
+}
+
+func (c *fleetCollector) Collect(ch chan<- prometheus.Metric) {
+	total := 0
+	for channel, depth := range c.fleet.BufferDepths() {
+		total += depth
+		ch <- prometheus.MustNewConstMetric(channelBufferDepthDesc, prometheus.GaugeValue, float64(depth), channel)
+	}
+	ch <- prometheus.MustNewConstMetric(bufferDepthDesc, prometheus.GaugeValue, float64(total))
+
+	counts, err := c.fleet.RocketsByStatus()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(rocketsDesc, err)
+		return
+	}
+	for status, count := range counts {
+		ch <- prometheus.MustNewConstMetric(rocketsDesc, prometheus.GaugeValue, float64(count), status)
+	}
+}
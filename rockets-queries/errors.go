@@ -0,0 +1,17 @@
+package queries
+
+import "errors"
+
+var (
+	// ErrRocketNotFound is returned when no rocket has the requested channel,
+	// or when it had no state yet at the requested point of its history.
+	ErrRocketNotFound = errors.New("rocket not found")
+
+	// ErrMissionNotFound is returned when no rocket has ever been assigned to
+	// the requested mission.
+	ErrMissionNotFound = errors.New("mission not found")
+
+	// ErrInvalidCursor is returned when a cursor is malformed or was issued for
+	// other filters or sorting.
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
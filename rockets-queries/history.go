@@ -0,0 +1,273 @@
+package queries
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	inventory "rocket-service/rockets-inventory"
+)
+
+// At selects a point in a rocket's history: the state right after
+// MessageNumber was applied, or after the last message sent at or before Time.
+// Exactly one of them must be set.
+type At struct {
+	MessageNumber int
+	Time          *time.Time
+}
+
+type storedMessage struct {
+	number    int
+	time      string
+	msgType   string
+	payload   string
+	appliedAt string
+}
+
+// replayTable shadows the rockets table for the connection of a transaction:
+// SQLite resolves unqualified names in the temp schema first, so the message
+// handlers replay into this empty copy instead of the live state. Like every
+// change of the transaction, the copy is gone once it is rolled back.
+const replayTable = `
+    CREATE TEMP TABLE rockets AS SELECT * FROM main.rockets WHERE 0;
+    CREATE UNIQUE INDEX temp.replay_channel ON rockets (channel);`
+
+// GetRocketAt rebuilds the state of a rocket at a past point by replaying its
+// stored messages through the inventory message handlers, so the result is
+// the state the live inventory had at that moment. The replay runs in a read
+// transaction on a temporary copy of the rockets table, which never takes the
+// write lock or touches the current state.
+func (q *Queries) GetRocketAt(channel string, at At) (*RocketState, error) {
+	tx, err := q.readTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	messages, err := loadMessages(tx, channel, at)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, ErrRocketNotFound
+	}
+
+	if _, err := tx.Exec(replayTable); err != nil {
+		return nil, err
+	}
+	for _, m := range messages {
+		msg := inventory.RocketMessage{
+			Metadata: inventory.Metadata{
+				Channel:       channel,
+				MessageNumber: m.number,
+				MessageTime:   m.time,
+				MessageType:   m.msgType,
+			},
+			Message: json.RawMessage(m.payload),
+		}
+		if err := inventory.ApplyMessage(tx, msg, m.appliedAt); err != nil {
+			return nil, err
+		}
+	}
+
+	// Messages applied before the launch leave no state behind
+	r, err := scanRocket(tx.QueryRow("SELECT "+rocketColumns+" FROM temp.rockets WHERE channel = ?", channel))
+	if err == sql.ErrNoRows {
+		return nil, ErrRocketNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// loadMessages reads the stored messages of a channel up to the requested point, in order.
+func loadMessages(tx *sql.Tx, channel string, at At) ([]storedMessage, error) {
+	query := `
+        SELECT message_number, message_time, message_type, payload, applied_at
+        FROM rocket_events WHERE channel = ?`
+	args := []interface{}{channel}
+	if at.MessageNumber > 0 {
+		query += " AND message_number <= ?"
+		args = append(args, at.MessageNumber)
+	}
+
+	rows, err := tx.Query(query+" ORDER BY message_number", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []storedMessage
+	for rows.Next() {
+		var m storedMessage
+		var messageTime, appliedAt sql.NullString
+		if err := rows.Scan(&m.number, &messageTime, &m.msgType, &m.payload, &appliedAt); err != nil {
+			return nil, err
+		}
+		m.time = messageTime.String
+		m.appliedAt = appliedAt.String
+
+		if at.Time != nil {
+			// Messages are applied in message number order, so the first one
+			// sent after the requested time ends the replay. Messages without a
+			// readable time were still applied and are kept.
+			sent, err := time.Parse(time.RFC3339Nano, m.time)
+			if err == nil && sent.After(*at.Time) {
+				break
+			}
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
+
+type RocketEvent struct {
+	MessageNumber int             `json:"messageNumber"`
+	MessageTime   string          `json:"messageTime"`
+	MessageType   string          `json:"messageType"`
+	Message       json.RawMessage `json:"message"`
+	Speed         *int            `json:"speed,omitempty"`
+	Status        *string         `json:"status,omitempty"`
+}
+
+type EventOptions struct {
+	MessageType string
+	// Limit is the page size; zero returns every matching event.
+	Limit  int
+	Cursor string
+}
+
+type EventPage struct {
+	Events     []RocketEvent `json:"events"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// eventCursor points after the last message number of a page. Stored
+// messages never change, so paging by message number is stable.
+type eventCursor struct {
+	After int `json:"a"`
+}
+
+// ListEvents returns the messages applied to a rocket in message number
+// order, with the speed and status each of them left the rocket in.
+func (q *Queries) ListEvents(channel string, opts EventOptions) (*EventPage, error) {
+	limit := opts.Limit
+	if limit > 0 {
+		// Read one more event to know whether there is a next page
+		opts.Limit++
+	}
+
+	page := &EventPage{Events: []RocketEvent{}}
+	err := q.EachEvent(channel, opts, func(e RocketEvent) error {
+		page.Events = append(page.Events, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(page.Events) > limit {
+		page.Events = page.Events[:limit]
+		data, _ := json.Marshal(eventCursor{After: page.Events[limit-1].MessageNumber})
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	return page, nil
+}
+
+// EachEvent calls fn for every event ListEvents would return, in order, as
+// rows are read from the database. It stops at the first error fn returns.
+func (q *Queries) EachEvent(channel string, opts EventOptions, fn func(RocketEvent) error) error {
+	var exists bool
+	err := q.db.QueryRow("SELECT EXISTS(SELECT 1 FROM rocket_events WHERE channel = ?)", channel).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrRocketNotFound
+	}
+
+	query := `
+        SELECT message_number, message_time, message_type, payload, speed, status
+        FROM rocket_events WHERE channel = ?`
+	args := []interface{}{channel}
+	if opts.MessageType != "" {
+		query += " AND message_type = ?"
+		args = append(args, opts.MessageType)
+	}
+	if opts.Cursor != "" {
+		var c eventCursor
+		data, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+		if err != nil || json.Unmarshal(data, &c) != nil {
+			return ErrInvalidCursor
+		}
+		query += " AND message_number > ?"
+		args = append(args, c.After)
+	}
+	query += " ORDER BY message_number"
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+
+	rows, err := q.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e RocketEvent
+		var messageTime, status sql.NullString
+		var payload string
+		var speed sql.NullInt64
+		if err := rows.Scan(&e.MessageNumber, &messageTime, &e.MessageType, &payload, &speed, &status); err != nil {
+			return err
+		}
+		e.MessageTime = messageTime.String
+		e.Message = json.RawMessage(payload)
+		if speed.Valid {
+			s := int(speed.Int64)
+			e.Speed = &s
+		}
+		if status.Valid {
+			e.Status = &status.String
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ChangesSince returns up to limit changes recorded after seq, in order, so a
+// subscriber to the inventory changes can catch up on what it missed. Fewer
+// than limit changes means it has caught up; otherwise it asks again after
+// the last one.
+func (q *Queries) ChangesSince(seq int64, limit int) ([]inventory.Change, error) {
+	rows, err := q.db.Query(`
+        SELECT id, channel, message_number, COALESCE(message_time, ''), message_type,
+            COALESCE(applied_at, ''), type, speed, mission, status
+        FROM rocket_events WHERE id > ? ORDER BY id LIMIT ?`, seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []inventory.Change
+	for rows.Next() {
+		var c inventory.Change
+		err := rows.Scan(&c.Seq, &c.Channel, &c.MessageNumber, &c.MessageTime, &c.MessageType,
+			&c.AppliedAt, &c.Type, &c.Speed, &c.Mission, &c.Status)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, rows.Err()
+}
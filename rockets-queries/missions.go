@@ -0,0 +1,168 @@
+package queries
+
+import (
+	"database/sql"
+	"sort"
+)
+
+// Mission summarizes the rockets assigned to a mission. Statuses and speeds
+// only cover the rockets currently assigned to it.
+type Mission struct {
+	Name                string         `json:"name"`
+	RocketCount         int            `json:"rocketCount"`
+	PreviousRocketCount int            `json:"previousRocketCount"`
+	ByStatus            map[string]int `json:"byStatus"`
+	Speed               *SpeedStats    `json:"speed,omitempty"`
+}
+
+// MissionRocket is a rocket assigned to a mission now or in the past.
+// AssignedAt is the sending time of the first message after which the rocket
+// was on the mission.
+type MissionRocket struct {
+	RocketState
+	Current    bool    `json:"current"`
+	AssignedAt *string `json:"assignedAt,omitempty"`
+}
+
+type MissionRockets struct {
+	Name    string          `json:"name"`
+	Rockets []MissionRocket `json:"rockets"`
+}
+
+// assignments lists every mission each rocket has been on: the current ones
+// and those recorded with the messages applied to it.
+const assignments = `
+    SELECT DISTINCT mission, channel FROM rocket_events WHERE mission IS NOT NULL
+    UNION
+    SELECT mission, channel FROM rockets WHERE mission IS NOT NULL`
+
+// ListMissions returns every mission a rocket has been assigned to, by name,
+// counted from one state of the database.
+func (q *Queries) ListMissions() ([]Mission, error) {
+	tx, err := q.readTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+        SELECT a.mission, COUNT(r.channel), COUNT(*) - COUNT(r.channel)
+        FROM (` + assignments + `) a
+        LEFT JOIN rockets r ON r.channel = a.channel AND r.mission = a.mission
+        GROUP BY a.mission ORDER BY a.mission`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	missions := []Mission{}
+	for rows.Next() {
+		m := Mission{ByStatus: map[string]int{}}
+		if err := rows.Scan(&m.Name, &m.RocketCount, &m.PreviousRocketCount); err != nil {
+			return nil, err
+		}
+		missions = append(missions, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*Mission, len(missions))
+	for i := range missions {
+		byName[missions[i].Name] = &missions[i]
+	}
+
+	statuses, err := tx.Query("SELECT mission, COALESCE(status, '" + unknownGroup + "'), COUNT(*) FROM rockets" +
+		" WHERE mission IS NOT NULL GROUP BY 1, 2")
+	if err != nil {
+		return nil, err
+	}
+	defer statuses.Close()
+	for statuses.Next() {
+		var name, status string
+		var count int
+		if err := statuses.Scan(&name, &status, &count); err != nil {
+			return nil, err
+		}
+		if m, ok := byName[name]; ok {
+			m.ByStatus[status] = count
+		}
+	}
+	if err := statuses.Err(); err != nil {
+		return nil, err
+	}
+
+	speeds := map[string]SpeedStats{}
+	if err := speedBy(tx, "mission", "", nil, speeds); err != nil {
+		return nil, err
+	}
+	for name, s := range speeds {
+		if m, ok := byName[name]; ok {
+			s := s
+			m.Speed = &s
+		}
+	}
+
+	return missions, nil
+}
+
+// GetMission returns the rockets currently assigned to a mission, then those
+// that left it, each in channel order.
+func (q *Queries) GetMission(name string) (*MissionRockets, error) {
+	assignedAt := map[string]*string{}
+	rows, err := q.db.Query(`
+        SELECT e.channel, e.message_time FROM rocket_events e
+        WHERE e.mission = ? AND e.message_number = (
+            SELECT MIN(message_number) FROM rocket_events
+            WHERE channel = e.channel AND mission = e.mission)`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var channel string
+		var messageTime sql.NullString
+		if err := rows.Scan(&channel, &messageTime); err != nil {
+			return nil, err
+		}
+		if messageTime.Valid {
+			assignedAt[channel] = &messageTime.String
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rockets, err := q.db.Query("SELECT "+rocketColumns+" FROM rockets"+
+		" WHERE mission = ? OR channel IN (SELECT channel FROM rocket_events WHERE mission = ?)"+
+		" ORDER BY channel", name, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rockets.Close()
+
+	mission := &MissionRockets{Name: name, Rockets: []MissionRocket{}}
+	for rockets.Next() {
+		r, err := scanRocket(rockets)
+		if err != nil {
+			return nil, err
+		}
+		q.withPending(r)
+		mission.Rockets = append(mission.Rockets, MissionRocket{
+			RocketState: *r,
+			Current:     r.Mission != nil && *r.Mission == name,
+			AssignedAt:  assignedAt[r.Channel],
+		})
+	}
+	if err := rockets.Err(); err != nil {
+		return nil, err
+	}
+	if len(mission.Rockets) == 0 {
+		return nil, ErrMissionNotFound
+	}
+
+	// A stable sort keeps the channel order within each group
+	sort.SliceStable(mission.Rockets, func(i, j int) bool {
+		return mission.Rockets[i].Current && !mission.Rockets[j].Current
+	})
+	return mission, nil
+}
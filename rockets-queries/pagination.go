@@ -0,0 +1,259 @@
+package queries
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Columns rockets can be sorted by.
+var sortColumns = map[string]bool{
+	"channel": true,
+	"type":    true,
+	"speed":   true,
+	"mission": true,
+	"status":  true,
+}
+
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+type ListOptions struct {
+	Filter RocketFilter
+	SortBy []SortKey
+	// Limit is the page size; zero returns every matching rocket.
+	Limit  int
+	Cursor string
+}
+
+type RocketPage struct {
+	Rockets    []RocketState `json:"rockets"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// ParseSort parses a comma separated list of sort keys such as "status,-speed".
+// order ("asc" or "desc") sets the direction of every key and a leading "-"
+// reverses it for a single key.
+func ParseSort(sortBy, order string) ([]SortKey, error) {
+	var desc bool
+	switch order {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		return nil, fmt.Errorf("invalid order: %s", order)
+	}
+
+	if sortBy == "" {
+		sortBy = "channel"
+	}
+
+	var keys []SortKey
+	for _, field := range strings.Split(sortBy, ",") {
+		key := SortKey{Field: strings.TrimSpace(field), Desc: desc}
+		if strings.HasPrefix(key.Field, "-") {
+			key.Field = key.Field[1:]
+			key.Desc = !desc
+		}
+		if !sortColumns[key.Field] {
+			return nil, fmt.Errorf("invalid sort_by field: %s", key.Field)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// orderKeys returns the sort keys ending with channel, so the order is
+// total and a page can end after any rocket.
+func orderKeys(keys []SortKey) []SortKey {
+	for _, key := range keys {
+		if key.Field == "channel" {
+			return keys
+		}
+	}
+	return append(append([]SortKey{}, keys...), SortKey{Field: "channel"})
+}
+
+// orderBy builds the ORDER BY clause of keys, which orderKeys completed.
+func orderBy(keys []SortKey) string {
+	terms := make([]string, len(keys))
+	for i, key := range keys {
+		direction := "ASC"
+		if key.Desc {
+			direction = "DESC"
+		}
+		terms[i] = key.Field + " " + direction
+	}
+	return strings.Join(terms, ", ")
+}
+
+// MaxPageSize caps the rockets of a page, including the page size a cursor
+// carries over.
+const MaxPageSize = 1000
+
+// cursor points after the last rocket of a page by its sort values, so no
+// listing is kept in memory between pages. It is bound to the filter and
+// sorting of its listing, and to the last message recorded when the listing
+// started: every page reads the rockets as they were then, so their sort
+// values cannot change between pages.
+type cursor struct {
+	Listing  string        `json:"q"`
+	Snapshot int64         `json:"s"`
+	After    []interface{} `json:"a"`
+	Limit    int           `json:"l"`
+}
+
+// rocketsAt selects the rockets as they were once the recorded message with
+// the id given as its 3 arguments was applied: each launched rocket in the
+// state recorded with its last message up to that one. Rockets launched later
+// are left out. Rockets without recorded messages keep their current state,
+// as only recording a message changes it.
+const rocketsAt = `(
+    SELECT r.channel, e.type, e.speed, e.mission, e.status,
+        e.message_number AS last_message_number, e.message_time AS last_message_time,
+        (SELECT l.message_time FROM rocket_events l
+            WHERE l.channel = r.channel AND l.message_type = 'RocketLaunched' AND l.id <= ?
+            ORDER BY l.id DESC LIMIT 1) AS launched_at,
+        e.applied_at AS updated_at
+    FROM rockets r JOIN rocket_events e ON e.id = (
+        SELECT MAX(id) FROM rocket_events WHERE channel = r.channel AND id <= ?)
+    WHERE EXISTS (
+        SELECT 1 FROM rocket_events l
+        WHERE l.channel = r.channel AND l.message_type = 'RocketLaunched' AND l.id <= ?)
+    UNION ALL
+    SELECT ` + rocketColumns + ` FROM rockets r
+    WHERE NOT EXISTS (SELECT 1 FROM rocket_events WHERE channel = r.channel)
+)`
+
+// listing fingerprints the filter and sorting of opts, which the next pages
+// must repeat.
+func listing(filter RocketFilter, keys []SortKey) string {
+	speed := func(s *int) string {
+		if s == nil {
+			return ""
+		}
+		return strconv.Itoa(*s)
+	}
+	parts := []string{filter.Status, filter.Type, filter.Mission, filter.MissionPrefix, speed(filter.MinSpeed), speed(filter.MaxSpeed)}
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s:%t", key.Field, key.Desc))
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reads a cursor of a listing sorted by keys. Its values are
+// checked against the columns of the keys, and its page size against
+// MaxPageSize, before reaching the database.
+func decodeCursor(s string, keys []SortKey) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&c); err != nil || len(c.After) != len(keys) {
+		return c, ErrInvalidCursor
+	}
+	if c.Snapshot < 0 || c.Limit < 1 || c.Limit > MaxPageSize {
+		return c, ErrInvalidCursor
+	}
+	for i, key := range keys {
+		switch value := c.After[i].(type) {
+		case nil:
+			if key.Field == "channel" {
+				return c, ErrInvalidCursor
+			}
+		case json.Number:
+			speed, err := value.Int64()
+			if err != nil || key.Field != "speed" {
+				return c, ErrInvalidCursor
+			}
+			c.After[i] = speed
+		case string:
+			if key.Field == "speed" {
+				return c, ErrInvalidCursor
+			}
+		default:
+			return c, ErrInvalidCursor
+		}
+	}
+	return c, nil
+}
+
+// sortValues returns the values of r the keys sort by, NULLs as nil.
+func sortValues(keys []SortKey, r RocketState) []interface{} {
+	text := func(s *string) interface{} {
+		if s == nil {
+			return nil
+		}
+		return *s
+	}
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		switch key.Field {
+		case "channel":
+			values[i] = r.Channel
+		case "type":
+			values[i] = text(r.Type)
+		case "speed":
+			if r.Speed != nil {
+				values[i] = int64(*r.Speed)
+			}
+		case "mission":
+			values[i] = text(r.Mission)
+		case "status":
+			values[i] = text(r.Status)
+		}
+	}
+	return values
+}
+
+// after builds the condition selecting the rockets sorted after values.
+// SQLite sorts NULLs first, so they come before every value in ascending
+// order and after every value in descending order.
+func after(keys []SortKey, values []interface{}) (string, []interface{}) {
+	var alternatives []string
+	var args []interface{}
+	for i, key := range keys {
+		var terms []string
+		var termArgs []interface{}
+		for j := 0; j < i; j++ {
+			if values[j] == nil {
+				terms = append(terms, keys[j].Field+" IS NULL")
+			} else {
+				terms = append(terms, keys[j].Field+" = ?")
+				termArgs = append(termArgs, values[j])
+			}
+		}
+		switch {
+		case values[i] == nil && key.Desc:
+			// Nothing sorts after NULL
+			continue
+		case values[i] == nil:
+			terms = append(terms, key.Field+" IS NOT NULL")
+		case key.Desc:
+			terms = append(terms, "("+key.Field+" < ? OR "+key.Field+" IS NULL)")
+			termArgs = append(termArgs, values[i])
+		default:
+			terms = append(terms, key.Field+" > ?")
+			termArgs = append(termArgs, values[i])
+		}
+		alternatives = append(alternatives, "("+strings.Join(terms, " AND ")+")")
+		args = append(args, termArgs...)
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")", args
+}
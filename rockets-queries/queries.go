@@ -3,6 +3,8 @@ package queries
 import (
 	"database/sql"
 	"fmt"
+	"log/slog"
+	"strings"
 )
 
 type RocketState struct {
@@ -11,28 +13,161 @@ type RocketState struct {
 	Speed   *int    `json:"speed,omitempty"`
 	Mission *string `json:"mission,omitempty"`
 	Status  *string `json:"status,omitempty"`
+
+	// How current the state is: the last message applied, as sent by the
+	// rocket, when the rocket was launched according to its launch message,
+	// and when the server last updated it
+	LastMessageNumber int     `json:"lastMessageNumber"`
+	LastMessageTime   *string `json:"lastMessageTime,omitempty"`
+	LaunchedAt        *string `json:"launchedAt,omitempty"`
+	UpdatedAt         *string `json:"updatedAt,omitempty"`
+	// PendingMessages counts the messages received out of order that wait
+	// for a gap to be filled. It is only known for the current state.
+	PendingMessages *int `json:"pendingMessages,omitempty"`
+}
+
+// RocketFilter narrows the rockets returned by ListRockets.
+// Empty strings and nil speeds are ignored.
+type RocketFilter struct {
+	Status        string
+	Type          string
+	Mission       string
+	MissionPrefix string
+	MinSpeed      *int
+	MaxSpeed      *int
+}
+
+// Statuses a rocket can be in.
+var validStatuses = map[string]bool{
+	"launched": true,
+	"exploded": true,
+}
+
+// Validate checks the filter values before they reach the database.
+func (f RocketFilter) Validate() error {
+	if f.Status != "" && !validStatuses[f.Status] {
+		return fmt.Errorf("invalid status: %s", f.Status)
+	}
+	if f.Mission != "" && f.MissionPrefix != "" {
+		return fmt.Errorf("mission and mission_prefix are mutually exclusive")
+	}
+	if f.MinSpeed != nil && *f.MinSpeed < 0 {
+		return fmt.Errorf("min_speed must not be negative")
+	}
+	if f.MaxSpeed != nil && *f.MaxSpeed < 0 {
+		return fmt.Errorf("max_speed must not be negative")
+	}
+	if f.MinSpeed != nil && f.MaxSpeed != nil && *f.MinSpeed > *f.MaxSpeed {
+		return fmt.Errorf("min_speed must not be greater than max_speed")
+	}
+	return nil
+}
+
+// Matches reports whether a rocket passes the filter, applying the same
+// rules as the SQL built by where.
+func (f RocketFilter) Matches(r RocketState) bool {
+	if f.Status != "" && (r.Status == nil || *r.Status != f.Status) {
+		return false
+	}
+	if f.Type != "" && (r.Type == nil || *r.Type != f.Type) {
+		return false
+	}
+	if f.Mission != "" && (r.Mission == nil || *r.Mission != f.Mission) {
+		return false
+	}
+	if f.MissionPrefix != "" && (r.Mission == nil || !strings.HasPrefix(*r.Mission, f.MissionPrefix)) {
+		return false
+	}
+	if f.MinSpeed != nil && (r.Speed == nil || *r.Speed < *f.MinSpeed) {
+		return false
+	}
+	if f.MaxSpeed != nil && (r.Speed == nil || *r.Speed > *f.MaxSpeed) {
+		return false
+	}
+	return true
+}
+
+// where builds a parameterized WHERE clause for the filter.
+func (f RocketFilter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if f.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, f.Status)
+	}
+	if f.Type != "" {
+		conditions = append(conditions, "type = ?")
+		args = append(args, f.Type)
+	}
+	if f.Mission != "" {
+		conditions = append(conditions, "mission = ?")
+		args = append(args, f.Mission)
+	}
+	if f.MissionPrefix != "" {
+		// substr keeps the match case-sensitive, unlike LIKE
+		conditions = append(conditions, "substr(mission, 1, length(?)) = ?")
+		args = append(args, f.MissionPrefix, f.MissionPrefix)
+	}
+	if f.MinSpeed != nil {
+		conditions = append(conditions, "speed >= ?")
+		args = append(args, *f.MinSpeed)
+	}
+	if f.MaxSpeed != nil {
+		conditions = append(conditions, "speed <= ?")
+		args = append(args, *f.MaxSpeed)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// PendingCounter reports the messages waiting to be applied to rockets,
+// which only the inventory knows about.
+type PendingCounter interface {
+	PendingMessages(channel string) int
+	BufferDepths() map[string]int
 }
 
 type Queries struct {
-	db *sql.DB
+	db      *sql.DB
+	pending PendingCounter
 }
 
 func NewQueries(db *sql.DB) *Queries {
-	return &Queries{db}
+	return &Queries{db: db}
 }
 
-func (q *Queries) GetRocket(channel string) (*RocketState, error) {
+// SetPendingCounter makes the current rocket states report their pending
+// messages from counter.
+func (q *Queries) SetPendingCounter(counter PendingCounter) {
+	q.pending = counter
+}
+
+// withPending fills the pending messages of a current rocket state.
+func (q *Queries) withPending(r *RocketState) {
+	if q.pending != nil {
+		pending := q.pending.PendingMessages(r.Channel)
+		r.PendingMessages = &pending
+	}
+}
+
+// rocketColumns are the columns scanRocket reads, in order.
+const rocketColumns = "channel, type, speed, mission, status, last_message_number, last_message_time, launched_at, updated_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRocket(row rowScanner) (*RocketState, error) {
 	var r RocketState
 	var speed sql.NullInt64
 	var typ, mission, status sql.NullString
 
-	err := q.db.QueryRow(`
-        SELECT channel, type, speed, mission, status
-        FROM rockets WHERE channel = ?`, channel).
-		Scan(&r.Channel, &typ, &speed, &mission, &status)
-	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("rocket not found")
-	}
+	err := row.Scan(&r.Channel, &typ, &speed, &mission, &status,
+		&r.LastMessageNumber, &r.LastMessageTime, &r.LaunchedAt, &r.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -54,48 +189,121 @@ func (q *Queries) GetRocket(channel string) (*RocketState, error) {
 	return &r, nil
 }
 
-func (q *Queries) ListRockets(sortBy string) ([]RocketState, error) {
-	var orderBy string
-	switch sortBy {
-	case "speed":
-		orderBy = "speed ASC"
-	case "mission":
-		orderBy = "mission ASC"
-	case "status":
-		orderBy = "status ASC"
-	default:
-		orderBy = "channel ASC"
+func (q *Queries) GetRocket(channel string) (*RocketState, error) {
+	r, err := scanRocket(q.db.QueryRow("SELECT "+rocketColumns+" FROM rockets WHERE channel = ?", channel))
+	if err == sql.ErrNoRows {
+		return nil, ErrRocketNotFound
 	}
-
-	rows, err := q.db.Query("SELECT channel, type, speed, mission, status FROM rockets ORDER BY " + orderBy)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	var rockets []RocketState
-	for rows.Next() {
-		var r RocketState
-		var speed sql.NullInt64
-		var typ, mission, status sql.NullString
-		if err := rows.Scan(&r.Channel, &typ, &speed, &mission, &status); err != nil {
+	q.withPending(r)
+	return r, nil
+}
+
+// ListRockets returns one page of rockets matching opts.
+//
+// A listing with a limit is read as the fleet was when its first page was
+// read: NextCursor holds the last message recorded then, along with the sort
+// values of the last rocket of the page, and the next page starts after
+// them. Rockets updated between pages are listed once each, in the state and
+// place they had when the listing started, and rockets launched since are
+// left out. Without a limit, every rocket is listed in its current state.
+func (q *Queries) ListRockets(opts ListOptions) (*RocketPage, error) {
+	keys := orderKeys(opts.SortBy)
+	fingerprint := listing(opts.Filter, keys)
+	where, args := opts.Filter.where()
+
+	limit := opts.Limit
+	var c cursor
+	if opts.Cursor != "" {
+		var err error
+		if c, err = decodeCursor(opts.Cursor, keys); err != nil {
 			return nil, err
 		}
-		if typ.Valid {
-			r.Type = &typ.String
+		if c.Listing != fingerprint {
+			slog.Debug("Cursor of another listing", "listing", c.Listing, "expected", fingerprint)
+			return nil, ErrInvalidCursor
 		}
-		if speed.Valid {
-			s := int(speed.Int64)
-			r.Speed = &s
+		if limit <= 0 {
+			limit = c.Limit
 		}
-		if mission.Valid {
-			r.Mission = &mission.String
+		condition, afterArgs := after(keys, c.After)
+		if where == "" {
+			where = " WHERE " + condition
+		} else {
+			where += " AND " + condition
 		}
-		if status.Valid {
-			r.Status = &status.String
+		args = append(args, afterArgs...)
+	} else if limit > 0 {
+		err := q.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM rocket_events").Scan(&c.Snapshot)
+		if err != nil {
+			return nil, err
 		}
-		rockets = append(rockets, r)
 	}
 
-	return rockets, nil
+	from := "rockets"
+	if limit > 0 {
+		from = rocketsAt
+		args = append([]interface{}{c.Snapshot, c.Snapshot, c.Snapshot}, args...)
+	}
+
+	page := &RocketPage{Rockets: []RocketState{}}
+	// Read one more rocket to know whether there is a next page
+	read := 0
+	if limit > 0 {
+		read = limit + 1
+	}
+	err := q.eachRocket(from, where, args, keys, read, func(r RocketState) error {
+		page.Rockets = append(page.Rockets, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(page.Rockets) > limit {
+		page.Rockets = page.Rockets[:limit]
+		last := page.Rockets[limit-1]
+		page.NextCursor = encodeCursor(cursor{
+			Listing: fingerprint, Snapshot: c.Snapshot, After: sortValues(keys, last), Limit: limit})
+	}
+
+	return page, nil
+}
+
+// EachRocket calls fn for every rocket matching filter, in order, as rows
+// are read from the database. It stops at the first error fn returns.
+func (q *Queries) EachRocket(filter RocketFilter, sortBy []SortKey, fn func(RocketState) error) error {
+	where, args := filter.where()
+	return q.eachRocket("rockets", where, args, orderKeys(sortBy), 0, fn)
+}
+
+// eachRocket calls fn for the rockets of from matching where, sorted by keys,
+// up to limit rockets unless limit is zero. args fill the placeholders of
+// from, then of where.
+func (q *Queries) eachRocket(from, where string, args []interface{}, keys []SortKey, limit int, fn func(RocketState) error) error {
+	query := "SELECT " + rocketColumns + " FROM " + from + where + " ORDER BY " + orderBy(keys)
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := q.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r, err := scanRocket(rows)
+		if err != nil {
+			return err
+		}
+		q.withPending(r)
+		if err := fn(*r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
 }
@@ -2,8 +2,13 @@ package queries
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"reflect"
+	inventory "rocket-service/rockets-inventory"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -20,11 +25,28 @@ func setupDB(t *testing.T) *sql.DB {
             speed INTEGER,
             mission TEXT,
             status TEXT,
-            last_message_number INTEGER DEFAULT 0
+            last_message_number INTEGER DEFAULT 0,
+            last_message_time TEXT,
+            launched_at TEXT,
+            updated_at TEXT
+        );
+        CREATE TABLE rocket_events (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            channel TEXT NOT NULL,
+            message_number INTEGER NOT NULL,
+            message_time TEXT,
+            message_type TEXT NOT NULL,
+            payload TEXT NOT NULL,
+            type TEXT,
+            speed INTEGER,
+            mission TEXT,
+            status TEXT,
+            applied_at TEXT,
+            UNIQUE(channel, message_number)
         )
     `)
 	if err != nil {
-		t.Fatalf("Failed to create table: %v", err)
+		t.Fatalf("Failed to create tables: %v", err)
 	}
 	return db
 }
@@ -61,7 +83,7 @@ func TestGetRocket_NotFound(t *testing.T) {
 
 	queries := NewQueries(db)
 	_, err := queries.GetRocket("non-existent")
-	if err == nil || err.Error() != "rocket not found" {
+	if !errors.Is(err, ErrRocketNotFound) {
 		t.Errorf("Expected 'rocket not found' error, got %v", err)
 	}
 }
@@ -76,10 +98,11 @@ func TestListRockets_SortBySpeed(t *testing.T) {
 	db.Exec("INSERT INTO rockets (channel, speed) VALUES (?, ?)", "chan3", 750)
 
 	queries := NewQueries(db)
-	rockets, err := queries.ListRockets("speed")
+	page, err := queries.ListRockets(ListOptions{SortBy: []SortKey{{Field: "speed"}}})
 	if err != nil {
 		t.Fatalf("ListRockets failed: %v", err)
 	}
+	rockets := page.Rockets
 
 	if len(rockets) != 3 {
 		t.Fatalf("Expected 3 rockets, got %d", len(rockets))
@@ -90,5 +113,649 @@ func TestListRockets_SortBySpeed(t *testing.T) {
 	}
 }
 
+func TestListRockets_Filter(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	// Insert test data
+	db.Exec("INSERT INTO rockets (channel, type, speed, mission, status) VALUES (?, ?, ?, ?, ?)",
+		"chan1", "Falcon-9", 500, "ARTEMIS", "launched")
+	db.Exec("INSERT INTO rockets (channel, type, speed, mission, status) VALUES (?, ?, ?, ?, ?)",
+		"chan2", "Falcon-9", 1500, "ARTEMIS-II", "exploded")
+	db.Exec("INSERT INTO rockets (channel, type, speed, mission, status) VALUES (?, ?, ?, ?, ?)",
+		"chan3", "Starship", 1000, "artemis", "launched")
+	db.Exec("INSERT INTO rockets (channel, type, speed, mission, status) VALUES (?, ?, ?, ?, ?)",
+		"chan4", "Starship", 2000, "SHUTTLE_MIR", "launched")
+
+	tests := []struct {
+		name     string
+		filter   RocketFilter
+		expected []string
+	}{
+		{"no filter", RocketFilter{}, []string{"chan1", "chan2", "chan3", "chan4"}},
+		{"status", RocketFilter{Status: "launched"}, []string{"chan1", "chan3", "chan4"}},
+		{"type", RocketFilter{Type: "Starship"}, []string{"chan3", "chan4"}},
+		{"mission exact", RocketFilter{Mission: "ARTEMIS"}, []string{"chan1"}},
+		{"mission prefix", RocketFilter{MissionPrefix: "ARTEMIS"}, []string{"chan1", "chan2"}},
+		{"prefix wildcard is literal", RocketFilter{MissionPrefix: "%"}, nil},
+		{"min speed", RocketFilter{MinSpeed: intPtr(1000)}, []string{"chan2", "chan3", "chan4"}},
+		{"speed range", RocketFilter{MinSpeed: intPtr(600), MaxSpeed: intPtr(1500)}, []string{"chan2", "chan3"}},
+		{"combined", RocketFilter{Status: "launched", Type: "Starship", MaxSpeed: intPtr(1000)}, []string{"chan3"}},
+	}
+
+	queries := NewQueries(db)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := queries.ListRockets(ListOptions{Filter: tt.filter})
+			if err != nil {
+				t.Fatalf("ListRockets failed: %v", err)
+			}
+			var channels []string
+			for _, r := range page.Rockets {
+				channels = append(channels, r.Channel)
+			}
+			if !reflect.DeepEqual(channels, tt.expected) {
+				t.Errorf("Expected channels %v, got %v", tt.expected, channels)
+			}
+		})
+	}
+}
+
+func TestRocketFilter_Validate(t *testing.T) {
+	invalid := []RocketFilter{
+		{Status: "orbiting"},
+		{Mission: "ARTEMIS", MissionPrefix: "ART"},
+		{MinSpeed: intPtr(-1)},
+		{MaxSpeed: intPtr(-1)},
+		{MinSpeed: intPtr(1000), MaxSpeed: intPtr(500)},
+	}
+	for _, f := range invalid {
+		if err := f.Validate(); err == nil {
+			t.Errorf("Expected validation error for %+v", f)
+		}
+	}
+
+	valid := RocketFilter{Status: "exploded", MinSpeed: intPtr(500), MaxSpeed: intPtr(500)}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected no validation error, got %v", err)
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	keys, err := ParseSort("status,-speed", "")
+	if err != nil {
+		t.Fatalf("ParseSort failed: %v", err)
+	}
+	expected := []SortKey{{Field: "status"}, {Field: "speed", Desc: true}}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, keys)
+	}
+
+	keys, err = ParseSort("status,-speed", "desc")
+	if err != nil {
+		t.Fatalf("ParseSort failed: %v", err)
+	}
+	expected = []SortKey{{Field: "status", Desc: true}, {Field: "speed"}}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, keys)
+	}
+
+	for _, tt := range []struct{ sortBy, order string }{
+		{"altitude", ""},
+		{"speed;DROP TABLE rockets", ""},
+		{"speed", "sideways"},
+	} {
+		if _, err := ParseSort(tt.sortBy, tt.order); err == nil {
+			t.Errorf("Expected error for sort_by=%q order=%q", tt.sortBy, tt.order)
+		}
+	}
+}
+
+func TestListRockets_MultiKeySort(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	db.Exec("INSERT INTO rockets (channel, speed, status) VALUES (?, ?, ?)", "chan1", 500, "launched")
+	db.Exec("INSERT INTO rockets (channel, speed, status) VALUES (?, ?, ?)", "chan2", 900, "exploded")
+	db.Exec("INSERT INTO rockets (channel, speed, status) VALUES (?, ?, ?)", "chan3", 700, "launched")
+	db.Exec("INSERT INTO rockets (channel, speed, status) VALUES (?, ?, ?)", "chan4", 700, "launched")
+
+	keys, _ := ParseSort("status,-speed", "")
+	page, err := NewQueries(db).ListRockets(ListOptions{SortBy: keys})
+	if err != nil {
+		t.Fatalf("ListRockets failed: %v", err)
+	}
+
+	var channels []string
+	for _, r := range page.Rockets {
+		channels = append(channels, r.Channel)
+	}
+	expected := []string{"chan2", "chan3", "chan4", "chan1"}
+	if !reflect.DeepEqual(channels, expected) {
+		t.Errorf("Expected channels %v, got %v", expected, channels)
+	}
+}
+
+func TestListRockets_PaginationUnderInsertsAndDeletes(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	for i := 1; i <= 10; i++ {
+		db.Exec("INSERT INTO rockets (channel, speed) VALUES (?, ?)", fmt.Sprintf("chan%02d", i), i*100)
+	}
+
+	queries := NewQueries(db)
+	keys, _ := ParseSort("speed", "")
+	opts := ListOptions{SortBy: keys, Limit: 3}
+
+	seen := map[string]int{}
+	pages := 0
+	for {
+		page, err := queries.ListRockets(opts)
+		if err != nil {
+			t.Fatalf("ListRockets failed: %v", err)
+		}
+		pages++
+		if len(page.Rockets) > 3 {
+			t.Fatalf("Expected at most 3 rockets per page, got %d", len(page.Rockets))
+		}
+		for _, r := range page.Rockets {
+			seen[r.Channel]++
+		}
+
+		// Between pages, rockets without recorded messages are added before
+		// and after the cursor, and a rocket already listed is deleted
+		db.Exec("INSERT INTO rockets (channel, speed) VALUES (?, ?)", fmt.Sprintf("slow%02d", pages), 0)
+		db.Exec("INSERT INTO rockets (channel, speed) VALUES (?, ?)", fmt.Sprintf("fast%02d", pages), 5000+pages)
+		db.Exec("DELETE FROM rockets WHERE channel = ?", page.Rockets[0].Channel)
+
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+
+	for i := 1; i <= 10; i++ {
+		if channel := fmt.Sprintf("chan%02d", i); seen[channel] != 1 {
+			t.Errorf("Rocket %s returned %d times", channel, seen[channel])
+		}
+	}
+	for channel, count := range seen {
+		if channel[:4] == "slow" {
+			t.Errorf("Rocket %s launched before the cursor was listed", channel)
+		}
+		if channel[:4] == "fast" && count != 1 {
+			t.Errorf("Rocket %s returned %d times", channel, count)
+		}
+	}
+}
+
+func TestListRockets_PaginationUnderSortValueChanges(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	inv := inventory.NewInventory(db)
+	numbers := map[string]int{}
+	send := func(channel, messageType, payload string) {
+		t.Helper()
+		numbers[channel]++
+		err := inv.UpdateRocketState(inventory.RocketMessage{
+			Metadata: inventory.Metadata{Channel: channel, MessageNumber: numbers[channel], MessageType: messageType},
+			Message:  json.RawMessage(payload),
+		})
+		if err != nil {
+			t.Fatalf("Failed to send %s to %s: %v", messageType, channel, err)
+		}
+	}
+	for i := 1; i <= 10; i++ {
+		send(fmt.Sprintf("chan%02d", i), "RocketLaunched", fmt.Sprintf(`{"type":"Falcon-9","launchSpeed":%d,"mission":"ARTEMIS"}`, i*100))
+	}
+
+	queries := NewQueries(db)
+	keys, _ := ParseSort("speed", "")
+	opts := ListOptions{SortBy: keys, Limit: 3}
+
+	seen := map[string]int{}
+	speeds := map[string]int{}
+	pages := 0
+	for {
+		page, err := queries.ListRockets(opts)
+		if err != nil {
+			t.Fatalf("ListRockets failed: %v", err)
+		}
+		pages++
+		for _, r := range page.Rockets {
+			seen[r.Channel]++
+			speeds[r.Channel] = *r.Speed
+		}
+
+		// Between pages, an unread rocket slows down ahead of the cursor, a
+		// listed rocket speeds up past the rockets left to read, an unread
+		// rocket speeds up and a new rocket is launched
+		switch pages {
+		case 1:
+			send("chan10", "RocketSpeedDecreased", `{"by":950}`)
+			send("chan01", "RocketSpeedIncreased", `{"by":5000}`)
+			send("chan05", "RocketSpeedIncreased", `{"by":2000}`)
+			send("late", "RocketLaunched", `{"type":"Falcon-9","launchSpeed":5000,"mission":"ARTEMIS"}`)
+		case 2:
+			send("chan06", "RocketMissionChanged", `{"newMission":"APOLLO"}`)
+			send("chan09", "RocketSpeedDecreased", `{"by":900}`)
+		}
+
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+
+	if pages != 4 {
+		t.Errorf("Expected 4 pages, got %d", pages)
+	}
+	for i := 1; i <= 10; i++ {
+		channel := fmt.Sprintf("chan%02d", i)
+		if seen[channel] != 1 {
+			t.Errorf("Rocket %s returned %d times", channel, seen[channel])
+		}
+		// Every page shows the speeds from when the listing started
+		if speeds[channel] != i*100 {
+			t.Errorf("Expected %s at speed %d, got %d", channel, i*100, speeds[channel])
+		}
+	}
+	if seen["late"] != 0 {
+		t.Errorf("Expected the rocket launched after the first page not to be listed")
+	}
+
+	// A new listing starts from the current state
+	page, err := queries.ListRockets(ListOptions{SortBy: keys, Limit: 2})
+	if err != nil {
+		t.Fatalf("ListRockets failed: %v", err)
+	}
+	if len(page.Rockets) != 2 || page.Rockets[0].Channel != "chan09" || *page.Rockets[0].Speed != 0 ||
+		page.Rockets[1].Channel != "chan10" || *page.Rockets[1].Speed != 50 {
+		t.Errorf("Expected chan09 and chan10 first in a new listing, got %+v", page.Rockets)
+	}
+}
+
+func TestListRockets_PagesMatchFullListing(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	// Missing types, speeds, missions and statuses sort as NULLs
+	db.Exec("INSERT INTO rockets (channel, type, speed, mission, status) VALUES (?, ?, ?, ?, ?)", "chan1", "Falcon-9", 500, "ARTEMIS", "launched")
+	db.Exec("INSERT INTO rockets (channel, type, speed, mission, status) VALUES (?, ?, ?, ?, ?)", "chan2", "Falcon-9", 500, nil, "launched")
+	db.Exec("INSERT INTO rockets (channel, type, speed, mission, status) VALUES (?, ?, ?, ?, ?)", "chan3", "Starship", nil, "ARTEMIS", "exploded")
+	db.Exec("INSERT INTO rockets (channel) VALUES (?)", "chan4")
+	db.Exec("INSERT INTO rockets (channel, type, speed, mission, status) VALUES (?, ?, ?, ?, ?)", "chan5", "Starship", 900, "APOLLO", "launched")
+	db.Exec("INSERT INTO rockets (channel, type, speed, mission) VALUES (?, ?, ?, ?)", "chan6", "Falcon-9", 700, "APOLLO")
+
+	queries := NewQueries(db)
+	for _, sortBy := range []string{"channel", "-channel", "speed", "-speed", "mission,-speed", "-status,type,-mission", "type,speed,mission"} {
+		keys, err := ParseSort(sortBy, "")
+		if err != nil {
+			t.Fatalf("ParseSort(%q) failed: %v", sortBy, err)
+		}
+		full, err := queries.ListRockets(ListOptions{SortBy: keys})
+		if err != nil {
+			t.Fatalf("ListRockets failed: %v", err)
+		}
+
+		var expected, paged []string
+		for _, r := range full.Rockets {
+			expected = append(expected, r.Channel)
+		}
+		opts := ListOptions{SortBy: keys, Limit: 2}
+		for {
+			page, err := queries.ListRockets(opts)
+			if err != nil {
+				t.Fatalf("sort_by=%s: ListRockets failed: %v", sortBy, err)
+			}
+			for _, r := range page.Rockets {
+				paged = append(paged, r.Channel)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			opts.Cursor = page.NextCursor
+		}
+		if !reflect.DeepEqual(paged, expected) {
+			t.Errorf("sort_by=%s: expected pages of %v, got %v", sortBy, expected, paged)
+		}
+	}
+}
+
+func TestListRockets_InvalidCursor(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	for i := 1; i <= 3; i++ {
+		db.Exec("INSERT INTO rockets (channel, speed, status) VALUES (?, ?, ?)", fmt.Sprintf("chan%d", i), i*100, "launched")
+	}
+	queries := NewQueries(db)
+	keys, _ := ParseSort("speed", "")
+	page, err := queries.ListRockets(ListOptions{SortBy: keys, Limit: 1})
+	if err != nil || page.NextCursor == "" {
+		t.Fatalf("Expected a next page, got %+v, %v", page, err)
+	}
+
+	byChannel, _ := ParseSort("channel", "")
+	desc, _ := ParseSort("speed", "desc")
+	for _, tt := range []struct {
+		name string
+		opts ListOptions
+	}{
+		{"not base64", ListOptions{SortBy: keys, Cursor: "not-base64!"}},
+		{"other sort", ListOptions{SortBy: byChannel, Cursor: page.NextCursor}},
+		{"other order", ListOptions{SortBy: desc, Cursor: page.NextCursor}},
+		{"other filter", ListOptions{SortBy: keys, Filter: RocketFilter{Status: "launched"}, Cursor: page.NextCursor}},
+		{"wrong values", ListOptions{SortBy: keys, Cursor: encodeCursor(cursor{Listing: listing(RocketFilter{}, orderKeys(keys)), After: []interface{}{"fast", "chan1"}, Limit: 1})}},
+		{"missing values", ListOptions{SortBy: keys, Cursor: encodeCursor(cursor{Listing: listing(RocketFilter{}, orderKeys(keys)), After: []interface{}{100}, Limit: 1})}},
+		{"limit too large", ListOptions{SortBy: keys, Cursor: encodeCursor(cursor{Listing: listing(RocketFilter{}, orderKeys(keys)), After: []interface{}{100, "chan1"}, Limit: 1000000})}},
+		{"negative limit", ListOptions{SortBy: keys, Cursor: encodeCursor(cursor{Listing: listing(RocketFilter{}, orderKeys(keys)), After: []interface{}{100, "chan1"}, Limit: -1})}},
+		{"negative snapshot", ListOptions{SortBy: keys, Cursor: encodeCursor(cursor{Listing: listing(RocketFilter{}, orderKeys(keys)), Snapshot: -1, After: []interface{}{100, "chan1"}, Limit: 1})}},
+	} {
+		if _, err := queries.ListRockets(tt.opts); err != ErrInvalidCursor {
+			t.Errorf("%s: expected ErrInvalidCursor, got %v", tt.name, err)
+		}
+	}
+
+	// The cursor keeps the page size when the next request has none
+	next, err := queries.ListRockets(ListOptions{SortBy: keys, Cursor: page.NextCursor})
+	if err != nil || len(next.Rockets) != 1 || next.Rockets[0].Channel != "chan2" {
+		t.Errorf("Expected chan2 alone on the next page, got %+v, %v", next, err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	db.Exec("INSERT INTO rockets (channel, type, speed, mission, status) VALUES (?, ?, ?, ?, ?)",
+		"chan1", "Falcon-9", 500, "ARTEMIS", "launched")
+	db.Exec("INSERT INTO rockets (channel, type, speed, mission, status) VALUES (?, ?, ?, ?, ?)",
+		"chan2", "Falcon-9", 1500, "ARTEMIS", "launched")
+	db.Exec("INSERT INTO rockets (channel, type, speed, mission, status) VALUES (?, ?, ?, ?, ?)",
+		"chan3", "Starship", 1000, "SHUTTLE_MIR", "exploded")
+	db.Exec("INSERT INTO rockets (channel, speed) VALUES (?, ?)", "chan4", 200)
+
+	queries := NewQueries(db)
+	stats, err := queries.Stats(RocketFilter{})
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+
+	expected := &FleetStats{
+		Total:    4,
+		ByStatus: map[string]int{"launched": 2, "exploded": 1, "unknown": 1},
+		ByType:   map[string]int{"Falcon-9": 2, "Starship": 1, "unknown": 1},
+		SpeedByType: map[string]SpeedStats{
+			"Falcon-9": {Average: 1000, Max: 1500, Min: 500},
+			"Starship": {Average: 1000, Max: 1000, Min: 1000},
+		},
+		SpeedByMission: map[string]SpeedStats{
+			"ARTEMIS":     {Average: 1000, Max: 1500, Min: 500},
+			"SHUTTLE_MIR": {Average: 1000, Max: 1000, Min: 1000},
+		},
+		ActiveMissions: 1,
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+
+	stats, err = queries.Stats(RocketFilter{Type: "Starship"})
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats.Total != 1 || stats.ActiveMissions != 0 || len(stats.SpeedByType) != 1 {
+		t.Errorf("Unexpected filtered stats: %+v", stats)
+	}
+}
+
+func TestGetRocketAt(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	inv := inventory.NewInventory(db)
+	messages := []inventory.RocketMessage{
+		{
+			Metadata: inventory.Metadata{Channel: "test-channel", MessageNumber: 1, MessageType: "RocketLaunched",
+				MessageTime: "2022-02-02T19:39:05+01:00"},
+			Message: json.RawMessage(`{"type":"Falcon-9","launchSpeed":500,"mission":"ARTEMIS"}`),
+		},
+		{
+			Metadata: inventory.Metadata{Channel: "test-channel", MessageNumber: 2, MessageType: "RocketSpeedIncreased",
+				MessageTime: "2022-02-02T19:39:06+01:00"},
+			Message: json.RawMessage(`{"by":300}`),
+		},
+		{
+			Metadata: inventory.Metadata{Channel: "test-channel", MessageNumber: 3, MessageType: "RocketMissionChanged",
+				MessageTime: "2022-02-02T19:39:07+01:00"},
+			Message: json.RawMessage(`{"newMission":"SHUTTLE_MIR"}`),
+		},
+		{
+			Metadata: inventory.Metadata{Channel: "test-channel", MessageNumber: 4, MessageType: "RocketExploded",
+				MessageTime: "2022-02-02T19:39:08+01:00"},
+			Message: json.RawMessage(`{"reason":"PRESSURE_VESSEL_FAILURE"}`),
+		},
+	}
+	for _, msg := range messages {
+		if err := inv.UpdateRocketState(msg); err != nil {
+			t.Fatalf("Failed to process message %d: %v", msg.Metadata.MessageNumber, err)
+		}
+	}
+
+	queries := NewQueries(db)
+
+	// The state is replayed from the messages, not read from the state
+	// recorded with them
+	db.Exec("UPDATE rocket_events SET speed = 0, mission = NULL")
+
+	rocket, err := queries.GetRocketAt("test-channel", At{MessageNumber: 2})
+	if err != nil {
+		t.Fatalf("GetRocketAt failed: %v", err)
+	}
+	var temporary int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_temp_master").Scan(&temporary)
+	if temporary != 0 {
+		t.Errorf("Expected the replay table to be dropped, found %d temporary objects", temporary)
+	}
+	var appliedAt string
+	db.QueryRow("SELECT applied_at FROM rocket_events WHERE message_number = 2").Scan(&appliedAt)
+	expected := &RocketState{
+		Channel:           "test-channel",
+		Type:              stringPtr("Falcon-9"),
+		Speed:             intPtr(800),
+		Mission:           stringPtr("ARTEMIS"),
+		Status:            stringPtr("launched"),
+		LastMessageNumber: 2,
+		LastMessageTime:   stringPtr("2022-02-02T19:39:06+01:00"),
+		LaunchedAt:        stringPtr("2022-02-02T19:39:05+01:00"),
+		UpdatedAt:         &appliedAt,
+	}
+	if !reflect.DeepEqual(rocket, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, rocket)
+	}
+
+	// 18:39:07.5 UTC is between messages 3 and 4
+	at := time.Date(2022, 2, 2, 18, 39, 7, 500000000, time.UTC)
+	rocket, err = queries.GetRocketAt("test-channel", At{Time: &at})
+	if err != nil {
+		t.Fatalf("GetRocketAt failed: %v", err)
+	}
+	if *rocket.Mission != "SHUTTLE_MIR" || *rocket.Status != "launched" {
+		t.Errorf("Expected launched rocket on SHUTTLE_MIR, got %+v", rocket)
+	}
+
+	// Replaying every message matches the live state, which is left untouched
+	rocket, err = queries.GetRocketAt("test-channel", At{MessageNumber: 100})
+	if err != nil {
+		t.Fatalf("GetRocketAt failed: %v", err)
+	}
+	live, err := queries.GetRocket("test-channel")
+	if err != nil {
+		t.Fatalf("GetRocket failed: %v", err)
+	}
+	if !reflect.DeepEqual(rocket, live) {
+		t.Errorf("Expected replayed state %+v to match live state %+v", rocket, live)
+	}
+
+	before := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := queries.GetRocketAt("test-channel", At{Time: &before}); !errors.Is(err, ErrRocketNotFound) {
+		t.Errorf("Expected 'rocket not found' before launch, got %v", err)
+	}
+	if _, err := queries.GetRocketAt("non-existent", At{MessageNumber: 1}); !errors.Is(err, ErrRocketNotFound) {
+		t.Errorf("Expected 'rocket not found' error, got %v", err)
+	}
+}
+
+func TestListEvents(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	inv := inventory.NewInventory(db)
+	for i, payload := range []string{
+		`{"type":"Falcon-9","launchSpeed":500,"mission":"ARTEMIS"}`,
+		`{"by":300}`,
+		`{"by":200}`,
+		`{"by":1000}`,
+		`{"reason":"PRESSURE_VESSEL_FAILURE"}`,
+	} {
+		messageType := "RocketSpeedIncreased"
+		switch i {
+		case 0:
+			messageType = "RocketLaunched"
+		case 3:
+			messageType = "RocketSpeedDecreased"
+		case 4:
+			messageType = "RocketExploded"
+		}
+		msg := inventory.RocketMessage{
+			Metadata: inventory.Metadata{Channel: "test-channel", MessageNumber: i + 1, MessageType: messageType},
+			Message:  json.RawMessage(payload),
+		}
+		if err := inv.UpdateRocketState(msg); err != nil {
+			t.Fatalf("Failed to process message %d: %v", i+1, err)
+		}
+	}
+
+	queries := NewQueries(db)
+
+	page, err := queries.ListEvents("test-channel", EventOptions{})
+	if err != nil {
+		t.Fatalf("ListEvents failed: %v", err)
+	}
+	if len(page.Events) != 5 || page.NextCursor != "" {
+		t.Fatalf("Expected 5 events and no cursor, got %+v", page)
+	}
+	last := page.Events[4]
+	if last.MessageType != "RocketExploded" || *last.Speed != 0 || *last.Status != "exploded" {
+		t.Errorf("Unexpected last event: %+v", last)
+	}
+
+	// Page through the speed increases one at a time
+	opts := EventOptions{MessageType: "RocketSpeedIncreased", Limit: 1}
+	var speeds []int
+	for {
+		page, err := queries.ListEvents("test-channel", opts)
+		if err != nil {
+			t.Fatalf("ListEvents failed: %v", err)
+		}
+		for _, e := range page.Events {
+			speeds = append(speeds, *e.Speed)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	if !reflect.DeepEqual(speeds, []int{800, 1000}) {
+		t.Errorf("Expected speeds [800 1000], got %v", speeds)
+	}
+
+	if _, err := queries.ListEvents("non-existent", EventOptions{}); !errors.Is(err, ErrRocketNotFound) {
+		t.Errorf("Expected 'rocket not found' error, got %v", err)
+	}
+	if _, err := queries.ListEvents("test-channel", EventOptions{Cursor: "%%%"}); err != ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestMissions(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	inv := inventory.NewInventory(db)
+	message := func(channel string, number int, messageType, payload string) inventory.RocketMessage {
+		return inventory.RocketMessage{
+			Metadata: inventory.Metadata{Channel: channel, MessageNumber: number, MessageType: messageType,
+				MessageTime: fmt.Sprintf("2022-02-02T19:39:0%d+01:00", number)},
+			Message: json.RawMessage(payload),
+		}
+	}
+	for _, msg := range []inventory.RocketMessage{
+		message("chan1", 1, "RocketLaunched", `{"type":"Falcon-9","launchSpeed":500,"mission":"ARTEMIS"}`),
+		message("chan2", 1, "RocketLaunched", `{"type":"Falcon-9","launchSpeed":700,"mission":"ARTEMIS"}`),
+		message("chan2", 2, "RocketMissionChanged", `{"newMission":"SHUTTLE_MIR"}`),
+		message("chan3", 1, "RocketLaunched", `{"type":"Starship","launchSpeed":1000,"mission":"SHUTTLE_MIR"}`),
+		message("chan3", 2, "RocketExploded", `{"reason":"PRESSURE_VESSEL_FAILURE"}`),
+	} {
+		if err := inv.UpdateRocketState(msg); err != nil {
+			t.Fatalf("Failed to process message: %v", err)
+		}
+	}
+
+	queries := NewQueries(db)
+	missions, err := queries.ListMissions()
+	if err != nil {
+		t.Fatalf("ListMissions failed: %v", err)
+	}
+	expected := []Mission{
+		{
+			Name:                "ARTEMIS",
+			RocketCount:         1,
+			PreviousRocketCount: 1,
+			ByStatus:            map[string]int{"launched": 1},
+			Speed:               &SpeedStats{Average: 500, Max: 500, Min: 500},
+		},
+		{
+			Name:        "SHUTTLE_MIR",
+			RocketCount: 2,
+			ByStatus:    map[string]int{"launched": 1, "exploded": 1},
+			Speed:       &SpeedStats{Average: 850, Max: 1000, Min: 700},
+		},
+	}
+	if !reflect.DeepEqual(missions, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, missions)
+	}
+
+	mission, err := queries.GetMission("ARTEMIS")
+	if err != nil {
+		t.Fatalf("GetMission failed: %v", err)
+	}
+	if len(mission.Rockets) != 2 {
+		t.Fatalf("Expected 2 rockets, got %+v", mission.Rockets)
+	}
+	current, previous := mission.Rockets[0], mission.Rockets[1]
+	if current.Channel != "chan1" || !current.Current || *current.AssignedAt != "2022-02-02T19:39:01+01:00" {
+		t.Errorf("Unexpected current rocket: %+v", current)
+	}
+	if previous.Channel != "chan2" || previous.Current || *previous.Mission != "SHUTTLE_MIR" ||
+		*previous.AssignedAt != "2022-02-02T19:39:01+01:00" {
+		t.Errorf("Unexpected previous rocket: %+v", previous)
+	}
+
+	mission, err = queries.GetMission("SHUTTLE_MIR")
+	if err != nil {
+		t.Fatalf("GetMission failed: %v", err)
+	}
+	if *mission.Rockets[0].AssignedAt != "2022-02-02T19:39:02+01:00" {
+		t.Errorf("Expected chan2 to join SHUTTLE_MIR with message 2, got %+v", mission.Rockets[0])
+	}
+
+	if _, err := queries.GetMission("APOLLO"); !errors.Is(err, ErrMissionNotFound) {
+		t.Errorf("Expected ErrMissionNotFound, got %v", err)
+	}
+}
+
 func stringPtr(s string) *string { return &s }
 func intPtr(i int) *int          { return &i }
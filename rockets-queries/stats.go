@@ -0,0 +1,139 @@
+package queries
+
+import (
+	"context"
+	"database/sql"
+)
+
+type SpeedStats struct {
+	Average float64 `json:"average"`
+	Max     int     `json:"max"`
+	Min     int     `json:"min"`
+}
+
+type FleetStats struct {
+	Total          int                   `json:"total"`
+	ByStatus       map[string]int        `json:"byStatus"`
+	ByType         map[string]int        `json:"byType"`
+	SpeedByType    map[string]SpeedStats `json:"speedByType"`
+	SpeedByMission map[string]SpeedStats `json:"speedByMission"`
+	ActiveMissions int                   `json:"activeMissions"`
+}
+
+// Rockets whose type or status is not known yet are grouped under this key.
+const unknownGroup = "unknown"
+
+// querier runs queries on the database or within a transaction.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// readTx starts a read-only transaction, so the queries combined into one
+// result see the same state of the database while messages are applied.
+func (q *Queries) readTx() (*sql.Tx, error) {
+	return q.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+}
+
+// Stats aggregates the rockets matching filter. A mission is active while at
+// least one rocket assigned to it has not exploded.
+func (q *Queries) Stats(filter RocketFilter) (*FleetStats, error) {
+	where, args := filter.where()
+	stats := &FleetStats{
+		ByStatus:       map[string]int{},
+		ByType:         map[string]int{},
+		SpeedByType:    map[string]SpeedStats{},
+		SpeedByMission: map[string]SpeedStats{},
+	}
+
+	tx, err := q.readTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT COUNT(*) FROM rockets"+where, args...).Scan(&stats.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow("SELECT COUNT(DISTINCT mission) FROM rockets"+
+		and(where, "status = 'launched' AND mission IS NOT NULL"), args...).Scan(&stats.ActiveMissions)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := countBy(tx, "status", where, args, stats.ByStatus); err != nil {
+		return nil, err
+	}
+	if err := countBy(tx, "type", where, args, stats.ByType); err != nil {
+		return nil, err
+	}
+	if err := speedBy(tx, "type", where, args, stats.SpeedByType); err != nil {
+		return nil, err
+	}
+	if err := speedBy(tx, "mission", where, args, stats.SpeedByMission); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// RocketsByStatus counts the rockets of the whole fleet by status.
+func (q *Queries) RocketsByStatus() (map[string]int, error) {
+	counts := map[string]int{}
+	if err := countBy(q.db, "status", "", nil, counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+func countBy(db querier, column, where string, args []interface{}, counts map[string]int) error {
+	rows, err := db.Query("SELECT COALESCE("+column+", '"+unknownGroup+"'), COUNT(*) FROM rockets"+where+
+		" GROUP BY 1", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			return err
+		}
+		counts[key] = count
+	}
+	return rows.Err()
+}
+
+// speedBy computes speed statistics grouped by column, ignoring rockets
+// without a known speed or group.
+func speedBy(db querier, column, where string, args []interface{}, speeds map[string]SpeedStats) error {
+	rows, err := db.Query("SELECT "+column+", AVG(speed), MAX(speed), MIN(speed) FROM rockets"+
+		and(where, column+" IS NOT NULL AND speed IS NOT NULL")+" GROUP BY "+column, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var s SpeedStats
+		var avg sql.NullFloat64
+		if err := rows.Scan(&key, &avg, &s.Max, &s.Min); err != nil {
+			return err
+		}
+		s.Average = avg.Float64
+		speeds[key] = s
+	}
+	return rows.Err()
+}
+
+// and appends condition to a WHERE clause built by RocketFilter.where.
+func and(where, condition string) string {
+	if where == "" {
+		return " WHERE " + condition
+	}
+	return where + " AND " + condition
+}
@@ -0,0 +1,110 @@
+package queries
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	storage "rocket-service/rockets-storage"
+)
+
+// Version identifies a state of a rocket or of the whole fleet. Number grows
+// with every applied message and Modified is when that message was applied,
+// zero when unknown. Pending changes with the messages waiting to be
+// applied, which are part of the current states too: it is their count for
+// a rocket and a checksum of the counts of every rocket for the fleet.
+type Version struct {
+	Number   int64
+	Pending  uint64
+	Modified time.Time
+}
+
+// RocketVersion returns the version of a rocket, based on the number of the
+// last message applied to it.
+func (q *Queries) RocketVersion(channel string) (*Version, error) {
+	var v Version
+	var appliedAt sql.NullString
+	err := q.db.QueryRow(`
+        SELECT r.last_message_number, e.applied_at
+        FROM rockets r
+        LEFT JOIN rocket_events e ON e.channel = r.channel AND e.message_number = r.last_message_number
+        WHERE r.channel = ?`, channel).Scan(&v.Number, &appliedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrRocketNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v.Modified = parseTimestamp(appliedAt)
+	if q.pending != nil {
+		v.Pending = uint64(q.pending.PendingMessages(channel))
+	}
+	// Buffering a message changes the rocket but not when it was last applied
+	if v.Pending > 0 {
+		v.Modified = time.Time{}
+	}
+	return &v, nil
+}
+
+// FleetVersion returns the version of the fleet as a whole: the sequence
+// number of the last message applied to any rocket.
+func (q *Queries) FleetVersion() (*Version, error) {
+	var v Version
+	var appliedAt sql.NullString
+	err := q.db.QueryRow("SELECT id, applied_at FROM rocket_events ORDER BY id DESC LIMIT 1").Scan(&v.Number, &appliedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	v.Modified = parseTimestamp(appliedAt)
+	if q.pending != nil {
+		v.Pending = pendingChecksum(q.pending.BufferDepths())
+	}
+	if v.Pending > 0 {
+		v.Modified = time.Time{}
+	}
+	return &v, nil
+}
+
+// pendingChecksum sums up the pending messages of every rocket, zero when
+// none is waiting.
+func pendingChecksum(depths map[string]int) uint64 {
+	if len(depths) == 0 {
+		return 0
+	}
+	channels := make([]string, 0, len(depths))
+	for channel := range depths {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	h := fnv.New64a()
+	for _, channel := range channels {
+		fmt.Fprintf(h, "%s=%d\n", channel, depths[channel])
+	}
+	// Keep zero for an empty buffer
+	return h.Sum64() | 1
+}
+
+func parseTimestamp(s sql.NullString) time.Time {
+	if !s.Valid {
+		return time.Time{}
+	}
+	t, err := time.Parse(storage.TimestampFormat, s.String)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// SchemaVersion returns the version of the database schema, as recorded by
+// the migrations. An error means the database cannot be queried.
+func (q *Queries) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := q.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	return version, err
+}
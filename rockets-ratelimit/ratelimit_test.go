@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	l := New(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("chan1"); !ok {
+			t.Fatalf("Expected request %d of the burst to be allowed", i+1)
+		}
+	}
+	ok, wait := l.Allow("chan1")
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms once the burst is spent, got %v and %s", ok, wait)
+	}
+	// Buckets are independent
+	if ok, _ := l.Allow("chan2"); !ok {
+		t.Error("Expected another key to have its own bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("chan1"); !ok {
+		t.Error("Expected a token after 500ms")
+	}
+	if ok, _ := l.Allow("chan1"); ok {
+		t.Error("Expected the refilled token to be spent")
+	}
+
+	// Refilled buckets are dropped
+	now = now.Add(time.Minute)
+	l.Allow("chan3")
+	if len(l.buckets) != 1 {
+		t.Errorf("Expected only the new bucket to be kept, got %d buckets", len(l.buckets))
+	}
+}
+
+func TestWait(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	l := New(2, 1)
+	l.now = func() time.Time { return now }
+
+	if wait := l.Wait("chan1"); wait != 0 {
+		t.Errorf("Expected no wait for an unknown key, got %s", wait)
+	}
+	if wait := l.Wait("chan1"); wait != 0 {
+		t.Errorf("Expected Wait to take no token, got %s", wait)
+	}
+	l.Allow("chan1")
+	if wait := l.Wait("chan1"); wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms once the burst is spent, got %s", wait)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if wait := l.Wait("chan1"); wait != 0 {
+		t.Errorf("Expected a token after 500ms, got %s", wait)
+	}
+}
+
+func TestAllow_Disabled(t *testing.T) {
+	l := New(0, 10)
+	if l != nil {
+		t.Fatalf("Expected no limiter without a rate")
+	}
+	if ok, _ := l.Allow("chan1"); !ok || l.Wait("chan1") != 0 {
+		t.Error("Expected a nil limiter to allow everything")
+	}
+}
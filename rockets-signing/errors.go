@@ -0,0 +1,24 @@
+package signing
+
+import "errors"
+
+var (
+	// ErrKeyNotFound is returned when no key has the requested ID.
+	ErrKeyNotFound = errors.New("signing key not found")
+
+	// ErrKeyInactive is returned when rotating a revoked or expired key.
+	ErrKeyInactive = errors.New("signing key is revoked or expired")
+
+	// ErrSignatureRequired is returned for unsigned messages of a channel that
+	// has keys, or of any channel when signatures are required.
+	ErrSignatureRequired = errors.New("message signature required")
+
+	// ErrInvalidSignature is returned when a signature is malformed, names an
+	// unknown or inactive key, or does not match the message.
+	ErrInvalidSignature = errors.New("invalid message signature")
+
+	// ErrSignatureExpired is returned when the timestamp of a signature is
+	// outside the accepted window, which keeps captured messages from being
+	// replayed later.
+	ErrSignatureExpired = errors.New("message signature timestamp outside the accepted window")
+)
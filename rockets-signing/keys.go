@@ -0,0 +1,235 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	storage "rocket-service/rockets-storage"
+)
+
+// AnyChannel is the channel of sender keys, which can sign messages of every
+// channel.
+const AnyChannel = "*"
+
+// Key is a shared secret that signs the messages of a channel. Secret is only
+// returned when the key is created.
+type Key struct {
+	ID        string  `json:"id"`
+	Channel   string  `json:"channel"`
+	Secret    string  `json:"secret,omitempty"`
+	CreatedAt string  `json:"createdAt"`
+	ExpiresAt *string `json:"expiresAt,omitempty"`
+	RevokedAt *string `json:"revokedAt,omitempty"`
+	Active    bool    `json:"active"`
+}
+
+// Signature is what a sender sends along a message: the key it signed with,
+// the Unix time it signed at and the hex encoded HMAC-SHA256.
+type Signature struct {
+	KeyID     string
+	Timestamp int64
+	MAC       string
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the timestamp, a dot and the
+// body, keyed with the secret.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Keys stores the signing keys in the database and verifies signatures.
+type Keys struct {
+	db *sql.DB
+	// maxSkew is how far the timestamp of a signature may be from now
+	maxSkew time.Duration
+	now     func() time.Time
+}
+
+func NewKeys(db *sql.DB, maxSkew time.Duration) *Keys {
+	return &Keys{db: db, maxSkew: maxSkew, now: time.Now}
+}
+
+// execer runs statements on the database or within a transaction.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Create adds a key with a random secret for channel, or for every channel
+// with AnyChannel. A nil expiresAt never expires.
+func (k *Keys) Create(channel string, expiresAt *time.Time) (*Key, error) {
+	return k.create(k.db, channel, expiresAt)
+}
+
+func (k *Keys) create(db execer, channel string, expiresAt *time.Time) (*Key, error) {
+	if channel == "" {
+		return nil, fmt.Errorf("channel must not be empty")
+	}
+	id, err := storage.RandomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := storage.RandomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{
+		ID:        "key_" + id,
+		Channel:   channel,
+		Secret:    secret,
+		CreatedAt: k.now().UTC().Format(storage.TimestampFormat),
+		Active:    true,
+	}
+	if expiresAt != nil {
+		expires := expiresAt.UTC().Format(storage.TimestampFormat)
+		key.ExpiresAt = &expires
+		key.Active = expiresAt.After(k.now())
+	}
+	_, err = db.Exec("INSERT INTO signing_keys (id, channel, secret, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		key.ID, key.Channel, key.Secret, key.CreatedAt, key.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// List returns every key, active or not, without their secrets.
+func (k *Keys) List() ([]Key, error) {
+	rows, err := k.db.Query("SELECT id, channel, created_at, expires_at, revoked_at FROM signing_keys ORDER BY channel, created_at, rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []Key{}
+	now := k.now()
+	for rows.Next() {
+		var key Key
+		if err := rows.Scan(&key.ID, &key.Channel, &key.CreatedAt, &key.ExpiresAt, &key.RevokedAt); err != nil {
+			return nil, err
+		}
+		key.Active = active(key.ExpiresAt, key.RevokedAt, now)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Revoke deactivates a key at once.
+func (k *Keys) Revoke(id string) error {
+	result, err := k.db.Exec("UPDATE signing_keys SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?",
+		k.now().UTC().Format(storage.TimestampFormat), id)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		if err == nil {
+			err = ErrKeyNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// Rotate creates a key for the channel of key id and makes the old key expire
+// after overlap, leaving senders that long to switch to the new one. Revoked
+// and expired keys cannot be rotated, as that would bring their channel back
+// under signing. The old key is only changed if the new one is created.
+func (k *Keys) Rotate(id string, overlap time.Duration) (*Key, error) {
+	tx, err := k.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Updating first takes the write lock, so a concurrent rotation or
+	// revocation cannot change the key between the check and the insert. An
+	// earlier expiry is kept.
+	now := k.now()
+	expires := now.Add(overlap).UTC().Format(storage.TimestampFormat)
+	result, err := tx.Exec(`
+        UPDATE signing_keys SET expires_at = CASE WHEN expires_at IS NULL OR expires_at > ? THEN ? ELSE expires_at END
+        WHERE id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)`,
+		expires, expires, id, now.UTC().Format(storage.TimestampFormat))
+	if err != nil {
+		return nil, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	var channel string
+	err = tx.QueryRow("SELECT channel FROM signing_keys WHERE id = ?", id).Scan(&channel)
+	if err == sql.ErrNoRows {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if updated == 0 {
+		return nil, ErrKeyInactive
+	}
+
+	key, err := k.create(tx, channel, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Covered reports whether an active key can sign the messages of channel,
+// in which case its messages must be signed.
+func (k *Keys) Covered(channel string) (bool, error) {
+	now := k.now().UTC().Format(storage.TimestampFormat)
+	var count int
+	err := k.db.QueryRow(`
+        SELECT COUNT(*) FROM signing_keys
+        WHERE channel IN (?, ?) AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)`,
+		channel, AnyChannel, now).Scan(&count)
+	return count > 0, err
+}
+
+// Verify checks that sig was made for body, a message of channel, with an
+// active key of the channel, within the accepted window around now.
+func (k *Keys) Verify(sig Signature, channel string, body []byte) error {
+	now := k.now()
+	signedAt := time.Unix(sig.Timestamp, 0)
+	if signedAt.Before(now.Add(-k.maxSkew)) || signedAt.After(now.Add(k.maxSkew)) {
+		return ErrSignatureExpired
+	}
+
+	var keyChannel, secret string
+	var expiresAt, revokedAt *string
+	err := k.db.QueryRow("SELECT channel, secret, expires_at, revoked_at FROM signing_keys WHERE id = ?", sig.KeyID).
+		Scan(&keyChannel, &secret, &expiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return ErrInvalidSignature
+	}
+	if err != nil {
+		return err
+	}
+	if keyChannel != channel && keyChannel != AnyChannel || !active(expiresAt, revokedAt, now) {
+		return ErrInvalidSignature
+	}
+
+	expected := Sign(secret, sig.Timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(sig.MAC)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func active(expiresAt, revokedAt *string, now time.Time) bool {
+	return revokedAt == nil && (expiresAt == nil || *expiresAt > now.UTC().Format(storage.TimestampFormat))
+}
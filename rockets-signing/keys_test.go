@@ -0,0 +1,178 @@
+package signing
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func setupKeys(t *testing.T) (*Keys, *time.Time) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(`
+        CREATE TABLE signing_keys (
+            id TEXT PRIMARY KEY,
+            channel TEXT NOT NULL,
+            secret TEXT NOT NULL,
+            created_at TEXT NOT NULL,
+            expires_at TEXT,
+            revoked_at TEXT
+        )
+    `)
+	if err != nil {
+		t.Fatalf("Failed to create tables: %v", err)
+	}
+
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	keys := NewKeys(db, 5*time.Minute)
+	keys.now = func() time.Time { return now }
+	return keys, &now
+}
+
+func TestVerify(t *testing.T) {
+	keys, now := setupKeys(t)
+	key, err := keys.Create("chan1", nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	sender, err := keys.Create(AnyChannel, nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	body := []byte(`{"metadata":{"channel":"chan1"}}`)
+	signedAt := now.Unix()
+	valid := Signature{KeyID: key.ID, Timestamp: signedAt, MAC: Sign(key.Secret, signedAt, body)}
+
+	tests := []struct {
+		name     string
+		sig      Signature
+		channel  string
+		body     []byte
+		expected error
+	}{
+		{"valid", valid, "chan1", body, nil},
+		{"sender key", Signature{KeyID: sender.ID, Timestamp: signedAt, MAC: Sign(sender.Secret, signedAt, body)}, "chan2", body, nil},
+		{"other channel", valid, "chan2", body, ErrInvalidSignature},
+		{"tampered body", valid, "chan1", []byte(`{"metadata":{"channel":"chan2"}}`), ErrInvalidSignature},
+		{"unknown key", Signature{KeyID: "key_unknown", Timestamp: signedAt, MAC: valid.MAC}, "chan1", body, ErrInvalidSignature},
+		{"old timestamp", Signature{KeyID: key.ID, Timestamp: signedAt - 301, MAC: Sign(key.Secret, signedAt-301, body)}, "chan1", body, ErrSignatureExpired},
+		{"future timestamp", Signature{KeyID: key.ID, Timestamp: signedAt + 301, MAC: Sign(key.Secret, signedAt+301, body)}, "chan1", body, ErrSignatureExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := keys.Verify(tt.sig, tt.channel, tt.body); !errors.Is(err, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+
+	if err := keys.Revoke(key.ID); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if err := keys.Verify(valid, "chan1", body); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected revoked keys to be refused, got %v", err)
+	}
+	if err := keys.Revoke("key_unknown"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	keys, now := setupKeys(t)
+	old, err := keys.Create("chan1", nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if covered, _ := keys.Covered("chan2"); covered {
+		t.Errorf("Expected chan2 to have no key")
+	}
+
+	rotated, err := keys.Rotate(old.ID, time.Hour)
+	if err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if rotated.Channel != "chan1" || rotated.Secret == old.Secret {
+		t.Errorf("Unexpected new key: %+v", rotated)
+	}
+
+	body := []byte("{}")
+	sign := func(key *Key) Signature {
+		return Signature{KeyID: key.ID, Timestamp: now.Unix(), MAC: Sign(key.Secret, now.Unix(), body)}
+	}
+	// Both keys are accepted during the overlap, then only the new one
+	for _, key := range []*Key{old, rotated} {
+		if err := keys.Verify(sign(key), "chan1", body); err != nil {
+			t.Errorf("Expected %s to be accepted during the overlap, got %v", key.ID, err)
+		}
+	}
+	*now = now.Add(time.Hour)
+	if err := keys.Verify(sign(old), "chan1", body); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected the old key to expire, got %v", err)
+	}
+	if err := keys.Verify(sign(rotated), "chan1", body); err != nil {
+		t.Errorf("Expected the new key to be accepted, got %v", err)
+	}
+
+	list, err := keys.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(list) != 2 || list[0].Active || !list[1].Active || list[0].Secret != "" {
+		t.Errorf("Unexpected keys: %+v", list)
+	}
+	if covered, _ := keys.Covered("chan1"); !covered {
+		t.Errorf("Expected chan1 to have an active key")
+	}
+	if _, err := keys.Rotate("key_unknown", time.Hour); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// Rotating an inactive key would make a new active one
+	if _, err := keys.Rotate(old.ID, time.Hour); !errors.Is(err, ErrKeyInactive) {
+		t.Errorf("Expected the expired key to be refused, got %v", err)
+	}
+	if err := keys.Revoke(rotated.ID); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if _, err := keys.Rotate(rotated.ID, time.Hour); !errors.Is(err, ErrKeyInactive) {
+		t.Errorf("Expected the revoked key to be refused, got %v", err)
+	}
+	if covered, _ := keys.Covered("chan1"); covered {
+		t.Errorf("Expected chan1 to have no active key left")
+	}
+}
+
+func TestRotate_FailureChangesNothing(t *testing.T) {
+	for _, statement := range []string{"INSERT", "UPDATE"} {
+		keys, _ := setupKeys(t)
+		old, err := keys.Create("chan1", nil)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+
+		_, err = keys.db.Exec(`
+            CREATE TRIGGER refuse BEFORE ` + statement + ` ON signing_keys
+            BEGIN SELECT RAISE(ABORT, 'refused'); END`)
+		if err != nil {
+			t.Fatalf("Failed to create trigger: %v", err)
+		}
+		if _, err := keys.Rotate(old.ID, time.Hour); err == nil {
+			t.Fatalf("%s refused: expected Rotate to fail", statement)
+		}
+
+		list, err := keys.List()
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		if len(list) != 1 || list[0].ExpiresAt != nil || !list[0].Active {
+			t.Errorf("%s refused: expected the old key alone and unchanged, got %+v", statement, list)
+		}
+	}
+}
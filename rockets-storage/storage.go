@@ -0,0 +1,20 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// TimestampFormat is the layout of the server timestamps stored in the
+// database. It has a fixed width so timestamps sort as text.
+const TimestampFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// RandomHex returns n random bytes, hex encoded, for the identifiers and
+// secrets of stored keys.
+func RandomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetup_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	shutdown, err := Setup(ExporterFile, path, 1)
+	if err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	_, span := otel.Tracer("test").Start(context.Background(), "operation")
+	End(span, errors.New("failed"))
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read traces: %v", err)
+	}
+	var recorded struct {
+		Name   string
+		Status struct{ Code string }
+	}
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		t.Fatalf("Expected one JSON span, got %q: %v", data, err)
+	}
+	if recorded.Name != "operation" || recorded.Status.Code != "Error" {
+		t.Errorf("Unexpected span: %s", data)
+	}
+}
+
+func TestSetup_UnknownExporter(t *testing.T) {
+	if _, err := Setup("jaeger", "", 1); err == nil || !strings.Contains(err.Error(), "unknown trace exporter") {
+		t.Errorf("Expected an unknown exporter error, got %v", err)
+	}
+}